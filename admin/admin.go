@@ -0,0 +1,192 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/Orlion/cat-agent/cat"
+	"github.com/Orlion/cat-agent/cat/config"
+	"github.com/Orlion/cat-agent/log"
+	"github.com/Orlion/cat-agent/metrics"
+	"github.com/Orlion/cat-agent/server"
+	"github.com/Orlion/cat-agent/status"
+)
+
+type ServerStatus struct {
+	ConnNum int64 `json:"conn_num"`
+}
+
+type AgentStatus struct {
+	Domain    string       `json:"domain"`
+	Routers   []string     `json:"routers"`
+	Sample    float64      `json:"sample"`
+	Enabled   bool         `json:"enabled"`
+	Server    ServerStatus `json:"server"`
+	Cat       cat.Stats    `json:"cat"`
+	Heartbeat string       `json:"heartbeat"`
+}
+
+type Server struct {
+	addr     string
+	srv      *server.Server
+	httpSrv  *http.Server
+	listener net.Listener
+}
+
+func NewServer(conf *Config, srv *server.Server) *Server {
+	s := &Server{
+		addr: conf.Addr,
+		srv:  srv,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	s.httpSrv = &http.Server{Handler: mux}
+
+	s.registerMetrics()
+
+	return s
+}
+
+// registerMetrics exposes the values owned by other components, they are read on every scrape.
+func (s *Server) registerMetrics() {
+	metrics.NewCounterFunc("cat_agent_sender_dropped_total", "Message trees thrown away by the sender.", func() float64 {
+		return float64(cat.GetStats().Sender.Dropped)
+	})
+	metrics.NewCounterFunc("cat_agent_sender_spooled_total", "Message trees written to the spool.", func() float64 {
+		return float64(cat.GetStats().Sender.Spooled)
+	})
+	metrics.NewCounterFunc("cat_agent_sender_replayed_total", "Spooled message trees sent after the connection recovered.", func() float64 {
+		return float64(cat.GetStats().Sender.Replayed)
+	})
+	metrics.NewGaugeFunc("cat_agent_sender_spool_bytes", "Size of the spool on disk.", func() float64 {
+		return float64(cat.GetStats().Sender.SpoolBytes)
+	})
+	metrics.NewGaugeFunc("cat_agent_sender_normal_queue_len", "Depth of the normal queue of the sender.", func() float64 {
+		return float64(cat.GetStats().Sender.NormalQueueLen)
+	})
+	metrics.NewGaugeFunc("cat_agent_sender_high_queue_len", "Depth of the high queue of the sender.", func() float64 {
+		return float64(cat.GetStats().Sender.HighQueueLen)
+	})
+	metrics.NewGaugeFunc("cat_agent_sender_healthy_routers", "Routers the sender has not seen an error from since they last recovered.", func() float64 {
+		healthy := 0
+		for _, router := range cat.GetStats().Sender.Routers {
+			if router.Healthy {
+				healthy++
+			}
+		}
+		return float64(healthy)
+	})
+	metrics.NewGaugeFunc("cat_agent_aggregator_transactions", "Transactions waiting for the next flush of the aggregator.", func() float64 {
+		return float64(cat.GetStats().Aggregator.Transactions)
+	})
+	metrics.NewGaugeFunc("cat_agent_aggregator_events", "Events waiting for the next flush of the aggregator.", func() float64 {
+		return float64(cat.GetStats().Aggregator.Events)
+	})
+	metrics.NewGaugeFunc("cat_agent_aggregator_metrics", "Metrics waiting for the next flush of the aggregator.", func() float64 {
+		return float64(cat.GetStats().Aggregator.Metrics)
+	})
+	metrics.NewGaugeFunc("cat_agent_server_connections", "Active connections of the agent server.", func() float64 {
+		return float64(s.srv.ConnNum())
+	})
+	metrics.NewGaugeFunc("cat_agent_sample", "Sample rate given by the router server.", func() float64 {
+		return config.GetInstance().GetSample()
+	})
+	metrics.NewGaugeFunc("cat_agent_sample_effective_rate", "Part of the trees that can be discarded sent by the sampler.", func() float64 {
+		return cat.GetStats().Sampler.EffectiveRate
+	})
+	metrics.NewGaugeFunc("cat_agent_enabled", "Whether cat is enabled by the router server.", func() float64 {
+		if config.GetInstance().IsEnabled() {
+			return 1
+		}
+		return 0
+	})
+}
+
+func (s *Server) ListenAndServe() (err error) {
+	s.listener, err = net.Listen("tcp", s.addr)
+	if err != nil {
+		return
+	}
+
+	log.Infof("admin server listen on %s...", s.addr)
+
+	go func() {
+		if err := s.httpSrv.Serve(s.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("admin server serve error: %s", err.Error())
+		}
+	}()
+
+	return nil
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	log.Info("admin server shutdown...")
+	err := s.httpSrv.Shutdown(ctx)
+	log.Info("admin server exit")
+	return err
+}
+
+// CheckReload reports a change of the admin address, it can not be applied without a restart.
+// s may be nil if the admin server is disabled.
+func (s *Server) CheckReload(conf *Config) error {
+	addr, newAddr := "", ""
+	if s != nil {
+		addr = s.addr
+	}
+	if conf != nil {
+		newAddr = conf.Addr
+	}
+
+	if addr != newAddr {
+		return fmt.Errorf("admin.addr changed from %s to %s, restart required", addr, newAddr)
+	}
+
+	return nil
+}
+
+func (s *Server) GetStatus() *AgentStatus {
+	c := config.GetInstance()
+	return &AgentStatus{
+		Domain:  c.GetDomain(),
+		Routers: c.GetRouters(),
+		Sample:  c.GetSample(),
+		Enabled: c.IsEnabled(),
+		Server: ServerStatus{
+			ConnNum: s.srv.ConnNum(),
+		},
+		Cat:       cat.GetStats(),
+		Heartbeat: status.GetLastHeartbeat(),
+	}
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := metrics.WriteText(w); err != nil {
+		log.Warnf("admin server write metrics error: %s", err.Error())
+	}
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(s.GetStatus()); err != nil {
+		log.Warnf("admin server encode status error: %s", err.Error())
+	}
+}
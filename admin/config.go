@@ -0,0 +1,6 @@
+package admin
+
+type Config struct {
+	// Addr is the tcp address the admin server listens to, the admin server is disabled if empty.
+	Addr string `yaml:"addr"`
+}
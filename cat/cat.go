@@ -1,22 +1,63 @@
 package cat
 
 import (
+	"strconv"
+
 	"github.com/Orlion/cat-agent/cat/config"
 	"github.com/Orlion/cat-agent/cat/message"
+	"github.com/Orlion/cat-agent/cat/sender"
 	"github.com/Orlion/cat-agent/log"
+	"github.com/Orlion/cat-agent/metrics"
 )
 
 var catInstance *Cat
 
+type Stats struct {
+	Sender     sender.Stats    `json:"sender"`
+	Aggregator AggregatorStats `json:"aggregator"`
+	Sampler    SamplerStats    `json:"sampler"`
+}
+
+// SendResult tells what happened to a message tree handed to Send.
+type SendResult uint32
+
+const (
+	// SendQueued means the tree has been queued for the cat server.
+	SendQueued SendResult = iota
+	// SendAggregated means the tree has been sampled out and folded into the local aggregation.
+	SendAggregated
+	// SendSampledOut means the tree has been sampled out and can not be aggregated, it is discarded.
+	SendSampledOut
+	// SendDroppedQueueFull means the sender queue is full and the tree has been discarded.
+	SendDroppedQueueFull
+	// SendSpooled means the sender queue is full and the tree has been spooled to disk.
+	SendSpooled
+	// SendDisabled means cat is disabled by the router server or shutting down, the tree is discarded.
+	SendDisabled
+)
+
+var sendResultNames = []string{"queued", "aggregated", "sampled_out", "dropped_queue_full", "spooled", "disabled"}
+
+func (r SendResult) String() string {
+	if int(r) < len(sendResultNames) {
+		return sendResultNames[r]
+	}
+	return strconv.Itoa(int(r))
+}
+
 type Cat struct {
 	inShutdown   bool
 	manager      *Manager
 	msgIdFactory *MessageIdFactory
 }
 
-func (cat *Cat) run() {
-	cat.msgIdFactory.run()
+func (cat *Cat) run() error {
+	if err := cat.msgIdFactory.run(); err != nil {
+		return err
+	}
 	cat.manager.run()
+
+	return nil
 }
 
 func (cat *Cat) shutdown() {
@@ -31,15 +72,37 @@ func (cat *Cat) shuttingDown() bool {
 	return cat.inShutdown
 }
 
-func (cat *Cat) send(tree *message.MessageTree) {
-	if cat.shuttingDown() || !config.GetInstance().IsEnabled() {
-		return
+func (cat *Cat) send(tree *message.MessageTree, aggregateMetrics bool) SendResult {
+	result := SendDisabled
+	if !cat.shuttingDown() && config.GetInstance().IsEnabled() {
+		// metrics are always aggregated locally, they are never sent as they are.
+		if aggregateMetrics && !cat.manager.aggregator.aggregateMetrics(tree) {
+			result = SendAggregated
+		} else {
+			result = cat.manager.send(tree)
+		}
 	}
 
-	cat.manager.send(tree)
+	metrics.Trees.WithLabelValues(result.String()).Inc()
+
+	return result
 }
 
-func (cat *Cat) createMessageId(domain string) []byte {
+func (cat *Cat) createMessageIds(domain string, n int) ([][]byte, error) {
+	return cat.msgIdFactory.getNextIds(domain, n)
+}
+
+func (cat *Cat) reload(conf *config.Config) error {
+	if err := config.GetInstance().Reload(conf); err != nil {
+		return err
+	}
+
+	cat.manager.reload()
+
+	return nil
+}
+
+func (cat *Cat) createMessageId(domain string) ([]byte, error) {
 	return cat.msgIdFactory.getNextId(domain)
 }
 
@@ -53,19 +116,48 @@ func Init(conf *config.Config) error {
 		msgIdFactory: newMessageIdFactory(),
 	}
 
-	catInstance.run()
+	if err := catInstance.run(); err != nil {
+		config.Shutdown()
+		return err
+	}
 
 	return nil
 }
 
-func Send(tree *message.MessageTree) {
-	catInstance.send(tree)
+func Send(tree *message.MessageTree) SendResult {
+	return catInstance.send(tree, true)
+}
+
+// sendAggregated sends a tree built by the metric aggregator, its metrics have been aggregated already.
+func sendAggregated(tree *message.MessageTree) SendResult {
+	return catInstance.send(tree, false)
 }
 
-func CreateMessageId(domain string) []byte {
+// CreateMessageId returns the next message id of domain, the error is ErrMessageIdUnavailable if its
+// reservation could not be persisted, or ErrBadDomain if domain can't be used in a message id.
+func CreateMessageId(domain string) ([]byte, error) {
 	return catInstance.createMessageId(domain)
 }
 
+// CreateMessageIds returns n consecutive message ids of domain.
+func CreateMessageIds(domain string, n int) ([][]byte, error) {
+	return catInstance.createMessageIds(domain, n)
+}
+
+// GetStats returns the internal state of the sender, the local aggregator and the sampler.
+func GetStats() Stats {
+	return catInstance.manager.stats()
+}
+
+// CheckReload reports whether conf can be applied by Reload without a restart.
+func CheckReload(conf *config.Config) error {
+	return config.GetInstance().CheckReload(conf)
+}
+
+func Reload(conf *config.Config) error {
+	return catInstance.reload(conf)
+}
+
 func Shutdown() {
 	catInstance.shutdown()
 }
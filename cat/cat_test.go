@@ -3,6 +3,7 @@ package cat
 import (
 	"fmt"
 	"regexp"
+	"strconv"
 	"sync"
 	"testing"
 
@@ -15,6 +16,34 @@ var (
 )
 
 func testInit(domain string) error {
+	return testInitConfig(&config.Config{
+		Domain:   domain,
+		Hostname: "cat_agent_test_hostname",
+		Env:      "cat_agent_test_env",
+		Ip:       "127.0.0.1",
+		IpHex:    "",
+		Servers:  []string{"127.0.0.1:8080"},
+	})
+}
+
+// testCreateMessageId fails t if the message id of domain cannot be created, it can be called from any goroutine.
+func testCreateMessageId(t *testing.T, domain string) []byte {
+	messageId, err := CreateMessageId(domain)
+	if err != nil {
+		t.Errorf("CreateMessageId of %s error: %s", domain, err)
+	}
+	return messageId
+}
+
+func testCreateMessageIds(t *testing.T, domain string, n int) [][]byte {
+	messageIds, err := CreateMessageIds(domain, n)
+	if err != nil {
+		t.Errorf("CreateMessageIds of %s error: %s", domain, err)
+	}
+	return messageIds
+}
+
+func testInitConfig(conf *config.Config) error {
 	if hasInit {
 		Shutdown()
 	} else {
@@ -25,14 +54,7 @@ func testInit(domain string) error {
 
 	hasInit = true
 
-	return Init(&config.Config{
-		Domain:   domain,
-		Hostname: "cat_agent_test_hostname",
-		Env:      "cat_agent_test_env",
-		Ip:       "127.0.0.1",
-		IpHex:    "",
-		Servers:  []string{"127.0.0.1:8080"},
-	})
+	return Init(conf)
 }
 
 func TestCreateSingleLocalMessageId(t *testing.T) {
@@ -43,7 +65,7 @@ func TestCreateSingleLocalMessageId(t *testing.T) {
 		t.Fatalf("testInit error: %s", err)
 	}
 
-	messageId := CreateMessageId(domain)
+	messageId := testCreateMessageId(t, domain)
 	t.Logf("messageId: %s", messageId)
 	pattern := fmt.Sprintf(`%s-%s-\d+-\d+`, domain, config.GetInstance().GetIpHex())
 	if !regexp.MustCompile(pattern).MatchString(string(messageId)) {
@@ -61,7 +83,7 @@ func TestCreateSingleDomainMessageId(t *testing.T) {
 	}
 
 	domain := "test-domain"
-	messageId := CreateMessageId(domain)
+	messageId := testCreateMessageId(t, domain)
 	t.Logf("messageId: %s", messageId)
 	pattern := fmt.Sprintf(`%s-%s-\d+-\d+`, domain, config.GetInstance().GetIpHex())
 	if !regexp.MustCompile(pattern).MatchString(string(messageId)) {
@@ -78,9 +100,9 @@ func TestCreateThreeLocalMessageId(t *testing.T) {
 		t.Fatalf("testInit error: %s", err)
 	}
 
-	messageId1 := CreateMessageId(domain)
-	messageId2 := CreateMessageId(domain)
-	messageId3 := CreateMessageId(domain)
+	messageId1 := testCreateMessageId(t, domain)
+	messageId2 := testCreateMessageId(t, domain)
+	messageId3 := testCreateMessageId(t, domain)
 	t.Logf("messageId1: %s, messageId2: %s, messageId3: %s", string(messageId1), string(messageId2), string(messageId3))
 	pattern := fmt.Sprintf(`%s-%s-\d+-\d+`, domain, config.GetInstance().GetIpHex())
 	reg := regexp.MustCompile(pattern)
@@ -116,9 +138,9 @@ func TestCreateThreeDomainMessageId(t *testing.T) {
 	}
 
 	domain := "test-domain"
-	messageId1 := CreateMessageId(domain)
-	messageId2 := CreateMessageId(domain)
-	messageId3 := CreateMessageId(domain)
+	messageId1 := testCreateMessageId(t, domain)
+	messageId2 := testCreateMessageId(t, domain)
+	messageId3 := testCreateMessageId(t, domain)
 	t.Logf("messageId1: %s, messageId2: %s, messageId3: %s", string(messageId1), string(messageId2), string(messageId3))
 	pattern := fmt.Sprintf(`%s-%s-\d+-\d+`, domain, config.GetInstance().GetIpHex())
 	reg := regexp.MustCompile(pattern)
@@ -167,7 +189,7 @@ func TestCreateLocalMessageIdParallel(t *testing.T) {
 		for j := 0; j < 10000; j++ {
 			wg.Add(1)
 			go func(argsI, argsJ int) {
-				messageId := CreateMessageId(fmt.Sprintf("%s-%d", baseDomain, argsI))
+				messageId := testCreateMessageId(t, fmt.Sprintf("%s-%d", baseDomain, argsI))
 				msgIdCh <- &msgId{string(messageId), argsI, argsJ}
 				wg.Done()
 			}(i, j)
@@ -198,3 +220,71 @@ Loop:
 	}
 	t.Log("TestCreateMessageIdParallel end")
 }
+
+func TestCreateMessageIdsParallel(t *testing.T) {
+	t.Log("TestCreateMessageIdsParallel begin")
+
+	baseDomain := "TestCreateMessageIdsParallel-"
+	if err := testInit(baseDomain + "0"); err != nil {
+		t.Fatalf("testInit error: %s", err)
+	}
+
+	type msgIds struct {
+		msgIds [][]byte
+		i      int
+		j      int
+	}
+
+	msgIdsCh := make(chan *msgIds, 10*1000)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 1000; j++ {
+			wg.Add(1)
+			go func(argsI, argsJ int) {
+				// mix batches with single ids of the same domain.
+				domain := fmt.Sprintf("%s-%d", baseDomain, argsI%3)
+				if argsJ%2 == 0 {
+					msgIdsCh <- &msgIds{testCreateMessageIds(t, domain, argsJ%7+1), argsI, argsJ}
+				} else {
+					msgIdsCh <- &msgIds{[][]byte{testCreateMessageId(t, domain)}, argsI, argsJ}
+				}
+				wg.Done()
+			}(i, j)
+		}
+	}
+
+	wg.Wait()
+	close(msgIdsCh)
+
+	msgIdMap := make(map[string]int)
+	for msgIds := range msgIdsCh {
+		if msgIds.j%2 == 0 && len(msgIds.msgIds) != msgIds.j%7+1 {
+			t.Fatalf("CreateMessageIds returned %d ids, expected %d", len(msgIds.msgIds), msgIds.j%7+1)
+		}
+
+		pattern := fmt.Sprintf(`^%s-%d-%s-\d+-(\d+)$`, baseDomain, msgIds.i%3, config.GetInstance().GetIpHex())
+		reg := regexp.MustCompile(pattern)
+		lastIndex := 0
+		for _, messageId := range msgIds.msgIds {
+			matches := reg.FindStringSubmatch(string(messageId))
+			if matches == nil {
+				t.Fatalf("messageId: %s not match: %s", messageId, pattern)
+			}
+
+			// ids of a batch are consecutive.
+			index, _ := strconv.Atoi(matches[1])
+			if lastIndex > 0 && index != lastIndex+1 {
+				t.Fatalf("messageId: %s is not consecutive to index %d", messageId, lastIndex)
+			}
+			lastIndex = index
+
+			if oldJ, exists := msgIdMap[string(messageId)]; exists {
+				t.Fatalf("CreateMessageIds get same messageId: %s, oldJ = %d, newJ = %d", messageId, oldJ, msgIds.j)
+			} else {
+				msgIdMap[string(messageId)] = msgIds.j
+			}
+		}
+	}
+
+	t.Log("TestCreateMessageIdsParallel end")
+}
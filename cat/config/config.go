@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/Orlion/cat-agent/log"
+	"github.com/Orlion/cat-agent/metrics"
 	"github.com/Orlion/cat-agent/pkg/atomicx"
 	"github.com/Orlion/cat-agent/pkg/systemx"
 )
@@ -23,6 +24,29 @@ type Config struct {
 	Servers                      []string `yaml:"servers"`
 	SenderNormalQueueConsumerNum int      `yaml:"sender_normal_queue_consumer_num"`
 	SenderHighQueueConsumerNum   int      `yaml:"sender_high_queue_consumer_num"`
+	MessageIdStateFile           string   `yaml:"message_id_state_file"`
+	MessageIdBlockSize           int      `yaml:"message_id_block_size"`
+	SenderSpoolDir               string   `yaml:"sender_spool_dir"`
+	SenderSpoolSegmentMaxBytes   int64    `yaml:"sender_spool_segment_max_bytes"`
+	SenderSpoolMaxBytes          int64    `yaml:"sender_spool_max_bytes"`
+	SenderSpoolMaxAgeSeconds     int      `yaml:"sender_spool_max_age_seconds"`
+	FallbackRouters              []string `yaml:"fallback_routers"`
+	SenderRoutingStrategy        string   `yaml:"sender_routing_strategy"`
+	TraceMaxCountPerTree         int      `yaml:"trace_max_count_per_tree"`
+	TraceMaxBytesPerTree         int      `yaml:"trace_max_bytes_per_tree"`
+	SenderEncoder                string   `yaml:"sender_encoder"`
+	// SenderRouterEncoders overrides SenderEncoder for some routers, keyed by their ip:port.
+	SenderRouterEncoders map[string]string `yaml:"sender_router_encoders"`
+	SenderDump           string            `yaml:"sender_dump"`
+	SampleMode           string            `yaml:"sample_mode"`
+	// SampleRules are tried in order, the first one that matches a tree gives its sample rate.
+	SampleRules    []*SampleRule `yaml:"sample_rules"`
+	SampleRuleMode string        `yaml:"sample_rule_mode"`
+	// SampleKeepSlowMillis keeps the trees whose root transaction is slower than the threshold of its type,
+	// SampleKeepAnyType for the types without their own.
+	SampleKeepSlowMillis map[string]int `yaml:"sample_keep_slow_millis"`
+	// SampleKeepEventTypes keeps the trees with an event of one of these types.
+	SampleKeepEventTypes []string `yaml:"sample_keep_event_types"`
 }
 
 type ConfigService struct {
@@ -30,10 +54,14 @@ type ConfigService struct {
 	config      *Config
 	routers     []string
 	routersCond *sync.Cond
-	sample      float64
-	enable      uint32
-	done        chan struct{}
-	wg          *sync.WaitGroup
+	// routersVersion is incremented on every routers change, so a waiter never misses one.
+	routersVersion uint64
+	// routersFallback is set while the routers are the fallback routers, until a router pull succeeds.
+	routersFallback bool
+	sample          float64
+	enable          uint32
+	done            chan struct{}
+	wg              *sync.WaitGroup
 }
 
 func newConfigService(config *Config) (*ConfigService, error) {
@@ -53,24 +81,39 @@ func newConfigService(config *Config) (*ConfigService, error) {
 	return c, nil
 }
 
+// run never fails on an unreachable router server, cat starts in degraded mode with the fallback routers,
+// or no routers at all, and the router pull is retried with backoff until it succeeds.
 func (c *ConfigService) run() error {
 	log.Info("config service running...")
-	if err := c.pullRouters(); err != nil {
-		return err
+
+	delay := RouterUpdateDuration
+	if err := c.refreshRouters(); err != nil {
+		log.Warnf("%s, cat starts in degraded mode", err.Error())
+		c.useFallbackRouters()
+		delay = RouterRetryMinDuration
 	}
 
-	ticker := time.NewTicker(RouterUpdateDuration)
+	timer := time.NewTimer(delay)
 
 	c.wg.Add(1)
 	go func() {
 	Loop:
 		for {
 			select {
-			case <-ticker.C:
-				if err := c.pullRouters(); err != nil {
-					log.Error(err.Error())
+			case <-timer.C:
+				if err := c.refreshRouters(); err != nil {
+					if delay >= RouterUpdateDuration {
+						delay = RouterRetryMinDuration
+					} else if delay *= 2; delay > RouterUpdateDuration {
+						delay = RouterUpdateDuration
+					}
+					log.Errorf("%s, retry in %s", err.Error(), delay)
+				} else {
+					delay = RouterUpdateDuration
 				}
+				timer.Reset(delay)
 			case <-c.done:
+				timer.Stop()
 				break Loop
 			}
 		}
@@ -80,6 +123,47 @@ func (c *ConfigService) run() error {
 	return nil
 }
 
+func (c *ConfigService) refreshRouters() (err error) {
+	err = c.pullRouters()
+	if err == nil && len(c.GetRouters()) == 0 {
+		err = errors.New("router server returned no routers")
+	}
+
+	if err != nil {
+		metrics.RouterRefreshes.WithLabelValues("failure").Inc()
+	} else {
+		metrics.RouterRefreshes.WithLabelValues("success").Inc()
+	}
+
+	return
+}
+
+func (c *ConfigService) useFallbackRouters() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.routers) > 0 || len(c.config.FallbackRouters) == 0 {
+		return
+	}
+
+	log.Infof("routers has been initialized to fallback routers: %v", c.config.FallbackRouters)
+	c.setRoutersLocked(c.config.FallbackRouters)
+	c.routersFallback = true
+}
+
+// reloadFallbackRoutersLocked replaces the routers by the reloaded fallback routers while no router pull has
+// succeeded, the routers of the router server are kept otherwise. Empty fallback routers keep the current ones.
+func (c *ConfigService) reloadFallbackRoutersLocked(fallbackRouters []string) {
+	c.config.FallbackRouters = fallbackRouters
+	if len(fallbackRouters) == 0 || (len(c.routers) > 0 && !c.routersFallback) || sameRouters(c.routers, fallbackRouters) {
+		return
+	}
+
+	log.Infof("routers has been changed to fallback routers: %v", fallbackRouters)
+	c.setRoutersLocked(fallbackRouters)
+	c.routersFallback = true
+}
+
 func (c *ConfigService) shutdown() {
 	log.Info("config service shutdown...")
 	close(c.done)
@@ -108,17 +192,99 @@ func (c *ConfigService) GetIpHex() string {
 }
 
 func (c *ConfigService) GetServers() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.config.Servers
 }
 
 func (c *ConfigService) GetSenderNormalQueueConsumerNum() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.config.SenderNormalQueueConsumerNum
 }
 
 func (c *ConfigService) GetSenderHighQueueConsumerNum() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.config.SenderHighQueueConsumerNum
 }
 
+func (c *ConfigService) GetSenderRoutingStrategy() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.config.SenderRoutingStrategy
+}
+
+// GetSenderRouterEncoder returns the name of the encoder of the trees sent to router.
+func (c *ConfigService) GetSenderRouterEncoder(router string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if name, exists := c.config.SenderRouterEncoders[router]; exists {
+		return name
+	}
+	return c.config.SenderEncoder
+}
+
+func (c *ConfigService) GetSenderDump() string {
+	return c.config.SenderDump
+}
+
+func (c *ConfigService) GetSampleMode() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.config.SampleMode
+}
+
+// GetSampleRules returns the sample rules and how their rates combine with the sample of the router server.
+func (c *ConfigService) GetSampleRules() ([]*SampleRule, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.config.SampleRules, c.config.SampleRuleMode
+}
+
+// GetSampleKeep returns the thresholds in milliseconds and the event types of the trees kept whatever their sample rate.
+func (c *ConfigService) GetSampleKeep() (map[string]int, []string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.config.SampleKeepSlowMillis, c.config.SampleKeepEventTypes
+}
+
+func (c *ConfigService) GetTraceMaxCountPerTree() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.config.TraceMaxCountPerTree
+}
+
+func (c *ConfigService) GetTraceMaxBytesPerTree() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.config.TraceMaxBytesPerTree
+}
+
+func (c *ConfigService) GetMessageIdStateFile() string {
+	return c.config.MessageIdStateFile
+}
+
+func (c *ConfigService) GetMessageIdBlockSize() int {
+	return c.config.MessageIdBlockSize
+}
+
+func (c *ConfigService) GetSenderSpoolDir() string {
+	return c.config.SenderSpoolDir
+}
+
+func (c *ConfigService) GetSenderSpoolSegmentMaxBytes() int64 {
+	return c.config.SenderSpoolSegmentMaxBytes
+}
+
+func (c *ConfigService) GetSenderSpoolMaxBytes() int64 {
+	return c.config.SenderSpoolMaxBytes
+}
+
+func (c *ConfigService) GetSenderSpoolMaxAge() time.Duration {
+	return time.Duration(c.config.SenderSpoolMaxAgeSeconds) * time.Second
+}
+
 func (c *ConfigService) GetRouters() []string {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
@@ -149,7 +315,10 @@ func (c *ConfigService) updateRouters(router string) {
 	if newLen == 0 {
 		log.Info("cannot established a connection to cat server")
 		return
-	} else if oldLen == 0 {
+	}
+
+	c.routersFallback = false
+	if oldLen == 0 {
 		log.Infof("routers has been initialized to: %v", newRouters)
 		c.setRoutersLocked(newRouters)
 	} else if oldLen != newLen {
@@ -166,8 +335,21 @@ func (c *ConfigService) updateRouters(router string) {
 	}
 }
 
+func sameRouters(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func (c *ConfigService) setRoutersLocked(routers []string) {
 	c.routers = routers
+	c.routersVersion++
 	c.routersCond.Broadcast()
 }
 
@@ -183,14 +365,103 @@ func (c *ConfigService) updateBlock(v string) {
 	}
 }
 
+// CheckReload validates config and reports the changes that cannot be applied without a restart.
+func (c *ConfigService) CheckReload(config *Config) error {
+	// the hostname and the ips of the file are replaced by the detected ones, they are checked before.
+	var hostname, ip, ipHex string
+	if config != nil {
+		hostname, ip, ipHex = config.Hostname, config.Ip, config.IpHex
+	}
+	if err := withDefaultConf(config); err != nil {
+		return err
+	}
+
+	for _, field := range []struct{ name, given, detected, running string }{
+		{"hostname", hostname, config.Hostname, c.config.Hostname},
+		{"ip", ip, config.Ip, c.config.Ip},
+		{"ip_hex", ipHex, config.IpHex, c.config.IpHex},
+	} {
+		if field.given != "" && field.given != field.running {
+			return fmt.Errorf("cat.%s is detected at startup and cannot be set, %s given, %s running", field.name, field.given, field.running)
+		}
+		if field.detected != field.running {
+			return fmt.Errorf("cat.%s changed from %s to %s, restart required", field.name, field.running, field.detected)
+		}
+	}
+
+	if config.Domain != c.config.Domain {
+		return fmt.Errorf("cat.domain changed from %s to %s, restart required", c.config.Domain, config.Domain)
+	}
+
+	if config.Env != c.config.Env {
+		return fmt.Errorf("cat.env changed from %s to %s, restart required", c.config.Env, config.Env)
+	}
+
+	if config.MessageIdStateFile != c.config.MessageIdStateFile || config.MessageIdBlockSize != c.config.MessageIdBlockSize {
+		return errors.New("cat.message_id_state_file or cat.message_id_block_size changed, restart required")
+	}
+
+	if config.SenderSpoolDir != c.config.SenderSpoolDir ||
+		config.SenderSpoolSegmentMaxBytes != c.config.SenderSpoolSegmentMaxBytes ||
+		config.SenderSpoolMaxBytes != c.config.SenderSpoolMaxBytes ||
+		config.SenderSpoolMaxAgeSeconds != c.config.SenderSpoolMaxAgeSeconds {
+		return errors.New("cat.sender_spool_* changed, restart required")
+	}
+
+	if config.SenderDump != c.config.SenderDump {
+		return fmt.Errorf("cat.sender_dump changed from %s to %s, restart required", c.config.SenderDump, config.SenderDump)
+	}
+
+	return nil
+}
+
+// Reload applies the settings of config that are safe to change while running.
+func (c *ConfigService) Reload(config *Config) error {
+	if err := c.CheckReload(config); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.config.Servers = config.Servers
+	c.config.SenderNormalQueueConsumerNum = config.SenderNormalQueueConsumerNum
+	c.config.SenderHighQueueConsumerNum = config.SenderHighQueueConsumerNum
+	c.config.SenderRoutingStrategy = config.SenderRoutingStrategy
+	c.config.TraceMaxCountPerTree = config.TraceMaxCountPerTree
+	c.config.TraceMaxBytesPerTree = config.TraceMaxBytesPerTree
+	c.config.SenderEncoder = config.SenderEncoder
+	c.config.SenderRouterEncoders = config.SenderRouterEncoders
+	c.config.SampleMode = config.SampleMode
+	c.config.SampleRules = config.SampleRules
+	c.config.SampleRuleMode = config.SampleRuleMode
+	c.config.SampleKeepSlowMillis = config.SampleKeepSlowMillis
+	c.config.SampleKeepEventTypes = config.SampleKeepEventTypes
+	c.reloadFallbackRoutersLocked(config.FallbackRouters)
+	c.mu.Unlock()
+
+	log.Infof("cat config has been reloaded, servers: %v, sender normal queue consumer num: %d, sender high queue consumer num: %d, sender routing strategy: %s", config.Servers, config.SenderNormalQueueConsumerNum, config.SenderHighQueueConsumerNum, config.SenderRoutingStrategy)
+
+	return nil
+}
+
 func (c *ConfigService) IsEnabled() bool {
 	return atomic.LoadUint32(&c.enable) == 1
 }
 
-func (c *ConfigService) RoutersCondWait() {
+// GetRoutersWithVersion returns the routers and their version, the version can be passed to WaitRoutersChange.
+func (c *ConfigService) GetRoutersWithVersion() ([]string, uint64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.routers, c.routersVersion
+}
+
+// WaitRoutersChange blocks until the routers version differs from version, then returns the routers and their version.
+func (c *ConfigService) WaitRoutersChange(version uint64) ([]string, uint64) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.routersCond.Wait()
+	for c.routersVersion == version {
+		c.routersCond.Wait()
+	}
+	return c.routers, c.routersVersion
 }
 
 var instance *ConfigService
@@ -248,6 +519,12 @@ func withDefaultConf(config *Config) error {
 		return errors.New("servers cannot be empty")
 	}
 
+	for _, router := range config.FallbackRouters {
+		if len(resolveServerAddresses(router)) != 1 {
+			return fmt.Errorf("fallback router %s should be in the format ip:port", router)
+		}
+	}
+
 	if config.SenderNormalQueueConsumerNum < 0 {
 		return errors.New("sender normal queue consumer num cannot be less than 0")
 	}
@@ -264,5 +541,99 @@ func withDefaultConf(config *Config) error {
 		config.SenderHighQueueConsumerNum = DefaultTcpSenderHighQueueConsumerNum
 	}
 
+	switch config.SenderRoutingStrategy {
+	case "":
+		config.SenderRoutingStrategy = RoutingStrategyFailover
+	case RoutingStrategyFailover, RoutingStrategyRoundRobin, RoutingStrategyConsistentHash:
+	default:
+		return fmt.Errorf("sender routing strategy should be one of %s, %s and %s, %s given", RoutingStrategyFailover, RoutingStrategyRoundRobin, RoutingStrategyConsistentHash, config.SenderRoutingStrategy)
+	}
+
+	if config.SenderEncoder == "" {
+		config.SenderEncoder = EncoderBinary
+	}
+
+	if err := checkEncoder(config.SenderEncoder); err != nil {
+		return err
+	}
+
+	for router, name := range config.SenderRouterEncoders {
+		if err := checkEncoder(name); err != nil {
+			return fmt.Errorf("router %s: %s", router, err.Error())
+		}
+	}
+
+	switch config.SampleMode {
+	case "":
+		config.SampleMode = SampleModeRandom
+	case SampleModeRandom, SampleModeTrace:
+	default:
+		return fmt.Errorf("sample mode should be one of %s and %s, %s given", SampleModeRandom, SampleModeTrace, config.SampleMode)
+	}
+
+	switch config.SampleRuleMode {
+	case "":
+		config.SampleRuleMode = SampleRuleModeOverride
+	case SampleRuleModeOverride, SampleRuleModeMultiply:
+	default:
+		return fmt.Errorf("sample rule mode should be one of %s and %s, %s given", SampleRuleModeOverride, SampleRuleModeMultiply, config.SampleRuleMode)
+	}
+
+	for _, rule := range config.SampleRules {
+		if rule == nil {
+			return errors.New("sample rule cannot be empty")
+		}
+		if err := rule.compile(); err != nil {
+			return err
+		}
+	}
+
+	for t, millis := range config.SampleKeepSlowMillis {
+		if millis < 1 {
+			return fmt.Errorf("sample keep slow millis of %s should be greater than 0, %d given", t, millis)
+		}
+	}
+
+	for _, t := range config.SampleKeepEventTypes {
+		if t == "" {
+			return errors.New("sample keep event type cannot be empty")
+		}
+	}
+
+	if config.TraceMaxCountPerTree < 1 {
+		config.TraceMaxCountPerTree = DefaultTraceMaxCountPerTree
+	}
+
+	if config.TraceMaxBytesPerTree < 1 {
+		config.TraceMaxBytesPerTree = DefaultTraceMaxBytesPerTree
+	}
+
+	if config.MessageIdBlockSize < 0 {
+		return errors.New("message id block size cannot be less than 0")
+	}
+
+	if config.MessageIdBlockSize == 0 {
+		config.MessageIdBlockSize = DefaultMessageIdBlockSize
+	}
+
+	if config.SenderSpoolSegmentMaxBytes < 1 {
+		config.SenderSpoolSegmentMaxBytes = DefaultTcpSenderSpoolSegmentMaxBytes
+	}
+
+	if config.SenderSpoolMaxBytes < 1 {
+		config.SenderSpoolMaxBytes = DefaultTcpSenderSpoolMaxBytes
+	}
+
+	if config.SenderSpoolMaxAgeSeconds < 1 {
+		config.SenderSpoolMaxAgeSeconds = DefaultTcpSenderSpoolMaxAgeSeconds
+	}
+
+	return nil
+}
+
+func checkEncoder(name string) error {
+	if name != EncoderBinary && name != EncoderPlainText {
+		return fmt.Errorf("sender encoder should be one of %s and %s, %s given", EncoderBinary, EncoderPlainText, name)
+	}
 	return nil
 }
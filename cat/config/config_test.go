@@ -0,0 +1,278 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Orlion/cat-agent/log"
+)
+
+func init() {
+	log.Init(&log.Config{
+		StdoutLevel: "error",
+	})
+}
+
+func TestRunDegradedWithFallbackRouters(t *testing.T) {
+	c, err := newConfigService(&Config{
+		Domain:          "TestRunDegradedWithFallbackRouters",
+		Servers:         []string{"127.0.0.1:1"},
+		FallbackRouters: []string{"127.0.0.1:2280", "127.0.0.2:2280"},
+	})
+	if err != nil {
+		t.Fatalf("newConfigService error: %s", err)
+	}
+
+	if err = c.run(); err != nil {
+		t.Fatalf("run should not fail on an unreachable router server: %s", err)
+	}
+	defer c.shutdown()
+
+	if routers := c.GetRouters(); !reflect.DeepEqual(routers, []string{"127.0.0.1:2280", "127.0.0.2:2280"}) {
+		t.Fatalf("routers: %v, expected the fallback routers", routers)
+	}
+}
+
+func TestRunDegradedWithoutRouters(t *testing.T) {
+	c, err := newConfigService(&Config{
+		Domain:  "TestRunDegradedWithoutRouters",
+		Servers: []string{"127.0.0.1:1"},
+	})
+	if err != nil {
+		t.Fatalf("newConfigService error: %s", err)
+	}
+
+	if err = c.run(); err != nil {
+		t.Fatalf("run should not fail on an unreachable router server: %s", err)
+	}
+	defer c.shutdown()
+
+	if routers := c.GetRouters(); len(routers) != 0 {
+		t.Fatalf("routers: %v, expected no routers", routers)
+	}
+}
+
+func TestInvalidFallbackRouter(t *testing.T) {
+	_, err := newConfigService(&Config{
+		Domain:          "TestInvalidFallbackRouter",
+		Servers:         []string{"127.0.0.1:1"},
+		FallbackRouters: []string{"127.0.0.1"},
+	})
+	if err == nil {
+		t.Fatal("newConfigService should reject a fallback router without port")
+	}
+}
+
+func sampleRate(rate float64) *float64 {
+	return &rate
+}
+
+func TestSampleRules(t *testing.T) {
+	config := &Config{
+		Domain:  "TestSampleRules",
+		Servers: []string{"127.0.0.1:1"},
+		SampleRules: []*SampleRule{
+			{Type: "URL", Name: "/health*", Rate: sampleRate(0.001)},
+			{Domain: "order", Name: "*.php?a=(1)", Rate: sampleRate(0.5)},
+		},
+	}
+	if err := withDefaultConf(config); err != nil {
+		t.Fatalf("withDefaultConf error: %s", err)
+	}
+
+	if config.SampleRuleMode != SampleRuleModeOverride {
+		t.Fatalf("sample rule mode: %s, expected %s", config.SampleRuleMode, SampleRuleModeOverride)
+	}
+
+	for _, c := range []struct {
+		rule            *SampleRule
+		domain, t, name string
+		expected        bool
+	}{
+		{config.SampleRules[0], "user", "URL", "/health", true},
+		{config.SampleRules[0], "user", "URL", "/health/live", true},
+		{config.SampleRules[0], "user", "URL", "/api/health", false},
+		{config.SampleRules[0], "user", "SQL", "/health", false},
+		{config.SampleRules[1], "order", "URL", "/index.php?a=(1)", true},
+		{config.SampleRules[1], "order", "URL", "/index.phpxa=(1)", false},
+		{config.SampleRules[1], "user", "URL", "/index.php?a=(1)", false},
+	} {
+		if matched := c.rule.Match(c.domain, c.t, c.name); matched != c.expected {
+			t.Fatalf("rule %s matches %s %s %s: %v, expected %v", c.rule, c.domain, c.t, c.name, matched, c.expected)
+		}
+	}
+
+	for _, invalid := range []*Config{
+		{Domain: "TestSampleRules", Servers: []string{"127.0.0.1:1"}, SampleRules: []*SampleRule{{Rate: sampleRate(1.5)}}},
+		{Domain: "TestSampleRules", Servers: []string{"127.0.0.1:1"}, SampleRules: []*SampleRule{{Type: "URL"}}},
+		{Domain: "TestSampleRules", Servers: []string{"127.0.0.1:1"}, SampleRules: []*SampleRule{nil}},
+		{Domain: "TestSampleRules", Servers: []string{"127.0.0.1:1"}, SampleRuleMode: "min"},
+		{Domain: "TestSampleRules", Servers: []string{"127.0.0.1:1"}, SampleMode: "hash"},
+		{Domain: "TestSampleRules", Servers: []string{"127.0.0.1:1"}, SampleKeepSlowMillis: map[string]int{"URL": 0}},
+		{Domain: "TestSampleRules", Servers: []string{"127.0.0.1:1"}, SampleKeepEventTypes: []string{""}},
+	} {
+		if err := withDefaultConf(invalid); err == nil {
+			t.Fatalf("withDefaultConf should reject %+v", invalid)
+		}
+	}
+}
+
+func newTestReloadConfig(domain string) *Config {
+	return &Config{
+		Domain:                       domain,
+		Servers:                      []string{"127.0.0.1:1"},
+		SenderNormalQueueConsumerNum: 2,
+		SenderHighQueueConsumerNum:   2,
+		SenderRoutingStrategy:        RoutingStrategyFailover,
+		MessageIdBlockSize:           10,
+	}
+}
+
+func newTestReloadConfigService(t *testing.T, domain string) *ConfigService {
+	c, err := newConfigService(newTestReloadConfig(domain))
+	if err != nil {
+		t.Fatalf("newConfigService error: %s", err)
+	}
+	if err = c.run(); err != nil {
+		t.Fatalf("run error: %s", err)
+	}
+	t.Cleanup(c.shutdown)
+	return c
+}
+
+func TestReload(t *testing.T) {
+	c := newTestReloadConfigService(t, "TestReload")
+
+	config := newTestReloadConfig("TestReload")
+	config.Servers = []string{"127.0.0.2:1", "127.0.0.3:1"}
+	config.SenderNormalQueueConsumerNum = 4
+	config.SenderHighQueueConsumerNum = 6
+	config.SenderRoutingStrategy = RoutingStrategyRoundRobin
+	config.SampleMode = SampleModeTrace
+	config.Hostname = c.GetHostname()
+	config.Ip = c.GetIp()
+	config.IpHex = c.GetIpHex()
+	if err := c.CheckReload(config); err != nil {
+		t.Fatalf("CheckReload error: %s", err)
+	}
+	if err := c.Reload(config); err != nil {
+		t.Fatalf("Reload error: %s", err)
+	}
+
+	if servers := c.GetServers(); !reflect.DeepEqual(servers, []string{"127.0.0.2:1", "127.0.0.3:1"}) {
+		t.Fatalf("servers: %v, expected the reloaded ones", servers)
+	}
+	if num := c.GetSenderNormalQueueConsumerNum(); num != 4 {
+		t.Fatalf("sender normal queue consumer num: %d, expected 4", num)
+	}
+	if num := c.GetSenderHighQueueConsumerNum(); num != 6 {
+		t.Fatalf("sender high queue consumer num: %d, expected 6", num)
+	}
+	if strategy := c.GetSenderRoutingStrategy(); strategy != RoutingStrategyRoundRobin {
+		t.Fatalf("sender routing strategy: %s, expected %s", strategy, RoutingStrategyRoundRobin)
+	}
+	if mode := c.GetSampleMode(); mode != SampleModeTrace {
+		t.Fatalf("sample mode: %s, expected %s", mode, SampleModeTrace)
+	}
+}
+
+func TestReloadRejected(t *testing.T) {
+	c := newTestReloadConfigService(t, "TestReloadRejected")
+
+	for name, change := range map[string]func(config *Config){
+		"domain":                 func(config *Config) { config.Domain = "TestReloadRejected2" },
+		"env":                    func(config *Config) { config.Env = "prod" },
+		"hostname":               func(config *Config) { config.Hostname = c.GetHostname() + "2" },
+		"ip":                     func(config *Config) { config.Ip = "10.0.0.254" },
+		"ip_hex":                 func(config *Config) { config.IpHex = "0a0000fe" },
+		"message_id_state_file":  func(config *Config) { config.MessageIdStateFile = "message-id.state" },
+		"message_id_block_size":  func(config *Config) { config.MessageIdBlockSize = 20 },
+		"sender_spool_dir":       func(config *Config) { config.SenderSpoolDir = "spool" },
+		"sender_spool_max_bytes": func(config *Config) { config.SenderSpoolMaxBytes = 1024 },
+		"sender_dump":            func(config *Config) { config.SenderDump = SenderDumpToLog },
+	} {
+		newConfig := func() *Config {
+			config := newTestReloadConfig("TestReloadRejected")
+			config.Servers = []string{"127.0.0.2:1"}
+			change(config)
+			return config
+		}
+		if err := c.CheckReload(newConfig()); err == nil {
+			t.Fatalf("CheckReload should reject a change of %s", name)
+		}
+		if err := c.Reload(newConfig()); err == nil {
+			t.Fatalf("Reload should reject a change of %s", name)
+		}
+		if servers := c.GetServers(); !reflect.DeepEqual(servers, []string{"127.0.0.1:1"}) {
+			t.Fatalf("servers after a rejected change of %s: %v, expected the running ones", name, servers)
+		}
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	c := newTestReloadConfigService(t, "TestReloadInvalid")
+
+	for _, invalid := range []*Config{
+		nil,
+		{Domain: "TestReloadInvalid"},
+		{Domain: "TestReloadInvalid", Servers: []string{"127.0.0.2:1"}, SenderNormalQueueConsumerNum: 4, SenderRoutingStrategy: "random"},
+		{Domain: "TestReloadInvalid", Servers: []string{"127.0.0.2:1"}, SenderNormalQueueConsumerNum: 4, SampleMode: "hash"},
+	} {
+		if err := c.Reload(invalid); err == nil {
+			t.Fatalf("Reload should reject %+v", invalid)
+		}
+	}
+
+	if servers := c.GetServers(); !reflect.DeepEqual(servers, []string{"127.0.0.1:1"}) {
+		t.Fatalf("servers after an invalid file: %v, expected the running ones", servers)
+	}
+	if num := c.GetSenderNormalQueueConsumerNum(); num != 2 {
+		t.Fatalf("sender normal queue consumer num after an invalid file: %d, expected 2", num)
+	}
+	if strategy := c.GetSenderRoutingStrategy(); strategy != RoutingStrategyFailover {
+		t.Fatalf("sender routing strategy after an invalid file: %s, expected %s", strategy, RoutingStrategyFailover)
+	}
+}
+
+func TestReloadFallbackRouters(t *testing.T) {
+	c := newTestReloadConfigService(t, "TestReloadFallbackRouters")
+
+	reload := func(fallbackRouters []string) {
+		config := newTestReloadConfig("TestReloadFallbackRouters")
+		config.FallbackRouters = fallbackRouters
+		if err := c.Reload(config); err != nil {
+			t.Fatalf("Reload error: %s", err)
+		}
+	}
+
+	// the agent started without routers, the reloaded fallback routers are used at once.
+	reload([]string{"127.0.0.1:2280"})
+	if routers := c.GetRouters(); !reflect.DeepEqual(routers, []string{"127.0.0.1:2280"}) {
+		t.Fatalf("routers: %v, expected the reloaded fallback routers", routers)
+	}
+
+	reload([]string{"127.0.0.2:2280", "127.0.0.3:2280"})
+	if routers := c.GetRouters(); !reflect.DeepEqual(routers, []string{"127.0.0.2:2280", "127.0.0.3:2280"}) {
+		t.Fatalf("routers: %v, expected the fallback routers to be replaced", routers)
+	}
+
+	reload(nil)
+	if routers := c.GetRouters(); !reflect.DeepEqual(routers, []string{"127.0.0.2:2280", "127.0.0.3:2280"}) {
+		t.Fatalf("routers: %v, expected empty fallback routers to keep the current ones", routers)
+	}
+
+	// the routers of the router server are never replaced by the fallback routers.
+	c.updateRouters("127.0.0.4:2280;")
+	reload([]string{"127.0.0.1:2280"})
+	if routers := c.GetRouters(); !reflect.DeepEqual(routers, []string{"127.0.0.4:2280"}) {
+		t.Fatalf("routers: %v, expected the routers of the router server", routers)
+	}
+
+	for _, invalid := range [][]string{{"127.0.0.1"}, {""}} {
+		config := newTestReloadConfig("TestReloadFallbackRouters")
+		config.FallbackRouters = invalid
+		if err := c.Reload(config); err == nil {
+			t.Fatalf("Reload should reject fallback routers %v", invalid)
+		}
+	}
+}
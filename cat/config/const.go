@@ -14,6 +14,7 @@ const (
 	NameReboot                = "Reboot"
 	NameTransactionAggregator = "TransactionAggregator"
 	NameEventAggregator       = "EventAggregator"
+	NameMetricAggregator      = "MetricAggregator"
 	NameStatus                = "Status"
 	NameStatusExtensionPrefix = "StatusExtension-"
 
@@ -22,22 +23,66 @@ const (
 
 	TcpSenderHighQueueSize   = 50000
 	TcpSenderNormalQueueSize = 50000
+	// TcpSenderOverflowQueueSize is the number of trees that overflowed the queues waiting to be spooled.
+	TcpSenderOverflowQueueSize = 10000
 
 	DefaultTcpSenderNormalQueueConsumerNum = 10
 	DefaultTcpSenderHighQueueConsumerNum   = 10
 	TcpSenderQueueConsumerTickerDuration   = 1000 * time.Millisecond
 	TcpSenderQueueConsumerBufSize          = 150
+	TcpSenderSpoolReplayTimeout            = 30 * time.Second
+	TcpSenderConnMaxAge                    = 10 * time.Minute
+	TcpSenderRouterRetryMinDuration        = 100 * time.Millisecond
+	TcpSenderRouterRetryMaxDuration        = 5 * time.Second
+	TcpSenderRouterHashReplicas            = 160
+
+	RoutingStrategyFailover       = "failover"
+	RoutingStrategyRoundRobin     = "round_robin"
+	RoutingStrategyConsistentHash = "consistent_hash"
+
+	EncoderBinary    = "binary"
+	EncoderPlainText = "plain_text"
+
+	// SampleModeRandom samples every tree on its own, SampleModeTrace samples the trees of a trace
+	// together from a hash of their root message id, so every agent keeps or drops the same traces.
+	SampleModeRandom = "random"
+	SampleModeTrace  = "trace"
+
+	// SampleRuleModeOverride makes the rate of a sample rule replace the sample of the router server,
+	// SampleRuleModeMultiply makes it multiply it.
+	SampleRuleModeOverride = "override"
+	SampleRuleModeMultiply = "multiply"
+
+	// SampleKeepAnyType is the key of the sample keep slow threshold of the types without their own.
+	SampleKeepAnyType = "*"
+
+	// SenderDumpToLog makes the sender dump the trees to the agent log instead of a file.
+	SenderDumpToLog = "log"
+
+	DefaultTcpSenderSpoolSegmentMaxBytes = 16 * 1024 * 1024
+	DefaultTcpSenderSpoolMaxBytes        = 512 * 1024 * 1024
+	DefaultTcpSenderSpoolMaxAgeSeconds   = 3600
 
 	EventAggregatorTickerDuration       = 3 * time.Second
 	TransactionAggregatorTickerDuration = 3 * time.Second
+	MetricAggregatorTickerDuration      = 3 * time.Second
 	EventAggregatorChannelSize          = 1000
+	MetricAggregatorChannelSize         = 1000
 	TransactionAggregatorChannelSize    = 1000
 
-	RouterUpdateDuration = 60 * time.Second
+	RouterUpdateDuration   = 60 * time.Second
+	RouterRetryMinDuration = 1 * time.Second
+
+	DefaultTraceMaxCountPerTree = 200
+	DefaultTraceMaxBytesPerTree = 64 * 1024
+
+	DefaultMessageIdBlockSize = 1000
+	MaxBatchMessageIdCount    = 1000
 )
 
 var (
 	BinaryProtocol          = []byte("NT1")
+	PlainTextProtocol       = []byte("PT1")
 	ThreadNameCatAgent      = []byte("cat-agent")
 	ThreadGroupNameCatAgent = []byte("cat-agent-group")
 )
@@ -49,9 +49,10 @@ func (c *ConfigService) pullRouters() error {
 		Timeout: 5 * time.Second,
 	}
 
-	c.shuffleRouterServers()
+	servers := append([]string(nil), c.GetServers()...)
+	shuffleRouterServers(servers)
 
-	for _, server := range c.config.Servers {
+	for _, server := range servers {
 		u.Host = server
 		log.Infof("getting router config from %s", u.String())
 
@@ -91,12 +92,12 @@ func (c *ConfigService) parseRouterConfig(reader io.ReadCloser) {
 	}
 }
 
-func (c *ConfigService) shuffleRouterServers() {
+func shuffleRouterServers(servers []string) {
 	rand.Seed(time.Now().UnixNano())
-	length := len(c.config.Servers)
+	length := len(servers)
 	for i := 0; i < length; i++ {
 		index := rand.Intn(length - i)
-		c.config.Servers[i], c.config.Servers[index+i] = c.config.Servers[index+i], c.config.Servers[i]
+		servers[i], servers[index+i] = servers[index+i], servers[i]
 	}
 }
 
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// SampleRule samples the trees of a domain whose root message has a type and a name at its own rate,
+// instead of the sample of the router server.
+type SampleRule struct {
+	// Domain is the domain of the tree, every domain matches if it is empty.
+	Domain string `yaml:"domain"`
+	// Type is the type of the root message, every type matches if it is empty.
+	Type string `yaml:"type"`
+	// Name is a pattern of the name of the root message where * matches any characters, every name
+	// matches if it is empty.
+	Name string `yaml:"name"`
+	// Rate is the part of the trees sampled, from 0 to 1. It is required, so that a rule without rate
+	// doesn't drop every tree it matches.
+	Rate *float64 `yaml:"rate"`
+
+	nameRegexp *regexp.Regexp
+}
+
+// compile checks the rule and compiles its name pattern.
+func (r *SampleRule) compile() (err error) {
+	if r.Rate == nil {
+		return fmt.Errorf("sample rule %s: rate is required", r)
+	}
+
+	if *r.Rate < 0 || *r.Rate > 1 {
+		return fmt.Errorf("sample rule %s: rate should be between 0 and 1, %g given", r, *r.Rate)
+	}
+
+	if r.Name == "" {
+		return nil
+	}
+
+	parts := strings.Split(r.Name, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	r.nameRegexp, err = regexp.Compile("^" + strings.Join(parts, ".*") + "$")
+
+	return
+}
+
+// Match reports whether the rule applies to a tree of domain whose root message has t and name.
+func (r *SampleRule) Match(domain, t, name string) bool {
+	if r.Domain != "" && r.Domain != domain {
+		return false
+	}
+
+	if r.Type != "" && r.Type != t {
+		return false
+	}
+
+	return r.nameRegexp == nil || r.nameRegexp.MatchString(name)
+}
+
+func (r *SampleRule) String() string {
+	s := make([]string, 0, 3)
+	for _, v := range []string{r.Domain, r.Type, r.Name} {
+		if v == "" {
+			v = "*"
+		}
+		s = append(s, v)
+	}
+	return strings.Join(s, " ")
+}
@@ -0,0 +1,256 @@
+package encoder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/Orlion/cat-agent/cat/config"
+	"github.com/Orlion/cat-agent/cat/message"
+)
+
+var (
+	ErrShortBuffer = errors.New("binary decoder: unexpected end of tree")
+	ErrBadVarint   = errors.New("binary decoder: varint overflows int64")
+)
+
+// BinaryDecoder decodes the trees encoded by BinaryEncoder and by the native cat clients.
+type BinaryDecoder struct {
+	buf []byte
+	i   int
+	// hostname and ip are the ones of the client that encoded the last tree.
+	hostname []byte
+	ip       []byte
+}
+
+// pendingTransaction is a transaction whose end has not been read yet.
+type pendingTransaction struct {
+	t, name           string
+	timestampInMillis int64
+	children          []message.Message
+}
+
+func NewBinaryDecoder() *BinaryDecoder {
+	return &BinaryDecoder{}
+}
+
+// DecodeMessageTree decodes the tree of b, a frame without its length. The byte fields of the tree share
+// the memory of b. The hostname and the ip of the client are not part of the tree, they are the ones of
+// the agent once the tree is encoded again, GetHostname and GetIp return them. Like the trees sent to
+// the agent, the tree can be discarded by the sampling unless it has a heartbeat or a message that is
+// not successful.
+func (d *BinaryDecoder) DecodeMessageTree(b []byte) (tree *message.MessageTree, err error) {
+	d.buf, d.i = b, 0
+	d.hostname, d.ip = nil, nil
+	defer func() {
+		d.buf = nil
+	}()
+
+	tree = message.NewMessageTree()
+	if err = d.decodeHeader(tree); err != nil {
+		return nil, err
+	}
+
+	if err = d.decodeBody(tree); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+func (d *BinaryDecoder) decodeHeader(tree *message.MessageTree) (err error) {
+	if !bytes.HasPrefix(d.buf, config.BinaryProtocol) {
+		return errors.New("binary decoder: unknown protocol")
+	}
+	d.i = len(config.BinaryProtocol)
+
+	var fields [10][]byte
+	for i := range fields {
+		if fields[i], err = d.readBytes(); err != nil {
+			return
+		}
+	}
+
+	// fields[9] is the session token.
+	tree.SetDomain(fields[0])
+	d.hostname, d.ip = fields[1], fields[2]
+	tree.SetThreadGroupName(fields[3])
+	tree.SetThreadId(fields[4])
+	tree.SetThreadName(fields[5])
+	tree.SetMessageId(fields[6])
+	tree.SetParentMessageId(fields[7])
+	tree.SetRootMessageId(fields[8])
+
+	return
+}
+
+// GetHostname returns the hostname of the client that encoded the last tree.
+func (d *BinaryDecoder) GetHostname() string {
+	return string(d.hostname)
+}
+
+// GetIp returns the ip of the client that encoded the last tree.
+func (d *BinaryDecoder) GetIp() string {
+	return string(d.ip)
+}
+
+func (d *BinaryDecoder) decodeBody(tree *message.MessageTree) (err error) {
+	var (
+		root  message.Message
+		stack []*pendingTransaction
+	)
+
+	for d.i < len(d.buf) {
+		leader := d.buf[d.i]
+		d.i++
+
+		var msg message.Message
+		switch leader {
+		case 't':
+			trans := new(pendingTransaction)
+			if trans.timestampInMillis, trans.t, trans.name, err = d.decodeMessageStart(); err != nil {
+				return
+			}
+			stack = append(stack, trans)
+			continue
+		case 'T':
+			if len(stack) == 0 {
+				return errors.New("binary decoder: transaction end without start")
+			}
+			trans := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			var (
+				status, data     string
+				durationInMicros int64
+			)
+			if status, data, err = d.decodeMessageEnd(); err != nil {
+				return
+			}
+			if durationInMicros, err = d.readI64(); err != nil {
+				return
+			}
+			msg = message.NewTransaction(trans.t, trans.name, status, data, trans.timestampInMillis, trans.children, durationInMicros)
+		case 'A', 'E', 'H', 'M', 'L':
+			var (
+				timestampInMillis int64
+				t, name           string
+				status, data      string
+			)
+			if timestampInMillis, t, name, err = d.decodeMessageStart(); err != nil {
+				return
+			}
+			if status, data, err = d.decodeMessageEnd(); err != nil {
+				return
+			}
+
+			switch leader {
+			case 'A':
+				var durationInMicros int64
+				if durationInMicros, err = d.readI64(); err != nil {
+					return
+				}
+				msg = message.NewTransaction(t, name, status, data, timestampInMillis, nil, durationInMicros)
+			case 'E':
+				msg = message.NewEvent(t, name, status, data, timestampInMillis)
+			case 'H':
+				msg = message.NewHeartbeat(t, name, status, data, timestampInMillis)
+				tree.SetDiscard(false)
+			case 'M':
+				msg = message.NewMetric(t, name, status, data, timestampInMillis)
+			case 'L':
+				msg = message.NewTrace(t, name, status, data, timestampInMillis)
+			}
+		default:
+			return fmt.Errorf("binary decoder: unknown leader: %q", leader)
+		}
+
+		if !msg.IsSuccess() {
+			tree.SetDiscard(false)
+		}
+
+		if len(stack) > 0 {
+			parent := stack[len(stack)-1]
+			parent.children = append(parent.children, msg)
+		} else if root == nil {
+			root = msg
+		} else {
+			return errors.New("binary decoder: tree has more than one root message")
+		}
+	}
+
+	if len(stack) > 0 {
+		return errors.New("binary decoder: transaction is not closed")
+	}
+	if root == nil {
+		return errors.New("binary decoder: tree has no message")
+	}
+
+	tree.SetMessage(root)
+
+	return
+}
+
+func (d *BinaryDecoder) decodeMessageStart() (timestampInMillis int64, t, name string, err error) {
+	if timestampInMillis, err = d.readI64(); err != nil {
+		return
+	}
+	if t, err = d.readString(); err != nil {
+		return
+	}
+	name, err = d.readString()
+	return
+}
+
+func (d *BinaryDecoder) decodeMessageEnd() (status, data string, err error) {
+	if status, err = d.readString(); err != nil {
+		return
+	}
+	data, err = d.readString()
+	return
+}
+
+func (d *BinaryDecoder) readString() (string, error) {
+	b, err := d.readBytes()
+	return string(b), err
+}
+
+func (d *BinaryDecoder) readBytes() ([]byte, error) {
+	n, err := d.readI64()
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n > int64(len(d.buf)-d.i) {
+		return nil, ErrShortBuffer
+	}
+
+	start, end := d.i, d.i+int(n)
+	d.i = end
+
+	// the capacity is limited, so appending to a field never overwrites the rest of the frame.
+	return d.buf[start:end:end], nil
+}
+
+// readI64 reads a varint written by BinaryEncoder.writeI64, 7 bits per byte, least significant group first.
+func (d *BinaryDecoder) readI64() (int64, error) {
+	var v uint64
+	for shift := uint(0); ; shift += 7 {
+		if d.i >= len(d.buf) {
+			return 0, ErrShortBuffer
+		}
+		if shift > 63 {
+			return 0, ErrBadVarint
+		}
+
+		b := d.buf[d.i]
+		d.i++
+		// the 10th byte holds the last bit, anything above it overflows.
+		if shift == 63 && b > 1 {
+			return 0, ErrBadVarint
+		}
+		v |= uint64(b&0x7F) << shift
+		if b&0x80 == 0 {
+			return int64(v), nil
+		}
+	}
+}
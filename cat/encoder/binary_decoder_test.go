@@ -0,0 +1,255 @@
+package encoder
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/Orlion/cat-agent/cat/config"
+	"github.com/Orlion/cat-agent/cat/message"
+	"github.com/Orlion/cat-agent/log"
+)
+
+func init() {
+	log.Init(&log.Config{
+		StdoutLevel: "error",
+	})
+}
+
+// initTestConfig gives the encoder a hostname and an ip, the router server is unreachable.
+func initTestConfig(t *testing.T) {
+	err := config.Init(&config.Config{
+		Domain:  "TestBinaryDecoder",
+		Servers: []string{"127.0.0.1:1"},
+	})
+	if err != nil {
+		t.Fatalf("config.Init error: %s", err)
+	}
+}
+
+var testStrings = []string{"", "0", "URL", "/order/create", "select *\n\tfrom `order`", "订单", "a\x00b", string(make([]byte, 300))}
+
+func randomString(r *rand.Rand) string {
+	if r.Intn(4) == 0 {
+		b := make([]byte, r.Intn(200))
+		r.Read(b)
+		return string(b)
+	}
+	return testStrings[r.Intn(len(testStrings))]
+}
+
+func randomInt64(r *rand.Rand) int64 {
+	switch r.Intn(4) {
+	case 0:
+		return []int64{0, 1, 127, 128, math.MaxInt64, -1, math.MinInt64}[r.Intn(7)]
+	case 1:
+		return -r.Int63()
+	default:
+		return r.Int63()
+	}
+}
+
+func randomMessage(r *rand.Rand, depth int) message.Message {
+	t, name, status, data, timestamp := randomString(r), randomString(r), randomString(r), randomString(r), randomInt64(r)
+
+	switch r.Intn(6) {
+	case 0:
+		return message.NewEvent(t, name, status, data, timestamp)
+	case 1:
+		return message.NewHeartbeat(t, name, status, data, timestamp)
+	case 2:
+		return message.NewMetric(t, name, status, data, timestamp)
+	case 3:
+		return message.NewTrace(t, name, status, data, timestamp)
+	default:
+		var children []message.Message
+		if depth > 0 {
+			for i := r.Intn(5); i > 0; i-- {
+				children = append(children, randomMessage(r, depth-1))
+			}
+		}
+		return message.NewTransaction(t, name, status, data, timestamp, children, randomInt64(r))
+	}
+}
+
+func randomTree(r *rand.Rand) *message.MessageTree {
+	tree := message.NewMessageTree()
+	tree.SetDomain([]byte(randomString(r)))
+	tree.SetThreadGroupName([]byte(randomString(r)))
+	tree.SetThreadId([]byte(randomString(r)))
+	tree.SetThreadName([]byte(randomString(r)))
+	tree.SetMessageId([]byte(randomString(r)))
+	tree.SetParentMessageId([]byte(randomString(r)))
+	tree.SetRootMessageId([]byte(randomString(r)))
+	tree.SetMessage(randomMessage(r, 4))
+	return tree
+}
+
+func assertSameMessage(t *testing.T, expected, actual message.Message) {
+	if fmt.Sprintf("%T", expected) != fmt.Sprintf("%T", actual) ||
+		expected.GetType() != actual.GetType() ||
+		expected.GetName() != actual.GetName() ||
+		expected.GetStatus() != actual.GetStatus() ||
+		expected.GetData() != actual.GetData() ||
+		expected.GetTimestamp() != actual.GetTimestamp() {
+		t.Fatalf("message: %+v, expected: %+v", actual, expected)
+	}
+
+	if trans, ok := expected.(*message.Transaction); ok {
+		actualTrans := actual.(*message.Transaction)
+		if trans.GetDurationInMicros() != actualTrans.GetDurationInMicros() {
+			t.Fatalf("duration: %d, expected: %d", actualTrans.GetDurationInMicros(), trans.GetDurationInMicros())
+		}
+		if len(trans.GetChildren()) != len(actualTrans.GetChildren()) {
+			t.Fatalf("%d children, expected %d", len(actualTrans.GetChildren()), len(trans.GetChildren()))
+		}
+		for i, child := range trans.GetChildren() {
+			assertSameMessage(t, child, actualTrans.GetChildren()[i])
+		}
+	}
+}
+
+func TestBinaryDecoderRoundTrip(t *testing.T) {
+	initTestConfig(t)
+	defer config.Shutdown()
+
+	r := rand.New(rand.NewSource(1))
+	e, d := NewBinaryEncoder(), NewBinaryDecoder()
+
+	for i := 0; i < 1000; i++ {
+		tree := randomTree(r)
+		if err := e.EncodeMessageTree(tree); err != nil {
+			t.Fatalf("tree %d encode error: %s", i, err)
+		}
+		encoded := append([]byte{}, e.Bytes()...)
+
+		decoded, err := d.DecodeMessageTree(encoded)
+		if err != nil {
+			t.Fatalf("tree %d decode error: %s", i, err)
+		}
+
+		for j, field := range [][2][]byte{
+			{tree.GetDomain(), decoded.GetDomain()},
+			{tree.GetThreadGroupName(), decoded.GetThreadGroupName()},
+			{tree.GetThreadId(), decoded.GetThreadId()},
+			{tree.GetThreadName(), decoded.GetThreadName()},
+			{tree.GetMessageId(), decoded.GetMessageId()},
+			{tree.GetParentMessageId(), decoded.GetParentMessageId()},
+			{tree.GetRootMessageId(), decoded.GetRootMessageId()},
+		} {
+			if !bytes.Equal(field[0], field[1]) {
+				t.Fatalf("tree %d header field %d: %q, expected: %q", i, j, field[1], field[0])
+			}
+		}
+		if d.GetHostname() != config.GetInstance().GetHostname() || d.GetIp() != config.GetInstance().GetIp() {
+			t.Fatalf("tree %d hostname: %s, ip: %s, expected the ones of the encoder", i, d.GetHostname(), d.GetIp())
+		}
+
+		assertSameMessage(t, tree.GetMessage(), decoded.GetMessage())
+
+		// the decoded tree is encoded to the very same bytes.
+		if err = e.EncodeMessageTree(decoded); err != nil {
+			t.Fatalf("tree %d encode decoded tree error: %s", i, err)
+		}
+		if !bytes.Equal(encoded, e.Bytes()) {
+			t.Fatalf("tree %d encoded to %x after a round trip, expected %x", i, e.Bytes(), encoded)
+		}
+	}
+}
+
+func TestBinaryDecoderVarint(t *testing.T) {
+	for _, i := range []int64{0, 1, 127, 128, 300, 1600000000000, math.MaxInt64, -1, math.MinInt64} {
+		e := NewBinaryEncoder()
+		if err := e.writeI64(i); err != nil {
+			t.Fatalf("writeI64 %d error: %s", i, err)
+		}
+
+		d := &BinaryDecoder{buf: e.Bytes()}
+		if actual, err := d.readI64(); err != nil || actual != i || d.i != len(d.buf) {
+			t.Fatalf("readI64 of %d: %d, %v, %d of %d bytes read", i, actual, err, d.i, len(d.buf))
+		}
+	}
+
+	d := &BinaryDecoder{buf: bytes.Repeat([]byte{0xFF}, 11)}
+	if _, err := d.readI64(); err != ErrBadVarint {
+		t.Fatalf("readI64 of 11 bytes error: %v, expected: %s", err, ErrBadVarint)
+	}
+
+	// a 10th byte with bits above the last one overflows.
+	for _, last := range []byte{0x02, 0x7F} {
+		d = &BinaryDecoder{buf: append(bytes.Repeat([]byte{0xFF}, 9), last)}
+		if _, err := d.readI64(); err != ErrBadVarint {
+			t.Fatalf("readI64 with a 10th byte %#x error: %v, expected: %s", last, err, ErrBadVarint)
+		}
+	}
+}
+
+// TestBinaryDecoderWire decodes a tree written byte by byte, it pins the NT1 format of the cat clients.
+func TestBinaryDecoderWire(t *testing.T) {
+	b := []byte("NT1")
+	for _, field := range []string{"order", "host", "10.0.0.1", "group", "1", "main", "order-0a000001-447323-1", "", "", ""} {
+		b = append(b, byte(len(field)))
+		b = append(b, field...)
+	}
+	b = append(b, 't', 0x80, 0x80, 0xba, 0xbb, 0xc8, 0x2e, 3, 'U', 'R', 'L', 6, '/', 'o', 'r', 'd', 'e', 'r')
+	b = append(b, 'E', 0x80, 0x80, 0xba, 0xbb, 0xc8, 0x2e, 3, 'S', 'Q', 'L', 6, 's', 'e', 'l', 'e', 'c', 't', 1, '0', 0)
+	b = append(b, 'T', 5, 'E', 'r', 'r', 'o', 'r', 0, 0xe8, 0x07)
+
+	tree, err := NewBinaryDecoder().DecodeMessageTree(b)
+	if err != nil {
+		t.Fatalf("decode error: %s", err)
+	}
+
+	if string(tree.GetDomain()) != "order" || string(tree.GetThreadName()) != "main" || string(tree.GetMessageId()) != "order-0a000001-447323-1" {
+		t.Fatalf("unexpected header, domain: %s, threadName: %s, messageId: %s", tree.GetDomain(), tree.GetThreadName(), tree.GetMessageId())
+	}
+
+	expected := message.NewTransaction("URL", "/order", "Error", "", 1600000000000, []message.Message{
+		message.NewEvent("SQL", "select", "0", "", 1600000000000),
+	}, 1000)
+	assertSameMessage(t, expected, tree.GetMessage())
+
+	// a failed transaction is never sampled out.
+	if tree.CanDiscard() {
+		t.Fatal("tree with a failed transaction should not be discardable")
+	}
+
+	// every truncation of the tree is an error.
+	for i := 0; i < len(b); i++ {
+		if _, err = NewBinaryDecoder().DecodeMessageTree(b[:i]); err == nil {
+			t.Fatalf("tree truncated to %d bytes should fail", i)
+		}
+	}
+}
+
+func TestBinaryDecoderMalformed(t *testing.T) {
+	header := []byte("NT1")
+	for i := 0; i < 10; i++ {
+		header = append(header, 0)
+	}
+
+	for _, c := range []struct {
+		body []byte
+		err  string
+	}{
+		{[]byte("NT2"), "unknown protocol"},
+		{nil, "tree has no message"},
+		{[]byte{'X'}, "unknown leader"},
+		{[]byte{'T', 0, 0, 0}, "transaction end without start"},
+		{[]byte{'t', 0, 0, 0}, "transaction is not closed"},
+		{[]byte{'E', 0, 0, 0, 0, 0, 'E', 0, 0, 0, 0, 0}, "more than one root message"},
+		{[]byte{'E', 0, 0, 0, 0, 0x7F}, ErrShortBuffer.Error()},
+	} {
+		b := c.body
+		if c.err != "unknown protocol" {
+			b = append(append([]byte{}, header...), c.body...)
+		}
+
+		_, err := NewBinaryDecoder().DecodeMessageTree(b)
+		if err == nil || !bytes.Contains([]byte(err.Error()), []byte(c.err)) {
+			t.Fatalf("body %q error: %v, expected: %s", c.body, err, c.err)
+		}
+	}
+}
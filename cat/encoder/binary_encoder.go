@@ -92,6 +92,10 @@ func (e *BinaryEncoder) encodeMessage(m message.Message) (err error) {
 		return e.encodeEvent(m.(*message.Event))
 	case *message.Heartbeat:
 		return e.encodeHeartbeat(m.(*message.Heartbeat))
+	case *message.Metric:
+		return e.encodeMetric(m.(*message.Metric))
+	case *message.Trace:
+		return e.encodeTrace(m.(*message.Trace))
 	default:
 		return
 	}
@@ -134,6 +138,14 @@ func (e *BinaryEncoder) encodeHeartbeat(heartbeat *message.Heartbeat) (err error
 	return e.encodeMessageWithLeader(heartbeat, 'H')
 }
 
+func (e *BinaryEncoder) encodeMetric(metric *message.Metric) (err error) {
+	return e.encodeMessageWithLeader(metric, 'M')
+}
+
+func (e *BinaryEncoder) encodeTrace(trace *message.Trace) (err error) {
+	return e.encodeMessageWithLeader(trace, 'L')
+}
+
 func (e *BinaryEncoder) encodeMessageWithLeader(m message.Message, leader rune) (err error) {
 	if _, err = e.buf.WriteRune(leader); err != nil {
 		return
@@ -198,16 +210,19 @@ func (e *BinaryEncoder) writeBytes(b []byte) (err error) {
 	return
 }
 
+// writeI64 writes i as a varint, 7 bits per byte, least significant group first. A negative i is written
+// as its two's complement in 10 bytes, shifting it as an int64 would never reach 0.
 func (e *BinaryEncoder) writeI64(i int64) (err error) {
+	u := uint64(i)
 	for {
-		if i&^0x7F == 0 {
-			err = e.buf.WriteByte(byte(i))
+		if u&^0x7F == 0 {
+			err = e.buf.WriteByte(byte(u))
 			return
 		} else {
-			if err = e.buf.WriteByte(byte(i&0x7F | 0x80)); err != nil {
+			if err = e.buf.WriteByte(byte(u&0x7F | 0x80)); err != nil {
 				return
 			}
-			i >>= 7
+			u >>= 7
 		}
 	}
 }
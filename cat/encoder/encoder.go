@@ -0,0 +1,23 @@
+package encoder
+
+import (
+	"github.com/Orlion/cat-agent/cat/config"
+	"github.com/Orlion/cat-agent/cat/message"
+)
+
+// Encoder encodes a tree in one of the formats the cat routers take, Bytes returns the encoded tree
+// until the next EncodeMessageTree.
+type Encoder interface {
+	EncodeMessageTree(tree *message.MessageTree) error
+	BufLen() int
+	Bytes() []byte
+}
+
+// NewEncoder creates the encoder named by config.EncoderBinary or config.EncoderPlainText,
+// any other name gets the binary encoder.
+func NewEncoder(name string) Encoder {
+	if name == config.EncoderPlainText {
+		return NewPlainTextEncoder()
+	}
+	return NewBinaryEncoder()
+}
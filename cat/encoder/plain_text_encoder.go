@@ -0,0 +1,136 @@
+package encoder
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+
+	"github.com/Orlion/cat-agent/cat/config"
+	"github.com/Orlion/cat-agent/cat/message"
+)
+
+const plainTextTimeLayout = "2006-01-02 15:04:05.000"
+
+// PlainTextEncoder encodes a tree in PT1, the human readable format of the cat clients. Every message is a
+// line of tab separated fields, tabs, newlines and backslashes in the fields are escaped with a backslash.
+type PlainTextEncoder struct {
+	buf  *bytes.Buffer
+	tree *message.MessageTree
+}
+
+func NewPlainTextEncoder() *PlainTextEncoder {
+	return &PlainTextEncoder{
+		buf: bytes.NewBuffer([]byte{}),
+	}
+}
+
+func (e *PlainTextEncoder) BufLen() int {
+	return e.buf.Len()
+}
+
+func (e *PlainTextEncoder) Bytes() []byte {
+	return e.buf.Bytes()
+}
+
+func (e *PlainTextEncoder) EncodeMessageTree(tree *message.MessageTree) (err error) {
+	e.buf.Reset()
+
+	e.tree = tree
+	e.encodeHeader()
+	e.encodeMessage(tree.GetMessage())
+
+	return
+}
+
+func (e *PlainTextEncoder) encodeHeader() {
+	e.buf.Write(config.PlainTextProtocol)
+	e.buf.WriteByte('\t')
+	e.writeField(e.tree.GetDomain())
+	e.writeField([]byte(config.GetInstance().GetHostname()))
+	e.writeField([]byte(config.GetInstance().GetIp()))
+	e.writeField(e.tree.GetThreadGroupName())
+	e.writeField(e.tree.GetThreadId())
+	e.writeField(e.tree.GetThreadName())
+	e.writeField(e.tree.GetMessageId())
+	e.writeField(e.tree.GetParentMessageId())
+	e.writeField(e.tree.GetRootMessageId())
+	// sessionToken.
+	e.buf.WriteByte('\n')
+}
+
+func (e *PlainTextEncoder) encodeMessage(m message.Message) {
+	switch m := m.(type) {
+	case *message.Transaction:
+		e.encodeTransaction(m)
+	case *message.Event:
+		e.encodeLine('E', m.GetTimestamp(), m, "")
+	case *message.Heartbeat:
+		e.encodeLine('H', m.GetTimestamp(), m, "")
+	case *message.Metric:
+		e.encodeLine('M', m.GetTimestamp(), m, "")
+	case *message.Trace:
+		e.encodeLine('L', m.GetTimestamp(), m, "")
+	}
+}
+
+// encodeTransaction writes a transaction without children as a single A line, otherwise its children
+// are between a t line and a T line stamped with the end of the transaction.
+func (e *PlainTextEncoder) encodeTransaction(trans *message.Transaction) {
+	duration := strconv.FormatInt(trans.GetDurationInMicros(), 10) + "us"
+
+	children := trans.GetChildren()
+	if len(children) == 0 {
+		e.encodeLine('A', trans.GetTimestamp(), trans, duration)
+		return
+	}
+
+	e.buf.WriteByte('t')
+	e.writeTimestamp(trans.GetTimestamp())
+	e.writeField([]byte(trans.GetType()))
+	e.writeField([]byte(trans.GetName()))
+	e.buf.WriteByte('\n')
+
+	for _, child := range children {
+		e.encodeMessage(child)
+	}
+
+	e.encodeLine('T', trans.GetTimestamp()+trans.GetDurationInMicros()/1000, trans, duration)
+}
+
+// encodeLine writes a message with its status and data, duration is only written for transactions.
+func (e *PlainTextEncoder) encodeLine(leader byte, timestampInMillis int64, m message.Message, duration string) {
+	e.buf.WriteByte(leader)
+	e.writeTimestamp(timestampInMillis)
+	e.writeField([]byte(m.GetType()))
+	e.writeField([]byte(m.GetName()))
+	e.writeField([]byte(m.GetStatus()))
+	if duration != "" {
+		e.writeField([]byte(duration))
+	}
+	e.writeField([]byte(m.GetData()))
+	e.buf.WriteByte('\n')
+}
+
+func (e *PlainTextEncoder) writeTimestamp(timestampInMillis int64) {
+	e.buf.WriteString(time.Unix(0, timestampInMillis*int64(time.Millisecond)).Format(plainTextTimeLayout))
+	e.buf.WriteByte('\t')
+}
+
+// writeField writes b escaped and followed by a tab.
+func (e *PlainTextEncoder) writeField(b []byte) {
+	for _, c := range b {
+		switch c {
+		case '\t':
+			e.buf.WriteString(`\t`)
+		case '\r':
+			e.buf.WriteString(`\r`)
+		case '\n':
+			e.buf.WriteString(`\n`)
+		case '\\':
+			e.buf.WriteString(`\\`)
+		default:
+			e.buf.WriteByte(c)
+		}
+	}
+	e.buf.WriteByte('\t')
+}
@@ -0,0 +1,47 @@
+package encoder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Orlion/cat-agent/cat/config"
+	"github.com/Orlion/cat-agent/cat/message"
+)
+
+func TestPlainTextEncoder(t *testing.T) {
+	initTestConfig(t)
+	defer config.Shutdown()
+
+	tree := message.NewMessageTree()
+	tree.SetDomain([]byte("order"))
+	tree.SetThreadGroupName([]byte("group"))
+	tree.SetThreadId([]byte("1"))
+	tree.SetThreadName([]byte("main"))
+	tree.SetMessageId([]byte("order-7f000001-447323-1"))
+	tree.SetRootMessageId([]byte("order-7f000001-447323-0"))
+	tree.SetMessage(message.NewTransaction("URL", "/order", "0", "id=1", 1600000000000, []message.Message{
+		message.NewEvent("SQL", "select", "0", "select *\n\tfrom `order` where name = 'a\\\\b'", 1600000000001),
+		message.NewTransaction("Cache", "get", "0", "", 1600000000002, nil, 300),
+		message.NewMetric("", "order.count", message.MetricCount, "1", 1600000000003),
+	}, 1500000))
+
+	e := NewPlainTextEncoder()
+	if err := e.EncodeMessageTree(tree); err != nil {
+		t.Fatalf("encode error: %s", err)
+	}
+
+	at := func(timestampInMillis int64) string {
+		return time.Unix(0, timestampInMillis*int64(time.Millisecond)).Format("2006-01-02 15:04:05.000")
+	}
+	c := config.GetInstance()
+	expected := "PT1\torder\t" + c.GetHostname() + "\t" + c.GetIp() + "\tgroup\t1\tmain\torder-7f000001-447323-1\t\torder-7f000001-447323-0\t\n" +
+		"t" + at(1600000000000) + "\tURL\t/order\t\n" +
+		"E" + at(1600000000001) + "\tSQL\tselect\t0\tselect *\\n\\tfrom `order` where name = 'a\\\\\\\\b'\t\n" +
+		"A" + at(1600000000002) + "\tCache\tget\t0\t300us\t\t\n" +
+		"M" + at(1600000000003) + "\t\torder.count\tC\t1\t\n" +
+		"T" + at(1600000001500) + "\tURL\t/order\t0\t1500000us\tid=1\t\n"
+
+	if actual := string(e.Bytes()); actual != expected {
+		t.Fatalf("encoded:\n%s\nexpected:\n%s", actual, expected)
+	}
+}
@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/Orlion/cat-agent/cat/config"
 	"github.com/Orlion/cat-agent/cat/message"
 	"github.com/Orlion/cat-agent/log"
+	"github.com/Orlion/cat-agent/metrics"
 	"github.com/Orlion/cat-agent/pkg/timex"
 )
 
@@ -33,6 +35,7 @@ type eventWithDomain struct {
 type EventAggregator struct {
 	datas map[string]map[string]*eventData
 	ch    chan *eventWithDomain
+	size  int64
 }
 
 func newEventAggregator() *EventAggregator {
@@ -75,6 +78,7 @@ func (ea *EventAggregator) logEvent(domain string, event *message.Event) {
 	select {
 	case ea.ch <- &eventWithDomain{domain, event}:
 	default:
+		metrics.AggregatorDropped.WithLabelValues("event").Inc()
 		log.Warnf("event aggregatro's ch is full, event: %s,%s  has been discarded", event.GetType(), event.GetName())
 	}
 }
@@ -91,7 +95,8 @@ func (ea *EventAggregator) getOrDefault(eventWithDomain *eventWithDomain) (data
 				fail:  0,
 			}
 
-			domainDatas[eventWithDomain.domain] = data
+			domainDatas[key] = data
+			atomic.AddInt64(&ea.size, 1)
 		}
 	} else {
 		data = &eventData{
@@ -102,6 +107,7 @@ func (ea *EventAggregator) getOrDefault(eventWithDomain *eventWithDomain) (data
 		}
 
 		ea.datas[eventWithDomain.domain] = map[string]*eventData{key: data}
+		atomic.AddInt64(&ea.size, 1)
 	}
 
 	return data
@@ -120,10 +126,15 @@ func (ea *EventAggregator) flush() {
 			trans.AddChild(child)
 		}
 
+		messageId, err := CreateMessageId(domain)
+		if err != nil {
+			log.Errorf("event aggregator create message id of domain %s error: %s, the aggregated tree has been dropped", domain, err.Error())
+			continue
+		}
+
 		tree := message.NewMessageTree()
 		tree.SetMessage(trans)
 		tree.SetDomain([]byte(domain))
-		messageId := CreateMessageId(domain)
 		tree.SetMessageId(messageId)
 		tree.SetThreadGroupName(config.ThreadGroupNameCatAgent)
 		tree.SetThreadId([]byte(strconv.Itoa(os.Getpid())))
@@ -136,4 +147,10 @@ func (ea *EventAggregator) flush() {
 	}
 
 	ea.datas = make(map[string]map[string]*eventData)
+	atomic.StoreInt64(&ea.size, 0)
+}
+
+// getSize returns the number of events waiting for the next flush, it is safe to call from any goroutine.
+func (ea *EventAggregator) getSize() int64 {
+	return atomic.LoadInt64(&ea.size)
 }
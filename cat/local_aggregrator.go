@@ -11,15 +11,26 @@ import (
 type LocalAggregator struct {
 	ta         *TransactionAggregator
 	ea         *EventAggregator
+	ma         *MetricAggregator
 	cancel     func()
 	wg         *sync.WaitGroup
 	inShutdown atomicx.Bool
 }
 
+type AggregatorStats struct {
+	Transactions          int64 `json:"transactions"`
+	Events                int64 `json:"events"`
+	TransactionChannelLen int   `json:"transaction_channel_len"`
+	EventChannelLen       int   `json:"event_channel_len"`
+	Metrics               int64 `json:"metrics"`
+	MetricChannelLen      int   `json:"metric_channel_len"`
+}
+
 func newLocalAggregator() *LocalAggregator {
 	return &LocalAggregator{
 		ta: newTransactionAggregator(),
 		ea: newEventAggregator(),
+		ma: newMetricAggregator(),
 		wg: new(sync.WaitGroup),
 	}
 }
@@ -27,11 +38,15 @@ func newLocalAggregator() *LocalAggregator {
 func (la *LocalAggregator) run() {
 	var ctx context.Context
 	ctx, la.cancel = context.WithCancel(context.Background())
-	la.wg.Add(2)
+	la.wg.Add(3)
 	go func() {
 		la.ea.run(ctx)
 		la.wg.Done()
 	}()
+	go func() {
+		la.ma.run(ctx)
+		la.wg.Done()
+	}()
 	go func() {
 		la.ta.run(ctx)
 		la.wg.Done()
@@ -44,9 +59,22 @@ func (la *LocalAggregator) shutdown() {
 	la.wg.Wait()
 }
 
-func (la *LocalAggregator) aggregate(tree *message.MessageTree) {
+// stats returns the items waiting for the next flush and the channel lengths of each aggregator.
+func (la *LocalAggregator) stats() AggregatorStats {
+	return AggregatorStats{
+		Transactions:          la.ta.getSize(),
+		Events:                la.ea.getSize(),
+		TransactionChannelLen: len(la.ta.ch),
+		EventChannelLen:       len(la.ea.ch),
+		Metrics:               la.ma.getSize(),
+		MetricChannelLen:      len(la.ma.ch),
+	}
+}
+
+// aggregate reports whether the tree has been aggregated, trees that can not be aggregated are discarded.
+func (la *LocalAggregator) aggregate(tree *message.MessageTree) bool {
 	if la.inShutdown.Get() {
-		return
+		return false
 	}
 
 	domain := string(tree.GetDomain())
@@ -58,6 +86,55 @@ func (la *LocalAggregator) aggregate(tree *message.MessageTree) {
 	case *message.Event:
 		la.ea.logEvent(domain, msg.(*message.Event))
 	default:
+		return false
+	}
+
+	return true
+}
+
+// aggregateMetrics hands the metrics of the tree to the metric aggregator and removes them from the tree,
+// it reports whether anything is left to send.
+func (la *LocalAggregator) aggregateMetrics(tree *message.MessageTree) bool {
+	domain := string(tree.GetDomain())
+
+	switch msg := tree.GetMessage().(type) {
+	case *message.Metric:
+		if !la.inShutdown.Get() {
+			la.ma.logMetric(domain, msg)
+		}
+		return false
+	case *message.Transaction:
+		la.extractMetrics(domain, msg)
+	}
+
+	return true
+}
+
+func (la *LocalAggregator) extractMetrics(domain string, transaction *message.Transaction) {
+	children := transaction.GetChildren()
+	for i, child := range children {
+		switch child.(type) {
+		case *message.Transaction:
+			la.extractMetrics(domain, child.(*message.Transaction))
+		case *message.Metric:
+			// the children are copied on the first metric, most transactions have none.
+			rest := make([]message.Message, i, len(children))
+			copy(rest, children[:i])
+			for _, child := range children[i:] {
+				if metric, ok := child.(*message.Metric); ok {
+					if !la.inShutdown.Get() {
+						la.ma.logMetric(domain, metric)
+					}
+					continue
+				}
+				if trans, ok := child.(*message.Transaction); ok {
+					la.extractMetrics(domain, trans)
+				}
+				rest = append(rest, child)
+			}
+			transaction.SetChildren(rest)
+			return
+		}
 	}
 }
 
@@ -1,24 +1,22 @@
 package cat
 
 import (
-	"sync/atomic"
-
-	"github.com/Orlion/cat-agent/cat/config"
 	"github.com/Orlion/cat-agent/cat/message"
 	"github.com/Orlion/cat-agent/cat/sender"
 	"github.com/Orlion/cat-agent/log"
 )
 
 type Manager struct {
-	aggregator  *LocalAggregator
-	sender      sender.Sender
-	sampleCount uint64
+	aggregator *LocalAggregator
+	sender     sender.Sender
+	sampler    *sampler
 }
 
 func newManager() *Manager {
 	manager := &Manager{
 		sender:     sender.NewTcpSender(),
 		aggregator: newLocalAggregator(),
+		sampler:    newSampler(),
 	}
 
 	return manager
@@ -36,23 +34,34 @@ func (m *Manager) shutdown() {
 	m.sender.Shutdown()
 }
 
-func (m *Manager) send(tree *message.MessageTree) {
-	if tree.CanDiscard() && !m.hitSample() {
-		m.aggregator.aggregate(tree)
-	} else {
-		m.sender.Offer(tree)
+func (m *Manager) stats() Stats {
+	return Stats{
+		Sender:     m.sender.Stats(),
+		Aggregator: m.aggregator.stats(),
+		Sampler:    m.sampler.stats(),
 	}
 }
 
-func (m *Manager) hitSample() bool {
-	sampleRatio := config.GetInstance().GetSample()
+func (m *Manager) reload() {
+	log.Info("manager reload...")
+	m.sender.Reload()
+	m.sampler.reload()
+}
+
+func (m *Manager) send(tree *message.MessageTree) SendResult {
+	if tree.CanDiscard() && !m.sampler.hit(tree) {
+		if m.aggregator.aggregate(tree) {
+			return SendAggregated
+		}
+		return SendSampledOut
+	}
 
-	if sampleRatio >= 1.0 {
-		return true
-	} else if sampleRatio < 1e-9 {
-		return false
-	} else {
-		count := atomic.AddUint64(&m.sampleCount, 1)
-		return count%(uint64(1/sampleRatio)) == 0
+	switch m.sender.Offer(tree) {
+	case sender.OfferQueued:
+		return SendQueued
+	case sender.OfferSpooled:
+		return SendSpooled
+	default:
+		return SendDroppedQueueFull
 	}
 }
@@ -0,0 +1,29 @@
+package message
+
+// The statuses of a metric tell how cat reads its data.
+const (
+	// MetricCount is a counter, the data is the count, it defaults to 1.
+	MetricCount = "C"
+	// MetricSum is a value that is summed up, the data is the value.
+	MetricSum = "S"
+	// MetricSumCount is a pre-aggregated sum, the data is "count,sum".
+	MetricSumCount = "S,C"
+	// MetricDuration is a duration in milliseconds, it is aggregated like a sum.
+	MetricDuration = "T"
+)
+
+// Metric is a business metric, its name is the metric key and its status is one of the Metric* kinds.
+type Metric struct {
+	baseMessage
+}
+
+func NewMetric(t, name, status, data string, timestampInMillis int64) *Metric {
+	return &Metric{
+		baseMessage: newBaseMessage(t, name, status, data, timestampInMillis),
+	}
+}
+
+// IsSuccess is always true, the status of a metric is its kind.
+func (m *Metric) IsSuccess() bool {
+	return true
+}
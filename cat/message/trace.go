@@ -0,0 +1,12 @@
+package message
+
+// Trace is an application log line shown inline in the logview of its tree.
+type Trace struct {
+	baseMessage
+}
+
+func NewTrace(t, name, status, data string, timestampInMillis int64) *Trace {
+	return &Trace{
+		baseMessage: newBaseMessage(t, name, status, data, timestampInMillis),
+	}
+}
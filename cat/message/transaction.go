@@ -26,6 +26,10 @@ func (trans *Transaction) SetDurationInMicros(durationInMicros int64) {
 	trans.durationInMicros = durationInMicros
 }
 
+func (trans *Transaction) SetChildren(children []Message) {
+	trans.children = children
+}
+
 func (trans *Transaction) AddChild(child Message) {
 	trans.children = append(trans.children, child)
 }
@@ -2,33 +2,66 @@ package cat
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/Orlion/cat-agent/cat/config"
+	"github.com/Orlion/cat-agent/log"
 )
 
+// ErrMessageIdUnavailable is returned when the reservation that covers a message id could not be persisted,
+// the id is not handed out since it could be handed out again after a restart.
+var ErrMessageIdUnavailable = errors.New("message id unavailable")
+
+// ErrBadDomain is returned for a domain that is empty or has a tab or a line break, it can't be
+// written to the state file.
+var ErrBadDomain = errors.New("bad domain")
+
+func checkDomain(domain string) error {
+	if domain == "" || strings.ContainsAny(domain, "\t\r\n") {
+		return fmt.Errorf("%w: %q", ErrBadDomain, domain)
+	}
+	return nil
+}
+
+type messageIdCounter struct {
+	index uint32
+	// limit is the highest index covered by the reservation persisted in the state file.
+	limit uint32
+}
+
 type MessageIdFactory struct {
 	mu        sync.RWMutex
 	domain    string
 	ipAddress []byte
 	idPrefix  []byte
-	index     uint32
-	m         map[string]*uint32
+	local     *messageIdCounter
+	m         map[string]*messageIdCounter
 	hour      []byte
+	state     *messageIdState
+	stateMu   sync.Mutex
 }
 
 func newMessageIdFactory() *MessageIdFactory {
 	return &MessageIdFactory{
 		domain:    config.GetInstance().GetDomain(),
 		ipAddress: []byte(config.GetInstance().GetIpHex()),
-		m:         make(map[string]*uint32),
+		local:     new(messageIdCounter),
+		m:         make(map[string]*messageIdCounter),
+		state:     newMessageIdState(config.GetInstance().GetMessageIdStateFile(), config.GetInstance().GetMessageIdBlockSize()),
 	}
 }
 
-func (f *MessageIdFactory) getNextId(domain string) []byte {
+func (f *MessageIdFactory) getNextId(domain string) ([]byte, error) {
+	if err := checkDomain(domain); err != nil {
+		return nil, err
+	}
+
 	if domain == f.domain {
 		return f.getLocalNextId()
 	} else {
@@ -36,58 +69,219 @@ func (f *MessageIdFactory) getNextId(domain string) []byte {
 	}
 }
 
-func (f *MessageIdFactory) getLocalNextId() []byte {
+func (f *MessageIdFactory) getLocalNextId() ([]byte, error) {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
+	index, err := f.nextIndexLocked(f.local, 1)
+	if err != nil {
+		return nil, err
+	}
 	buf := new(bytes.Buffer)
 	buf.Write(f.idPrefix)
-	buf.WriteString(strconv.Itoa(int(atomic.AddUint32(&f.index, 1))))
-	return buf.Bytes()
+	buf.WriteString(strconv.Itoa(int(index)))
+	return buf.Bytes(), nil
 }
 
-func (f *MessageIdFactory) getDomainNextId(domain string) []byte {
+func (f *MessageIdFactory) getDomainNextId(domain string) ([]byte, error) {
 	buf := new(bytes.Buffer)
+	var (
+		index uint32
+		err   error
+	)
 
 	f.mu.RLock()
-	if index, exists := f.m[domain]; exists {
-		buf.WriteString(domain)
-		buf.WriteByte('-')
-		buf.Write(f.ipAddress)
-		buf.WriteByte('-')
-		buf.Write(f.hour)
-		buf.WriteByte('-')
-		buf.WriteString(strconv.Itoa(int(atomic.AddUint32(index, 1))))
+	if counter, exists := f.m[domain]; exists {
+		f.writeDomainIdPrefix(buf, domain)
+		index, err = f.nextIndexLocked(counter, 1)
 		f.mu.RUnlock()
 	} else {
 		f.mu.RUnlock()
 		f.mu.Lock()
-		if index, exists := f.m[domain]; exists {
-			buf.WriteString(domain)
-			buf.WriteByte('-')
-			buf.Write(f.ipAddress)
-			buf.WriteByte('-')
-			buf.Write(f.hour)
-			buf.WriteByte('-')
-			buf.WriteString(strconv.Itoa(int(atomic.AddUint32(index, 1))))
-		} else {
-			buf.WriteString(domain)
-			buf.WriteByte('-')
-			buf.Write(f.ipAddress)
-			buf.WriteByte('-')
-			buf.Write(f.hour)
-			buf.Write([]byte{'-', '1'})
-			var i uint32 = 1
-			f.m[domain] = &i
-		}
+		f.writeDomainIdPrefix(buf, domain)
+		index, err = f.nextIndexLocked(f.getOrCreateCounterLocked(domain), 1)
+		f.mu.Unlock()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteString(strconv.Itoa(int(index)))
+
+	return buf.Bytes(), nil
+}
+
+// getNextIds reserves n consecutive ids of domain with a single atomic add.
+func (f *MessageIdFactory) getNextIds(domain string, n int) ([][]byte, error) {
+	if err := checkDomain(domain); err != nil {
+		return nil, err
+	}
 
+	prefix := new(bytes.Buffer)
+	var (
+		last uint32
+		err  error
+	)
+
+	f.mu.RLock()
+	if domain == f.domain {
+		prefix.Write(f.idPrefix)
+		last, err = f.nextIndexLocked(f.local, uint32(n))
+		f.mu.RUnlock()
+	} else if counter, exists := f.m[domain]; exists {
+		f.writeDomainIdPrefix(prefix, domain)
+		last, err = f.nextIndexLocked(counter, uint32(n))
+		f.mu.RUnlock()
+	} else {
+		f.mu.RUnlock()
+		f.mu.Lock()
+		f.writeDomainIdPrefix(prefix, domain)
+		last, err = f.nextIndexLocked(f.getOrCreateCounterLocked(domain), uint32(n))
 		f.mu.Unlock()
 	}
 
-	return buf.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		buf := bytes.NewBuffer(make([]byte, 0, prefix.Len()+10))
+		buf.Write(prefix.Bytes())
+		buf.WriteString(strconv.Itoa(int(last - uint32(n-1-i))))
+		ids[i] = buf.Bytes()
+	}
+
+	return ids, nil
+}
+
+// getOrCreateCounterLocked must be called with f.mu held for writing.
+func (f *MessageIdFactory) getOrCreateCounterLocked(domain string) *messageIdCounter {
+	counter, exists := f.m[domain]
+	if !exists {
+		counter = new(messageIdCounter)
+		f.m[domain] = counter
+	}
+	return counter
+}
+
+func (f *MessageIdFactory) writeDomainIdPrefix(buf *bytes.Buffer, domain string) {
+	buf.WriteString(domain)
+	buf.WriteByte('-')
+	buf.Write(f.ipAddress)
+	buf.WriteByte('-')
+	buf.Write(f.hour)
+	buf.WriteByte('-')
+}
+
+// nextIndexLocked advances counter by n and returns the last index, it must be called with f.mu held,
+// either for reading or for writing. The indexes skipped by an error are never handed out.
+func (f *MessageIdFactory) nextIndexLocked(counter *messageIdCounter, n uint32) (uint32, error) {
+	index := atomic.AddUint32(&counter.index, n)
+	if f.state.enabled() && index > atomic.LoadUint32(&counter.limit) {
+		if err := f.reserveLocked(counter, index); err != nil {
+			return 0, err
+		}
+	}
+	return index, nil
+}
+
+// reserveLocked extends the reservation of counter so that it covers index. The new limit is published
+// once it has been persisted, if it could not be the old one is kept and the next index tries again.
+func (f *MessageIdFactory) reserveLocked(counter *messageIdCounter, index uint32) error {
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+
+	if index <= atomic.LoadUint32(&counter.limit) {
+		return nil
+	}
+
+	limit := index - 1 + f.state.blockSize
+	if err := f.state.save(f.hour, f.snapshotLimitsLocked(map[*messageIdCounter]uint32{counter: limit})); err != nil {
+		log.Errorf("message id factory save state error: %s", err.Error())
+		return fmt.Errorf("%w: save message id state error: %s", ErrMessageIdUnavailable, err.Error())
+	}
+	atomic.StoreUint32(&counter.limit, limit)
+
+	return nil
+}
+
+// snapshotLimitsLocked returns the limits of the counters by domain, the limits of reserved replace
+// the ones of their counters.
+func (f *MessageIdFactory) snapshotLimitsLocked(reserved map[*messageIdCounter]uint32) map[string]uint32 {
+	limit := func(counter *messageIdCounter) uint32 {
+		if limit, exists := reserved[counter]; exists {
+			return limit
+		}
+		return atomic.LoadUint32(&counter.limit)
+	}
+
+	limits := make(map[string]uint32, len(f.m)+1)
+	for domain, counter := range f.m {
+		limits[domain] = limit(counter)
+	}
+	limits[f.domain] = limit(f.local)
+	return limits
+}
+
+// restoreLocked resumes every counter above the last reservation persisted for the current hour. A state
+// file that can't be loaded is left as it is and returned as an error, the counters can't be resumed safely.
+func (f *MessageIdFactory) restoreLocked() error {
+	if !f.state.enabled() {
+		return nil
+	}
+
+	hour, limits, err := f.state.load()
+	if err != nil {
+		return fmt.Errorf("load message id state file %s error: %s, the message ids issued before could be reissued", f.state.filename, err.Error())
+	}
+
+	if bytes.Equal(hour, f.hour) {
+		for domain, limit := range limits {
+			if domain == f.domain {
+				f.local.index, f.local.limit = limit, limit
+			} else {
+				f.m[domain] = &messageIdCounter{index: limit, limit: limit}
+			}
+		}
+		log.Infof("message id factory restored %d counters from %s", len(limits), f.state.filename)
+	}
+
+	f.reserveAllLocked()
+
+	return nil
 }
 
-func (f *MessageIdFactory) run() {
+// reserveAllLocked reserves a fresh block above the current index of every counter. If the blocks could
+// not be persisted nothing is reserved, the next index of every counter tries again.
+func (f *MessageIdFactory) reserveAllLocked() {
+	if !f.state.enabled() {
+		return
+	}
 
+	f.stateMu.Lock()
+	defer f.stateMu.Unlock()
+
+	reserved := make(map[*messageIdCounter]uint32, len(f.m)+1)
+	reserved[f.local] = atomic.LoadUint32(&f.local.index) + f.state.blockSize
+	for _, counter := range f.m {
+		reserved[counter] = atomic.LoadUint32(&counter.index) + f.state.blockSize
+	}
+
+	if err := f.state.save(f.hour, f.snapshotLimitsLocked(reserved)); err != nil {
+		log.Errorf("message id factory save state error: %s", err.Error())
+		for counter := range reserved {
+			atomic.StoreUint32(&counter.limit, atomic.LoadUint32(&counter.index))
+		}
+		return
+	}
+
+	for counter, limit := range reserved {
+		atomic.StoreUint32(&counter.limit, limit)
+	}
+}
+
+// run restores the counters from the state file and renews the hour of the message ids every hour.
+func (f *MessageIdFactory) run() error {
 	ipAddressBuf := new(bytes.Buffer)
 	ipAddressBuf.WriteString(f.domain)
 	ipAddressBuf.WriteByte('-')
@@ -101,7 +295,11 @@ func (f *MessageIdFactory) run() {
 	ipAddressBuf.Write(f.hour)
 	ipAddressBuf.WriteByte('-')
 	f.idPrefix = ipAddressBuf.Bytes()
+	err := f.restoreLocked()
 	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
 
 	next := now.Add(time.Hour)
 	next = time.Date(next.Year(), next.Month(), next.Day(), next.Hour(), 0, 0, 0, next.Location())
@@ -124,9 +322,10 @@ func (f *MessageIdFactory) run() {
 			ipAddressBuf.Write(f.hour)
 			ipAddressBuf.WriteByte('-')
 			f.idPrefix = ipAddressBuf.Bytes()
-			for _, index := range f.m {
-				atomic.StoreUint32(index, 0)
+			for _, counter := range f.m {
+				atomic.StoreUint32(&counter.index, 0)
 			}
+			f.reserveAllLocked()
 			f.mu.Unlock()
 
 			next = now.Add(time.Hour)
@@ -134,4 +333,6 @@ func (f *MessageIdFactory) run() {
 			timer.Reset(next.Sub(now))
 		}
 	}()
+
+	return nil
 }
@@ -0,0 +1,114 @@
+package cat
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// messageIdState checkpoints the reserved upper bound of every message id counter
+// to a small text file, the first line is the hour, followed by one "domain\tlimit" line per counter.
+type messageIdState struct {
+	filename  string
+	blockSize uint32
+}
+
+func newMessageIdState(filename string, blockSize int) *messageIdState {
+	return &messageIdState{
+		filename:  filename,
+		blockSize: uint32(blockSize),
+	}
+}
+
+func (s *messageIdState) enabled() bool {
+	return s != nil && s.filename != ""
+}
+
+func (s *messageIdState) load() (hour []byte, limits map[string]uint32, err error) {
+	data, err := ioutil.ReadFile(s.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() {
+		return
+	}
+	hour = []byte(strings.TrimSpace(scanner.Text()))
+
+	limits = make(map[string]uint32)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		i := strings.LastIndexByte(line, '\t')
+		if i < 0 {
+			err = fmt.Errorf("malformed line: %s", line)
+			return
+		}
+
+		var limit uint64
+		limit, err = strconv.ParseUint(line[i+1:], 10, 32)
+		if err != nil {
+			return
+		}
+		limits[line[:i]] = uint32(limit)
+	}
+
+	err = scanner.Err()
+
+	return
+}
+
+func (s *messageIdState) save(hour []byte, limits map[string]uint32) (err error) {
+	if len(hour) == 0 {
+		return errors.New("hour cannot be empty")
+	}
+
+	domains := make([]string, 0, len(limits))
+	for domain := range limits {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	buf := new(bytes.Buffer)
+	buf.Write(hour)
+	buf.WriteByte('\n')
+	for _, domain := range domains {
+		buf.WriteString(domain)
+		buf.WriteByte('\t')
+		buf.WriteString(strconv.FormatUint(uint64(limits[domain]), 10))
+		buf.WriteByte('\n')
+	}
+
+	// write to a temp file and rename it, so a crash never leaves a truncated state file behind.
+	tmp, err := ioutil.TempFile(filepath.Dir(s.filename), filepath.Base(s.filename)+".tmp")
+	if err != nil {
+		return
+	}
+
+	if _, err = tmp.Write(buf.Bytes()); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	return os.Rename(tmp.Name(), s.filename)
+}
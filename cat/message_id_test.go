@@ -0,0 +1,221 @@
+package cat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Orlion/cat-agent/log"
+)
+
+func newTestMessageIdFactory(t *testing.T, domain, stateFile string, blockSize int) *MessageIdFactory {
+	// the logger is never replaced under the goroutines of a running cat.
+	if !hasInit {
+		log.Init(&log.Config{
+			StdoutLevel: "error",
+		})
+	}
+
+	f := &MessageIdFactory{
+		domain:    domain,
+		ipAddress: []byte("7f000001"),
+		local:     new(messageIdCounter),
+		m:         make(map[string]*messageIdCounter),
+		state:     newMessageIdState(stateFile, blockSize),
+	}
+	if err := f.run(); err != nil {
+		t.Fatalf("message id factory run error: %s", err)
+	}
+
+	return f
+}
+
+// testNextId fails t if the next id of domain cannot be created, it can be called from any goroutine.
+func testNextId(t *testing.T, f *MessageIdFactory, domain string) string {
+	messageId, err := f.getNextId(domain)
+	if err != nil {
+		t.Errorf("getNextId of %s error: %s", domain, err)
+	}
+	return string(messageId)
+}
+
+func TestMessageIdFactoryRestartNoDuplicate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cat-agent-message-id")
+	if err != nil {
+		t.Fatalf("create temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	stateFile := filepath.Join(dir, "message-id.state")
+	domains := []string{"local-domain", "other-domain-1", "other-domain-2"}
+	issued := make(map[string]int)
+
+	for restart := 0; restart < 5; restart++ {
+		f := newTestMessageIdFactory(t, domains[0], stateFile, 10)
+
+		// issue a number of ids that is not a multiple of the block size, then "crash".
+		for i := 0; i < 37; i++ {
+			for _, domain := range domains {
+				messageId := testNextId(t, f, domain)
+				if oldRestart, exists := issued[messageId]; exists {
+					t.Fatalf("messageId: %s issued before restart %d has been reissued after restart %d", messageId, oldRestart, restart)
+				}
+				issued[messageId] = restart
+			}
+		}
+	}
+
+	if len(issued) != 5*37*len(domains) {
+		t.Fatalf("issued %d message ids, expected %d", len(issued), 5*37*len(domains))
+	}
+}
+
+func TestMessageIdFactoryRestartNoDuplicateParallel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cat-agent-message-id")
+	if err != nil {
+		t.Fatalf("create temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	stateFile := filepath.Join(dir, "message-id.state")
+	issued := make(map[string]bool)
+
+	for restart := 0; restart < 3; restart++ {
+		f := newTestMessageIdFactory(t, "local-domain", stateFile, 100)
+
+		msgIdCh := make(chan string, 20*500)
+		wg := &sync.WaitGroup{}
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(argsI int) {
+				for j := 0; j < 500; j++ {
+					msgIdCh <- testNextId(t, f, fmt.Sprintf("domain-%d", argsI%4))
+				}
+				wg.Done()
+			}(i)
+		}
+		wg.Wait()
+		close(msgIdCh)
+
+		for messageId := range msgIdCh {
+			if issued[messageId] {
+				t.Fatalf("messageId: %s has been reissued after restart %d", messageId, restart)
+			}
+			issued[messageId] = true
+		}
+	}
+}
+
+// TestMessageIdFactorySaveError checks that the ids not covered by a persisted reservation are never handed out.
+func TestMessageIdFactorySaveError(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("create state dir error: %s", err)
+	}
+	stateFile := filepath.Join(dir, "message-id.state")
+
+	f := newTestMessageIdFactory(t, "local-domain", stateFile, 10)
+	issued := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		issued[testNextId(t, f, "local-domain")] = true
+	}
+
+	// the state file cannot be written anymore.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("remove state dir error: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		if messageId, err := f.getNextId("local-domain"); !errors.Is(err, ErrMessageIdUnavailable) {
+			t.Fatalf("getNextId after a save error: %s, %v, expected %s", messageId, err, ErrMessageIdUnavailable)
+		}
+		if _, err := f.getNextIds("local-domain", 2); !errors.Is(err, ErrMessageIdUnavailable) {
+			t.Fatalf("getNextIds after a save error: %v, expected %s", err, ErrMessageIdUnavailable)
+		}
+	}
+	if limit := f.local.limit; limit != 10 {
+		t.Fatalf("limit after a save error: %d, expected the old one 10", limit)
+	}
+
+	// the ids are handed out again once the reservation is persisted, above the ones that failed.
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("create state dir error: %s", err)
+	}
+	messageId := testNextId(t, f, "local-domain")
+	if !strings.HasSuffix(messageId, "-20") {
+		t.Fatalf("messageId after the state dir is back: %s, expected index 20", messageId)
+	}
+	issued[messageId] = true
+
+	f = newTestMessageIdFactory(t, "local-domain", stateFile, 10)
+	for i := 0; i < 30; i++ {
+		messageId = testNextId(t, f, "local-domain")
+		if issued[messageId] {
+			t.Fatalf("messageId: %s has been reissued after restart", messageId)
+		}
+	}
+}
+
+// TestMessageIdFactoryBadStateFile checks that a state file that can't be loaded stops the factory and is kept.
+func TestMessageIdFactoryBadStateFile(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "message-id.state")
+	bad := []byte("447323\nlocal-domain 120\n")
+	if err := ioutil.WriteFile(stateFile, bad, 0644); err != nil {
+		t.Fatalf("write state file error: %s", err)
+	}
+
+	f := &MessageIdFactory{
+		domain:    "local-domain",
+		ipAddress: []byte("7f000001"),
+		local:     new(messageIdCounter),
+		m:         make(map[string]*messageIdCounter),
+		state:     newMessageIdState(stateFile, 10),
+	}
+	if err := f.run(); err == nil {
+		t.Fatal("run should fail on a malformed state file")
+	}
+
+	data, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		t.Fatalf("read state file error: %s", err)
+	}
+	if !bytes.Equal(data, bad) {
+		t.Fatalf("state file: %q, expected it to be kept as %q", data, bad)
+	}
+}
+
+func TestMessageIdFactoryBadDomain(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "message-id.state")
+	f := newTestMessageIdFactory(t, "local-domain", stateFile, 10)
+	testNextId(t, f, "other-domain")
+
+	for _, domain := range []string{"", "bad\ndomain", "bad\tdomain", "bad-domain\r"} {
+		if _, err := f.getNextId(domain); !errors.Is(err, ErrBadDomain) {
+			t.Fatalf("getNextId of %q: %v, expected %s", domain, err, ErrBadDomain)
+		}
+		if _, err := f.getNextIds(domain, 2); !errors.Is(err, ErrBadDomain) {
+			t.Fatalf("getNextIds of %q: %v, expected %s", domain, err, ErrBadDomain)
+		}
+	}
+
+	// the state file can still be loaded.
+	if _, limits, err := newMessageIdState(stateFile, 10).load(); err != nil || len(limits) != 2 {
+		t.Fatalf("load state file: %v, %v, expected the limits of 2 domains", limits, err)
+	}
+}
+
+func TestMessageIdStateLoadMissingFile(t *testing.T) {
+	s := newMessageIdState(filepath.Join(os.TempDir(), "cat-agent-not-exists.state"), 10)
+	hour, limits, err := s.load()
+	if err != nil {
+		t.Fatalf("load missing state file error: %s", err)
+	}
+	if hour != nil || limits != nil {
+		t.Fatalf("load missing state file got hour: %s, limits: %v", hour, limits)
+	}
+}
@@ -0,0 +1,206 @@
+package cat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Orlion/cat-agent/cat/config"
+	"github.com/Orlion/cat-agent/cat/message"
+	"github.com/Orlion/cat-agent/log"
+	"github.com/Orlion/cat-agent/metrics"
+	"github.com/Orlion/cat-agent/pkg/timex"
+)
+
+// metricData is a metric aggregated by name, counters are sent as "C" with the count, sums and durations
+// as "S,C" with "count,sum" like the java client does.
+type metricData struct {
+	kind, name string
+	count      int
+	sum        float64
+}
+
+func (md *metricData) add(metric *metricWithDomain) {
+	md.count += metric.count
+	md.sum += metric.sum
+}
+
+func (md *metricData) encode() string {
+	if md.kind == message.MetricCount {
+		return strconv.Itoa(md.count)
+	}
+	return fmt.Sprintf("%d,%.2f", md.count, md.sum)
+}
+
+type metricWithDomain struct {
+	domain, kind, name string
+	count              int
+	sum                float64
+}
+
+// parseMetric reads the count and the sum of metric according to its status.
+func parseMetric(domain string, metric *message.Metric) (*metricWithDomain, error) {
+	m := &metricWithDomain{
+		domain: domain,
+		kind:   message.MetricSumCount,
+		name:   metric.GetName(),
+		count:  1,
+	}
+
+	if m.name == "" {
+		return nil, errors.New("metric name cannot be empty")
+	}
+
+	var err error
+	data := metric.GetData()
+	switch metric.GetStatus() {
+	case message.MetricCount:
+		m.kind = message.MetricCount
+		if data != "" {
+			m.count, err = strconv.Atoi(data)
+		}
+	case message.MetricSum, message.MetricDuration:
+		m.sum, err = strconv.ParseFloat(data, 64)
+	case message.MetricSumCount:
+		i := strings.IndexByte(data, ',')
+		if i < 0 {
+			return nil, fmt.Errorf("metric data should be count,sum, %s given", data)
+		}
+		if m.count, err = strconv.Atoi(data[:i]); err == nil {
+			m.sum, err = strconv.ParseFloat(data[i+1:], 64)
+		}
+	default:
+		return nil, fmt.Errorf("unknown metric status: %s", metric.GetStatus())
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+type MetricAggregator struct {
+	datas map[string]map[string]*metricData
+	ch    chan *metricWithDomain
+	size  int64
+}
+
+func newMetricAggregator() *MetricAggregator {
+	return &MetricAggregator{
+		datas: make(map[string]map[string]*metricData),
+		ch:    make(chan *metricWithDomain, config.MetricAggregatorChannelSize),
+	}
+}
+
+func (ma *MetricAggregator) run(ctx context.Context) {
+	log.Info("metric aggregator running...")
+	ticker := time.NewTicker(config.MetricAggregatorTickerDuration)
+
+Loop:
+	for {
+		select {
+		case metricWithDomain := <-ma.ch:
+			ma.getOrDefault(metricWithDomain).add(metricWithDomain)
+		case <-ticker.C:
+			ma.flush()
+		case <-ctx.Done():
+			break Loop
+		}
+	}
+
+	ticker.Stop()
+
+	close(ma.ch)
+
+	for metricWithDomain := range ma.ch {
+		ma.getOrDefault(metricWithDomain).add(metricWithDomain)
+	}
+
+	ma.flush()
+
+	log.Info("metric aggregator exit")
+}
+
+func (ma *MetricAggregator) logMetric(domain string, metric *message.Metric) {
+	metricWithDomain, err := parseMetric(domain, metric)
+	if err != nil {
+		log.Warnf("metric aggregator parse metric %s error: %s, metric has been discarded", metric.GetName(), err.Error())
+		return
+	}
+
+	select {
+	case ma.ch <- metricWithDomain:
+	default:
+		metrics.AggregatorDropped.WithLabelValues("metric").Inc()
+		log.Warnf("metric aggregator's ch is full, metric: %s has been discarded", metric.GetName())
+	}
+}
+
+func (ma *MetricAggregator) getOrDefault(metricWithDomain *metricWithDomain) (data *metricData) {
+	key := fmt.Sprintf("%s,%s", metricWithDomain.kind, metricWithDomain.name)
+
+	domainDatas, exists := ma.datas[metricWithDomain.domain]
+	if !exists {
+		domainDatas = make(map[string]*metricData)
+		ma.datas[metricWithDomain.domain] = domainDatas
+	}
+
+	if data, exists = domainDatas[key]; !exists {
+		data = &metricData{
+			kind: metricWithDomain.kind,
+			name: metricWithDomain.name,
+		}
+
+		domainDatas[key] = data
+		atomic.AddInt64(&ma.size, 1)
+	}
+
+	return data
+}
+
+func (ma *MetricAggregator) flush() {
+	if len(ma.datas) == 0 {
+		return
+	}
+
+	for domain, domainDatas := range ma.datas {
+		trans := message.NewTransaction(config.TypeSystem, config.NameMetricAggregator, message.SUCCESS, "", timex.NowUnixMillis(), nil, 0)
+
+		for _, data := range domainDatas {
+			trans.AddChild(message.NewMetric("", data.name, data.kind, data.encode(), timex.NowUnixMillis()))
+		}
+
+		messageId, err := CreateMessageId(domain)
+		if err != nil {
+			log.Errorf("metric aggregator create message id of domain %s error: %s, the aggregated tree has been dropped", domain, err.Error())
+			continue
+		}
+
+		tree := message.NewMessageTree()
+		tree.SetMessage(trans)
+		tree.SetDomain([]byte(domain))
+		tree.SetMessageId(messageId)
+		tree.SetThreadGroupName(config.ThreadGroupNameCatAgent)
+		tree.SetThreadId([]byte(strconv.Itoa(os.Getpid())))
+		tree.SetThreadName(config.ThreadNameCatAgent)
+		tree.SetDiscard(false)
+
+		sendAggregated(tree)
+
+		log.Debugf("metric aggregator flush, messageId: %s, ", messageId)
+	}
+
+	ma.datas = make(map[string]map[string]*metricData)
+	atomic.StoreInt64(&ma.size, 0)
+}
+
+// getSize returns the number of metrics waiting for the next flush, it is safe to call from any goroutine.
+func (ma *MetricAggregator) getSize() int64 {
+	return atomic.LoadInt64(&ma.size)
+}
@@ -0,0 +1,89 @@
+package cat
+
+import (
+	"testing"
+
+	"github.com/Orlion/cat-agent/cat/message"
+)
+
+func TestMetricAggregatorAggregate(t *testing.T) {
+	ma := newMetricAggregator()
+
+	for _, metric := range []*message.Metric{
+		message.NewMetric("", "order.count", message.MetricCount, "", 0),
+		message.NewMetric("", "order.count", message.MetricCount, "3", 0),
+		message.NewMetric("", "order.amount", message.MetricSum, "10.5", 0),
+		message.NewMetric("", "order.amount", message.MetricSumCount, "2,4.25", 0),
+		message.NewMetric("", "order.latency", message.MetricDuration, "120", 0),
+		message.NewMetric("", "order.latency", message.MetricDuration, "80", 0),
+	} {
+		m, err := parseMetric("domain", metric)
+		if err != nil {
+			t.Fatalf("parseMetric %s %s error: %s", metric.GetStatus(), metric.GetData(), err)
+		}
+		ma.getOrDefault(m).add(m)
+	}
+
+	expected := map[string]string{
+		"C,order.count":     "4",
+		"S,C,order.amount":  "3,14.75",
+		"S,C,order.latency": "2,200.00",
+	}
+	if ma.getSize() != int64(len(expected)) {
+		t.Fatalf("size: %d, expected: %d", ma.getSize(), len(expected))
+	}
+	for key, data := range expected {
+		if actual := ma.datas["domain"][key].encode(); actual != data {
+			t.Fatalf("metric %s: %s, expected: %s", key, actual, data)
+		}
+	}
+}
+
+func TestParseMetricMalformed(t *testing.T) {
+	for _, metric := range []*message.Metric{
+		message.NewMetric("", "", message.MetricCount, "1", 0),
+		message.NewMetric("", "order.count", message.MetricCount, "one", 0),
+		message.NewMetric("", "order.amount", message.MetricSumCount, "2", 0),
+		message.NewMetric("", "order.amount", "X", "1", 0),
+	} {
+		if _, err := parseMetric("domain", metric); err == nil {
+			t.Fatalf("parseMetric %s %s %s should fail", metric.GetName(), metric.GetStatus(), metric.GetData())
+		}
+	}
+}
+
+func TestLocalAggregatorAggregateMetrics(t *testing.T) {
+	la := newLocalAggregator()
+
+	child := message.NewTransaction("SQL", "select", message.SUCCESS, "", 0, []message.Message{
+		message.NewMetric("", "sql.count", message.MetricCount, "1", 0),
+	}, 0)
+	event := message.NewEvent("Cache", "miss", message.SUCCESS, "", 0)
+	root := message.NewTransaction("URL", "/order", message.SUCCESS, "", 0, []message.Message{
+		message.NewMetric("", "order.count", message.MetricCount, "1", 0),
+		child,
+		event,
+	}, 0)
+
+	tree := message.NewMessageTree()
+	tree.SetDomain([]byte("domain"))
+	tree.SetMessage(root)
+	if !la.aggregateMetrics(tree) {
+		t.Fatal("a transaction tree should still be sent")
+	}
+
+	if children := root.GetChildren(); len(children) != 2 || children[0] != child || children[1] != event {
+		t.Fatalf("root children: %v, expected the metric to be removed", children)
+	}
+	if len(child.GetChildren()) != 0 {
+		t.Fatalf("child children: %v, expected the metric to be removed", child.GetChildren())
+	}
+	if len(la.ma.ch) != 2 {
+		t.Fatalf("%d metrics handed to the metric aggregator, expected 2", len(la.ma.ch))
+	}
+
+	tree.SetMessage(message.NewMetric("", "order.count", message.MetricCount, "1", 0))
+	if la.aggregateMetrics(tree) {
+		t.Fatal("a metric tree should not be sent")
+	}
+}
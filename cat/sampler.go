@@ -0,0 +1,261 @@
+package cat
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync/atomic"
+
+	"github.com/Orlion/cat-agent/cat/config"
+	"github.com/Orlion/cat-agent/cat/message"
+)
+
+// SampleRuleStats tells how a sample rule has sampled the trees since it has been loaded.
+type SampleRuleStats struct {
+	// Rule is the domain, type and name of the rule, default for the trees matched by no rule.
+	Rule string `json:"rule"`
+	// Rate is the rate the rule samples at, combined with the sample of the router server.
+	Rate    float64 `json:"rate"`
+	Seen    uint64  `json:"seen"`
+	Sampled uint64  `json:"sampled"`
+	// EffectiveRate is Sampled / Seen.
+	EffectiveRate float64 `json:"effective_rate"`
+}
+
+// SamplerStats only counts the trees that can be discarded, the others are always sent. The trees kept
+// because they are slow or have an event to keep are not sampled, they are not part of the rules stats.
+type SamplerStats struct {
+	Mode          string            `json:"mode"`
+	RuleMode      string            `json:"rule_mode"`
+	Rules         []SampleRuleStats `json:"rules"`
+	Seen          uint64            `json:"seen"`
+	Sampled       uint64            `json:"sampled"`
+	EffectiveRate float64           `json:"effective_rate"`
+	KeptSlow      uint64            `json:"kept_slow"`
+	KeptEvent     uint64            `json:"kept_event"`
+}
+
+// sampler decides which of the trees that can be discarded are sent, at the rate of the first sample
+// rule that matches them, or at the sample of the router server if none does. In SampleModeTrace, a
+// tree is sent if the traceHash of its trace is below the rate, so at a given rate the agents of every
+// service keep the same traces, and a trace kept at a rate is kept at any higher rate. Whatever their
+// rate, the slow trees and the ones with an event to keep are always sent.
+type sampler struct {
+	state atomic.Value
+}
+
+type samplerState struct {
+	keptSlow  uint64
+	keptEvent uint64
+
+	// slowMicros are the thresholds of the root transactions by type.
+	slowMicros map[string]int64
+	keepEvents map[string]struct{}
+
+	mode     string
+	rules    []*config.SampleRule
+	ruleMode string
+	// counters has a counter per rule, and a last one for the trees matched by no rule.
+	counters []samplerCounter
+}
+
+type samplerCounter struct {
+	seen    uint64
+	sampled uint64
+}
+
+func newSampler() *sampler {
+	s := new(sampler)
+	s.reload()
+	return s
+}
+
+// reload takes the rules of the config, the counters start again from zero.
+func (s *sampler) reload() {
+	c := config.GetInstance()
+	rules, ruleMode := c.GetSampleRules()
+	slowMillis, keepEventTypes := c.GetSampleKeep()
+
+	state := &samplerState{
+		slowMicros: make(map[string]int64, len(slowMillis)),
+		keepEvents: make(map[string]struct{}, len(keepEventTypes)),
+		mode:       c.GetSampleMode(),
+		rules:      rules,
+		ruleMode:   ruleMode,
+		counters:   make([]samplerCounter, len(rules)+1),
+	}
+	for t, millis := range slowMillis {
+		state.slowMicros[t] = int64(millis) * 1000
+	}
+	for _, t := range keepEventTypes {
+		state.keepEvents[t] = struct{}{}
+	}
+
+	s.state.Store(state)
+}
+
+func (s *sampler) hit(tree *message.MessageTree) bool {
+	state := s.state.Load().(*samplerState)
+	if state.isSlow(tree) {
+		atomic.AddUint64(&state.keptSlow, 1)
+		return true
+	}
+	if state.hasKeepEvent(tree.GetMessage()) {
+		atomic.AddUint64(&state.keptEvent, 1)
+		return true
+	}
+
+	i, rate := state.rate(tree, config.GetInstance().GetSample())
+
+	hit := rate >= 1
+	if !hit && rate > 0 {
+		if state.mode == config.SampleModeTrace {
+			hit = traceHash(tree) < rate
+		} else {
+			hit = rand.Float64() < rate
+		}
+	}
+
+	atomic.AddUint64(&state.counters[i].seen, 1)
+	if hit {
+		atomic.AddUint64(&state.counters[i].sampled, 1)
+	}
+
+	return hit
+}
+
+// isSlow reports whether the root transaction of tree is slower than the threshold of its type.
+func (state *samplerState) isSlow(tree *message.MessageTree) bool {
+	if len(state.slowMicros) == 0 {
+		return false
+	}
+
+	trans, ok := tree.GetMessage().(*message.Transaction)
+	if !ok {
+		return false
+	}
+
+	threshold, exists := state.slowMicros[trans.GetType()]
+	if !exists {
+		if threshold, exists = state.slowMicros[config.SampleKeepAnyType]; !exists {
+			return false
+		}
+	}
+
+	return trans.GetDurationInMicros() > threshold
+}
+
+// hasKeepEvent reports whether m or one of its descendants is an event of a type to keep.
+func (state *samplerState) hasKeepEvent(m message.Message) bool {
+	if len(state.keepEvents) == 0 {
+		return false
+	}
+
+	switch m := m.(type) {
+	case *message.Event:
+		_, exists := state.keepEvents[m.GetType()]
+		return exists
+	case *message.Transaction:
+		for _, child := range m.GetChildren() {
+			if state.hasKeepEvent(child) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// rate returns the index of the counter of tree and its sample rate, sample is the one of the router server.
+func (state *samplerState) rate(tree *message.MessageTree, sample float64) (int, float64) {
+	if len(state.rules) == 0 {
+		return 0, sample
+	}
+
+	domain := string(tree.GetDomain())
+	if domain == "" {
+		domain = config.GetInstance().GetDomain()
+	}
+
+	var t, name string
+	if m := tree.GetMessage(); m != nil {
+		t, name = m.GetType(), m.GetName()
+	}
+
+	for i, rule := range state.rules {
+		if rule.Match(domain, t, name) {
+			return i, state.ruleRate(rule, sample)
+		}
+	}
+
+	return len(state.rules), sample
+}
+
+func (state *samplerState) ruleRate(rule *config.SampleRule, sample float64) float64 {
+	if state.ruleMode == config.SampleRuleModeMultiply {
+		return *rule.Rate * sample
+	}
+	return *rule.Rate
+}
+
+func (s *sampler) stats() SamplerStats {
+	state := s.state.Load().(*samplerState)
+	sample := config.GetInstance().GetSample()
+
+	stats := SamplerStats{
+		Mode:     state.mode,
+		RuleMode: state.ruleMode,
+		Rules:    make([]SampleRuleStats, len(state.counters)),
+	}
+	for i := range state.counters {
+		ruleStats := SampleRuleStats{
+			Rule:    "default",
+			Rate:    sample,
+			Seen:    atomic.LoadUint64(&state.counters[i].seen),
+			Sampled: atomic.LoadUint64(&state.counters[i].sampled),
+		}
+		if i < len(state.rules) {
+			ruleStats.Rule = state.rules[i].String()
+			ruleStats.Rate = state.ruleRate(state.rules[i], sample)
+		}
+		ruleStats.EffectiveRate = effectiveRate(ruleStats.Sampled, ruleStats.Seen)
+
+		stats.Rules[i] = ruleStats
+		stats.Seen += ruleStats.Seen
+		stats.Sampled += ruleStats.Sampled
+	}
+	stats.EffectiveRate = effectiveRate(stats.Sampled, stats.Seen)
+	stats.KeptSlow = atomic.LoadUint64(&state.keptSlow)
+	stats.KeptEvent = atomic.LoadUint64(&state.keptEvent)
+
+	return stats
+}
+
+// traceHash maps the root message id of tree, or its message id if it is the root, to [0, 1). The id is
+// hashed with the 64 bits FNV-1a, mixed with the fmix64 finalizer of MurmurHash3 so that ids which only
+// differ by their last digits spread evenly, and its 53 high bits are the fraction. Other implementations
+// that sample with the same function keep the same traces.
+func traceHash(tree *message.MessageTree) float64 {
+	id := tree.GetRootMessageId()
+	if len(id) == 0 {
+		id = tree.GetMessageId()
+	}
+
+	h := fnv.New64a()
+	h.Write(id)
+	x := h.Sum64()
+
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	return float64(x>>11) / (1 << 53)
+}
+
+func effectiveRate(sampled, seen uint64) float64 {
+	if seen == 0 {
+		return 0
+	}
+	return float64(sampled) / float64(seen)
+}
@@ -0,0 +1,253 @@
+package cat
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/Orlion/cat-agent/cat/config"
+	"github.com/Orlion/cat-agent/cat/message"
+	"github.com/Orlion/cat-agent/fakecat"
+)
+
+func testSampledTree(domain, t, name string) *message.MessageTree {
+	tree := message.NewMessageTree()
+	tree.SetDomain([]byte(domain))
+	tree.SetMessage(message.NewTransaction(t, name, message.SUCCESS, "", 1600000000000, nil, 1000))
+	return tree
+}
+
+func sampleRate(rate float64) *float64 {
+	return &rate
+}
+
+// testInitSampler starts cat with conf and a router server that gives sample.
+func testInitSampler(t *testing.T, sample string, conf *config.Config) *sampler {
+	s := fakecat.NewServer(&fakecat.Config{Sample: sample})
+	if err := s.ListenAndServe(); err != nil {
+		t.Fatalf("fakecat listen error: %s", err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+	})
+
+	conf.Domain = "TestSampler"
+	conf.Servers = []string{s.HttpAddr()}
+	if err := testInitConfig(conf); err != nil {
+		t.Fatalf("testInitConfig error: %s", err)
+	}
+
+	return catInstance.manager.sampler
+}
+
+func TestSamplerRules(t *testing.T) {
+	s := testInitSampler(t, "0.5", &config.Config{
+		SampleRules: []*config.SampleRule{
+			{Type: "URL", Name: "/health*", Rate: sampleRate(0.001)},
+			{Domain: "order", Type: "URL", Rate: sampleRate(0.3)},
+			{Type: "SQL", Rate: sampleRate(1)},
+		},
+	})
+
+	const n = 20000
+	for _, c := range []struct {
+		tree *message.MessageTree
+		rate float64
+	}{
+		{testSampledTree("order", "URL", "/health/live"), 0.001},
+		{testSampledTree("order", "URL", "/order"), 0.3},
+		{testSampledTree("user", "URL", "/user"), 0.5},
+		{testSampledTree("user", "SQL", "select"), 1},
+		{testSampledTree("user", "Job", "sync"), 0.5},
+	} {
+		sampled := 0
+		for i := 0; i < n; i++ {
+			if s.hit(c.tree) {
+				sampled++
+			}
+		}
+
+		// 5 standard deviations of a binomial, the test fails once in millions of runs.
+		rate := float64(sampled) / n
+		if tolerance := 5 * math.Sqrt(c.rate*(1-c.rate)/n); math.Abs(rate-c.rate) > tolerance {
+			root := c.tree.GetMessage()
+			t.Fatalf("%s %s %s sampled at %f, expected %f", c.tree.GetDomain(), root.GetType(), root.GetName(), rate, c.rate)
+		}
+	}
+
+	stats := s.stats()
+	expected := []SampleRuleStats{
+		{Rule: "* URL /health*", Rate: 0.001, Seen: n},
+		{Rule: "order URL *", Rate: 0.3, Seen: n},
+		{Rule: "* SQL *", Rate: 1, Seen: n, Sampled: n, EffectiveRate: 1},
+		{Rule: "default", Rate: 0.5, Seen: 2 * n},
+	}
+	if len(stats.Rules) != len(expected) {
+		t.Fatalf("%d rules stats, expected %d", len(stats.Rules), len(expected))
+	}
+	for i, ruleStats := range stats.Rules {
+		if ruleStats.Rule != expected[i].Rule || ruleStats.Rate != expected[i].Rate || ruleStats.Seen != expected[i].Seen {
+			t.Fatalf("rule stats: %+v, expected: %+v", ruleStats, expected[i])
+		}
+		if ruleStats.EffectiveRate != float64(ruleStats.Sampled)/float64(ruleStats.Seen) {
+			t.Fatalf("rule stats: %+v, effective rate is not sampled / seen", ruleStats)
+		}
+	}
+	if stats.Seen != 5*n || stats.EffectiveRate != float64(stats.Sampled)/float64(stats.Seen) {
+		t.Fatalf("stats: seen %d, sampled %d, effective rate %f", stats.Seen, stats.Sampled, stats.EffectiveRate)
+	}
+}
+
+func TestSamplerRuleModeMultiply(t *testing.T) {
+	s := testInitSampler(t, "0.5", &config.Config{
+		SampleRules:    []*config.SampleRule{{Type: "URL", Rate: sampleRate(0.2)}},
+		SampleRuleMode: config.SampleRuleModeMultiply,
+	})
+
+	stats := s.stats()
+	if stats.RuleMode != config.SampleRuleModeMultiply {
+		t.Fatalf("rule mode: %s, expected %s", stats.RuleMode, config.SampleRuleModeMultiply)
+	}
+	if rate := stats.Rules[0].Rate; math.Abs(rate-0.1) > 1e-9 {
+		t.Fatalf("rule rate: %f, expected 0.1", rate)
+	}
+	if rate := stats.Rules[1].Rate; rate != 0.5 {
+		t.Fatalf("default rate: %f, expected 0.5", rate)
+	}
+}
+
+func TestSamplerReload(t *testing.T) {
+	s := testInitSampler(t, "1.0", &config.Config{})
+
+	tree := testSampledTree("TestSampler", "URL", "/health")
+	if !s.hit(tree) {
+		t.Fatalf("the tree should be sampled at the sample of the router server")
+	}
+
+	err := Reload(&config.Config{
+		Domain:      "TestSampler",
+		Servers:     config.GetInstance().GetServers(),
+		SampleRules: []*config.SampleRule{{Name: "/health", Rate: sampleRate(0)}},
+	})
+	if err != nil {
+		t.Fatalf("reload error: %s", err)
+	}
+
+	if s.hit(tree) {
+		t.Fatalf("the tree should be sampled out by the reloaded rule")
+	}
+	if stats := s.stats(); stats.Seen != 1 || stats.Rules[0].Rule != "* * /health" {
+		t.Fatalf("stats after reload: %+v", stats)
+	}
+}
+
+func testTraceTree(messageId, rootMessageId string) *message.MessageTree {
+	tree := testSampledTree("TestSampler", "URL", "/order")
+	tree.SetMessageId([]byte(messageId))
+	tree.SetRootMessageId([]byte(rootMessageId))
+	return tree
+}
+
+// TestTraceHash pins the hash, the agents of a fleet keep the same traces only if they all hash them alike.
+func TestTraceHash(t *testing.T) {
+	for _, c := range []struct {
+		messageId, rootMessageId string
+		expected                 float64
+	}{
+		{"order-c0a80001-447323-0", "", 0.4154386662212316},
+		{"order-c0a80001-447323-1", "", 0.29042537032911964},
+		{"user-c0a80002-447323-7", "user-c0a80002-447323-42", 0.26377566707727895},
+	} {
+		if h := traceHash(testTraceTree(c.messageId, c.rootMessageId)); h != c.expected {
+			t.Fatalf("traceHash of %s %s: %.17g, expected %.17g", c.messageId, c.rootMessageId, h, c.expected)
+		}
+	}
+
+	const n = 100000
+	sampled := 0
+	for i := 0; i < n; i++ {
+		if traceHash(testTraceTree(fmt.Sprintf("order-c0a80001-447323-%d", i), "")) < 0.1 {
+			sampled++
+		}
+	}
+	if rate := float64(sampled) / n; math.Abs(rate-0.1) > 5*math.Sqrt(0.1*0.9/n) {
+		t.Fatalf("sequential message ids sampled at %f, expected 0.1", rate)
+	}
+}
+
+func TestSamplerModeTrace(t *testing.T) {
+	s := testInitSampler(t, "0.3", &config.Config{
+		SampleMode:  config.SampleModeTrace,
+		SampleRules: []*config.SampleRule{{Type: "URL", Name: "/health", Rate: sampleRate(0.1)}},
+	})
+	if mode := s.stats().Mode; mode != config.SampleModeTrace {
+		t.Fatalf("mode: %s, expected %s", mode, config.SampleModeTrace)
+	}
+
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		root := fmt.Sprintf("order-c0a80001-447323-%d", i)
+		hit := s.hit(testTraceTree(root, ""))
+		// the downstream trees of the trace make the decision of its root.
+		for j := 0; j < 3; j++ {
+			if s.hit(testTraceTree(fmt.Sprintf("user-c0a80002-447323-%d", i*3+j), root)) != hit {
+				t.Fatalf("trace %s: a downstream tree has not been sampled like its root", root)
+			}
+		}
+
+		// a trace kept by a lower rate is kept by a higher one.
+		health := testTraceTree(fmt.Sprintf("user-c0a80002-447323-%d", i), root)
+		health.SetMessage(message.NewTransaction("URL", "/health", message.SUCCESS, "", 1600000000000, nil, 1000))
+		if s.hit(health) && !hit {
+			t.Fatalf("trace %s: kept at 0.1 and dropped at 0.3", root)
+		}
+
+		if hit {
+			kept++
+		}
+	}
+
+	if kept < 200 || kept > 400 {
+		t.Fatalf("%d traces kept out of 1000, expected about 300", kept)
+	}
+}
+
+func TestSamplerKeep(t *testing.T) {
+	s := testInitSampler(t, "0", &config.Config{
+		SampleKeepSlowMillis: map[string]int{"URL": 1000, config.SampleKeepAnyType: 5000},
+		SampleKeepEventTypes: []string{"Exception", "SQL.slow"},
+	})
+
+	slowSQL := testSampledTree("TestSampler", "URL", "/order")
+	slowSQL.GetMessage().(*message.Transaction).AddChild(message.NewTransaction("Service", "order", message.SUCCESS, "", 1600000000000, []message.Message{
+		message.NewEvent("SQL.slow", "select", message.SUCCESS, "", 1600000000000),
+	}, 100))
+
+	for _, c := range []struct {
+		tree     *message.MessageTree
+		expected SendResult
+	}{
+		{testDurationTree("URL", 1500*1000), SendQueued},
+		{testDurationTree("URL", 1000*1000), SendAggregated},
+		{testDurationTree("Job", 6000*1000), SendQueued},
+		{testDurationTree("Job", 4000*1000), SendAggregated},
+		{slowSQL, SendQueued},
+		{testSampledTree("TestSampler", "SQL", "select"), SendAggregated},
+	} {
+		root := c.tree.GetMessage().(*message.Transaction)
+		if result := catInstance.manager.send(c.tree); result != c.expected {
+			t.Fatalf("%s %s of %dus: %s, expected %s", root.GetType(), root.GetName(), root.GetDurationInMicros(), result, c.expected)
+		}
+	}
+
+	stats := s.stats()
+	if stats.KeptSlow != 2 || stats.KeptEvent != 1 || stats.Seen != 3 || stats.Sampled != 0 {
+		t.Fatalf("stats: %+v, expected 2 slow and 1 event trees kept, 3 sampled out", stats)
+	}
+}
+
+func testDurationTree(t string, durationInMicros int64) *message.MessageTree {
+	tree := testSampledTree("TestSampler", t, "run")
+	tree.GetMessage().(*message.Transaction).SetDurationInMicros(durationInMicros)
+	return tree
+}
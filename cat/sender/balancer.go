@@ -0,0 +1,265 @@
+package sender
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Orlion/cat-agent/cat/config"
+	"github.com/Orlion/cat-agent/cat/message"
+	"github.com/Orlion/cat-agent/log"
+)
+
+// routerHealth tracks the errors of a router, a router that failed is skipped until retryAt,
+// the delay doubles with every consecutive failure.
+type routerHealth struct {
+	failures int
+	retryAt  time.Time
+}
+
+// RouterStats is the health of a router as seen by the balancer.
+type RouterStats struct {
+	Router   string `json:"router"`
+	Healthy  bool   `json:"healthy"`
+	Failures int    `json:"failures"`
+}
+
+// Balancer decides which routers a batch of trees is written to according to the routing strategy.
+type Balancer struct {
+	mu       sync.Mutex
+	strategy string
+	routers  []string
+	health   map[string]*routerHealth
+	ring     []uint32
+	ringMap  map[uint32]string
+	next     int
+	now      func() time.Time
+}
+
+// route is a part of a batch together with the routers to try for it, in order of preference.
+type route struct {
+	routers []string
+	trees   []*message.MessageTree
+}
+
+func NewBalancer(strategy string) *Balancer {
+	return &Balancer{
+		strategy: strategy,
+		health:   make(map[string]*routerHealth),
+		now:      time.Now,
+	}
+}
+
+func (b *Balancer) SetStrategy(strategy string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.strategy != strategy {
+		log.Infof("sender routing strategy has been changed from %s to %s", b.strategy, strategy)
+		b.strategy = strategy
+	}
+}
+
+// Update replaces the routers, the health of the routers that are kept is preserved.
+func (b *Balancer) Update(routers []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	health := make(map[string]*routerHealth, len(routers))
+	for _, router := range routers {
+		if h, exists := b.health[router]; exists {
+			health[router] = h
+		} else {
+			health[router] = new(routerHealth)
+		}
+	}
+
+	b.routers = append([]string(nil), routers...)
+	b.health = health
+	b.buildRingLocked()
+}
+
+func (b *Balancer) buildRingLocked() {
+	b.ring = make([]uint32, 0, len(b.routers)*config.TcpSenderRouterHashReplicas)
+	b.ringMap = make(map[uint32]string, len(b.routers)*config.TcpSenderRouterHashReplicas)
+	for _, router := range b.routers {
+		for i := 0; i < config.TcpSenderRouterHashReplicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(router + "#" + strconv.Itoa(i)))
+			if _, exists := b.ringMap[hash]; exists {
+				continue
+			}
+			b.ring = append(b.ring, hash)
+			b.ringMap[hash] = router
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool {
+		return b.ring[i] < b.ring[j]
+	})
+}
+
+// Has reports whether router is one of the current routers.
+func (b *Balancer) Has(router string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, exists := b.health[router]
+	return exists
+}
+
+// Available reports whether there is a router that may be written to right now.
+func (b *Balancer) Available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	for _, router := range b.routers {
+		if b.isUpLocked(router, now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Balancer) isUpLocked(router string, now time.Time) bool {
+	return !now.Before(b.health[router].retryAt)
+}
+
+// Route splits trees into routes, the routers of a route are the ones that are up,
+// in the order they should be tried. The trees of a batch share a route unless routing is by domain.
+func (b *Balancer) Route(trees []*message.MessageTree) []*route {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+
+	switch b.strategy {
+	case config.RoutingStrategyRoundRobin:
+		if len(b.routers) == 0 {
+			return []*route{{trees: trees}}
+		}
+		start := b.next % len(b.routers)
+		b.next = start + 1
+		routers := make([]string, 0, len(b.routers))
+		for i := range b.routers {
+			router := b.routers[(start+i)%len(b.routers)]
+			if b.isUpLocked(router, now) {
+				routers = append(routers, router)
+			}
+		}
+		return []*route{{routers: routers, trees: trees}}
+	case config.RoutingStrategyConsistentHash:
+		if len(trees) == 0 {
+			return []*route{{routers: b.hashRoutersLocked(nil, now), trees: trees}}
+		}
+		var routes []*route
+		index := make(map[string]*route)
+		for _, tree := range trees {
+			routers := b.hashRoutersLocked(tree.GetDomain(), now)
+			key := strings.Join(routers, ",")
+			r, exists := index[key]
+			if !exists {
+				r = &route{routers: routers}
+				index[key] = r
+				routes = append(routes, r)
+			}
+			r.trees = append(r.trees, tree)
+		}
+		return routes
+	default:
+		routers := make([]string, 0, len(b.routers))
+		for _, router := range b.routers {
+			if b.isUpLocked(router, now) {
+				routers = append(routers, router)
+			}
+		}
+		return []*route{{routers: routers, trees: trees}}
+	}
+}
+
+// hashRoutersLocked walks the ring clockwise from the hash of domain and returns the distinct routers that are up.
+func (b *Balancer) hashRoutersLocked(domain []byte, now time.Time) []string {
+	routers := make([]string, 0, len(b.routers))
+	if len(b.ring) == 0 {
+		return routers
+	}
+
+	seen := make(map[string]bool, len(b.routers))
+	hash := crc32.ChecksumIEEE(domain)
+	start := sort.Search(len(b.ring), func(i int) bool {
+		return b.ring[i] >= hash
+	})
+	for i := 0; i < len(b.ring) && len(seen) < len(b.routers); i++ {
+		router := b.ringMap[b.ring[(start+i)%len(b.ring)]]
+		if seen[router] {
+			continue
+		}
+		seen[router] = true
+		if b.isUpLocked(router, now) {
+			routers = append(routers, router)
+		}
+	}
+
+	return routers
+}
+
+// MarkSuccess marks router as healthy after a successful write.
+func (b *Balancer) MarkSuccess(router string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	h, exists := b.health[router]
+	if !exists || h.failures == 0 {
+		return
+	}
+
+	log.Infof("router %s has recovered after %d failures", router, h.failures)
+	h.failures = 0
+	h.retryAt = time.Time{}
+}
+
+// MarkFailure skips router until its retry time after a connect or write error.
+func (b *Balancer) MarkFailure(router string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	h, exists := b.health[router]
+	if !exists {
+		return
+	}
+
+	now := b.now()
+	// the consumers that were writing to the router when it went down report it once.
+	if now.Before(h.retryAt) {
+		return
+	}
+
+	delay := config.TcpSenderRouterRetryMinDuration
+	for i := 0; i < h.failures && delay < config.TcpSenderRouterRetryMaxDuration; i++ {
+		delay *= 2
+	}
+	if delay > config.TcpSenderRouterRetryMaxDuration {
+		delay = config.TcpSenderRouterRetryMaxDuration
+	}
+
+	h.failures++
+	h.retryAt = now.Add(delay)
+
+	log.Warnf("router %s is down: %s, it will be retried in %s", router, err.Error(), delay)
+}
+
+// Stats returns the health of every router in the router order.
+func (b *Balancer) Stats() []RouterStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := make([]RouterStats, 0, len(b.routers))
+	for _, router := range b.routers {
+		h := b.health[router]
+		stats = append(stats, RouterStats{
+			Router:   router,
+			Healthy:  h.failures == 0,
+			Failures: h.failures,
+		})
+	}
+	return stats
+}
@@ -0,0 +1,144 @@
+package sender
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Orlion/cat-agent/cat/config"
+	"github.com/Orlion/cat-agent/cat/message"
+)
+
+func newTestBalancer(strategy string, routers ...string) (*Balancer, *time.Time) {
+	now := time.Unix(1600000000, 0)
+	b := NewBalancer(strategy)
+	b.now = func() time.Time {
+		return now
+	}
+	b.Update(routers)
+	return b, &now
+}
+
+func testDomainTree(domain string) *message.MessageTree {
+	tree := message.NewMessageTree()
+	tree.SetDomain([]byte(domain))
+	return tree
+}
+
+func routeRouters(b *Balancer, domain string) []string {
+	return b.Route([]*message.MessageTree{testDomainTree(domain)})[0].routers
+}
+
+func TestBalancerFailover(t *testing.T) {
+	b, now := newTestBalancer(config.RoutingStrategyFailover, "r1", "r2", "r3")
+
+	if routers := routeRouters(b, "domain"); !reflect.DeepEqual(routers, []string{"r1", "r2", "r3"}) {
+		t.Fatalf("routers: %v, expected the router order", routers)
+	}
+
+	b.MarkFailure("r1", errors.New("connection refused"))
+	if routers := routeRouters(b, "domain"); !reflect.DeepEqual(routers, []string{"r2", "r3"}) {
+		t.Fatalf("routers: %v, expected the dead primary to be skipped", routers)
+	}
+
+	// the router is retried after the min retry duration, and skipped twice as long after another failure.
+	*now = now.Add(config.TcpSenderRouterRetryMinDuration)
+	if routers := routeRouters(b, "domain"); !reflect.DeepEqual(routers, []string{"r1", "r2", "r3"}) {
+		t.Fatalf("routers: %v, expected the primary to be retried", routers)
+	}
+	b.MarkFailure("r1", errors.New("connection refused"))
+	*now = now.Add(config.TcpSenderRouterRetryMinDuration)
+	if routers := routeRouters(b, "domain"); !reflect.DeepEqual(routers, []string{"r2", "r3"}) {
+		t.Fatalf("routers: %v, expected the backoff to double", routers)
+	}
+
+	*now = now.Add(config.TcpSenderRouterRetryMinDuration)
+	b.MarkSuccess("r1")
+	if stats := b.Stats(); !stats[0].Healthy || stats[0].Failures != 0 {
+		t.Fatalf("router r1 should have recovered: %+v", stats[0])
+	}
+
+	// the health of the routers that are kept survives an update.
+	b.MarkFailure("r2", errors.New("broken pipe"))
+	b.Update([]string{"r2", "r4"})
+	if routers := routeRouters(b, "domain"); !reflect.DeepEqual(routers, []string{"r4"}) {
+		t.Fatalf("routers: %v, expected [r4]", routers)
+	}
+	if b.Has("r1") || !b.Has("r4") {
+		t.Fatal("router r1 should have been removed, router r4 should have been added")
+	}
+
+	b.MarkFailure("r4", errors.New("broken pipe"))
+	if b.Available() {
+		t.Fatal("no router should be available")
+	}
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b, _ := newTestBalancer(config.RoutingStrategyRoundRobin, "r1", "r2", "r3")
+
+	first := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		first[routeRouters(b, "domain")[0]]++
+	}
+	if !reflect.DeepEqual(first, map[string]int{"r1": 10, "r2": 10, "r3": 10}) {
+		t.Fatalf("batches per router: %v, expected an even spread", first)
+	}
+
+	b.MarkFailure("r2", errors.New("connection refused"))
+	for i := 0; i < 30; i++ {
+		routers := routeRouters(b, "domain")
+		if len(routers) != 2 || routers[0] == "r2" || routers[1] == "r2" {
+			t.Fatalf("routers: %v, expected the dead router to be skipped", routers)
+		}
+	}
+}
+
+func TestBalancerConsistentHash(t *testing.T) {
+	b, _ := newTestBalancer(config.RoutingStrategyConsistentHash, "r1", "r2", "r3", "r4")
+
+	domains := make([]string, 100)
+	primaries := make(map[string]string)
+	for i := range domains {
+		domains[i] = fmt.Sprintf("domain-%d", i)
+		primaries[domains[i]] = routeRouters(b, domains[i])[0]
+	}
+
+	// the trees of a batch are split by domain.
+	trees := make([]*message.MessageTree, 0, len(domains))
+	for _, domain := range domains {
+		trees = append(trees, testDomainTree(domain))
+	}
+	routes := b.Route(trees)
+	if len(routes) < 2 {
+		t.Fatalf("%d domains have been routed to %d routes", len(domains), len(routes))
+	}
+	for _, r := range routes {
+		for _, tree := range r.trees {
+			if primary := primaries[string(tree.GetDomain())]; r.routers[0] != primary {
+				t.Fatalf("domain %s routed to %s, expected %s", tree.GetDomain(), r.routers[0], primary)
+			}
+		}
+	}
+
+	// only the domains of a dead router move, and they come back once it recovers.
+	b.MarkFailure("r1", errors.New("connection refused"))
+	for _, domain := range domains {
+		primary := routeRouters(b, domain)[0]
+		if primaries[domain] != "r1" && primary != primaries[domain] {
+			t.Fatalf("domain %s moved from %s to %s while %s is healthy", domain, primaries[domain], primary, primaries[domain])
+		}
+		if primary == "r1" {
+			t.Fatalf("domain %s routed to the dead router r1", domain)
+		}
+	}
+
+	b.MarkSuccess("r1")
+	for _, domain := range domains {
+		if primary := routeRouters(b, domain)[0]; primary != primaries[domain] {
+			t.Fatalf("domain %s routed to %s after recovery, expected %s", domain, primary, primaries[domain])
+		}
+	}
+}
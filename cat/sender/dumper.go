@@ -0,0 +1,62 @@
+package sender
+
+import (
+	"os"
+	"sync"
+
+	"github.com/Orlion/cat-agent/cat/config"
+	"github.com/Orlion/cat-agent/cat/encoder"
+	"github.com/Orlion/cat-agent/cat/message"
+	"github.com/Orlion/cat-agent/log"
+)
+
+// Dumper writes the trees taken by the consumers in the plain text format, so what the agent sends can
+// be read without a hex decoder.
+type Dumper struct {
+	mu      sync.Mutex
+	encoder *encoder.PlainTextEncoder
+	// f is nil if the trees are dumped to the agent log.
+	f *os.File
+}
+
+// NewDumper dumps the trees to the agent log if target is config.SenderDumpToLog, otherwise it appends them to the file target.
+func NewDumper(target string) (*Dumper, error) {
+	d := &Dumper{
+		encoder: encoder.NewPlainTextEncoder(),
+	}
+
+	if target != config.SenderDumpToLog {
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		d.f = f
+	}
+
+	return d, nil
+}
+
+func (d *Dumper) Dump(tree *message.MessageTree) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.encoder.EncodeMessageTree(tree); err != nil {
+		log.Warnf("dumper encode message tree error: %s", err.Error())
+		return
+	}
+
+	if d.f == nil {
+		log.Infof("dump message tree:\n%s", d.encoder.Bytes())
+		return
+	}
+
+	if _, err := d.f.Write(d.encoder.Bytes()); err != nil {
+		log.Warnf("dumper write %s error: %s", d.f.Name(), err.Error())
+	}
+}
+
+func (d *Dumper) Close() {
+	if d.f != nil {
+		d.f.Close()
+	}
+}
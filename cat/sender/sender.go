@@ -1,11 +1,49 @@
 package sender
 
 import (
+	"sync/atomic"
+
 	"github.com/Orlion/cat-agent/cat/message"
 )
 
+type OfferResult int
+
+const (
+	OfferQueued OfferResult = iota
+	OfferSpooled
+	OfferDropped
+)
+
 type Sender interface {
-	Offer(tree *message.MessageTree)
+	Offer(tree *message.MessageTree) OfferResult
 	Run()
+	Reload()
 	Shutdown()
+	Stats() Stats
+}
+
+// Stats counts the trees that went through a sender, the counters must be accessed atomically.
+type Stats struct {
+	// Dropped is the number of trees that were thrown away.
+	Dropped uint64 `json:"dropped"`
+	// Spooled is the number of trees written to the spool.
+	Spooled uint64 `json:"spooled"`
+	// Replayed is the number of spooled trees sent after the connection recovered.
+	Replayed uint64 `json:"replayed"`
+	// SpoolBytes is the current size of the spool on disk.
+	SpoolBytes int64 `json:"spool_bytes"`
+	// NormalQueueLen and HighQueueLen are the depths of the queues, they are only filled in by Sender.Stats.
+	NormalQueueLen int `json:"normal_queue_len"`
+	HighQueueLen   int `json:"high_queue_len"`
+	// Routers is the health of the routers, it is only filled in by Sender.Stats.
+	Routers []RouterStats `json:"routers"`
+}
+
+func (s *Stats) Snapshot() Stats {
+	return Stats{
+		Dropped:    atomic.LoadUint64(&s.Dropped),
+		Spooled:    atomic.LoadUint64(&s.Spooled),
+		Replayed:   atomic.LoadUint64(&s.Replayed),
+		SpoolBytes: atomic.LoadInt64(&s.SpoolBytes),
+	}
 }
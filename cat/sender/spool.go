@@ -0,0 +1,296 @@
+package sender
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Orlion/cat-agent/log"
+)
+
+const spoolSegmentExt = ".spool"
+
+type spoolSegment struct {
+	filename string
+	size     int64
+	// frames is the number of frames that have not been replayed yet.
+	frames  int
+	updated time.Time
+	// replayed is the offset of the first frame that has not been written completely by a replay.
+	replayed int64
+}
+
+// Spool stores length-prefixed NT1 frames in segment files while no router can take them,
+// the frames are replayed in the order they were spooled.
+type Spool struct {
+	mu              sync.Mutex
+	dir             string
+	segmentMaxBytes int64
+	maxBytes        int64
+	maxAge          time.Duration
+	segments        []*spoolSegment
+	active          *os.File
+	size            int64
+	stats           *Stats
+	// replayMu is held by the caller that replays.
+	replayMu sync.Mutex
+}
+
+func NewSpool(dir string, segmentMaxBytes, maxBytes int64, maxAge time.Duration, stats *Stats) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		dir:             dir,
+		segmentMaxBytes: segmentMaxBytes,
+		maxBytes:        maxBytes,
+		maxAge:          maxAge,
+		stats:           stats,
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// load picks up the segments left behind by a previous run.
+func (s *Spool) load() error {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), spoolSegmentExt) {
+			continue
+		}
+
+		segment := &spoolSegment{
+			filename: filepath.Join(s.dir, info.Name()),
+			updated:  info.ModTime(),
+		}
+
+		data, err := ioutil.ReadFile(segment.filename)
+		if err != nil {
+			return err
+		}
+		segment.frames, segment.size = countFrames(data)
+
+		// a frame cut by a crash is cut off, the frames that follow would be misaligned otherwise.
+		if segment.size < int64(len(data)) {
+			log.Warnf("spool segment %s has a partial frame of %d bytes at its end, it has been cut off", segment.filename, int64(len(data))-segment.size)
+			if err = os.Truncate(segment.filename, segment.size); err != nil {
+				return err
+			}
+		}
+
+		s.segments = append(s.segments, segment)
+		s.size += segment.size
+	}
+
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].filename < s.segments[j].filename
+	})
+
+	s.updateStatsLocked()
+
+	if len(s.segments) > 0 {
+		log.Infof("spool loaded %d segments, %d bytes from %s", len(s.segments), s.size, s.dir)
+	}
+
+	return nil
+}
+
+// Append writes frames to the active segment, frames must hold exactly n length-prefixed NT1 frames.
+func (s *Spool) Append(frames []byte, n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expireLocked()
+
+	size := int64(len(frames))
+	if size > s.maxBytes {
+		return fmt.Errorf("spool frames size %d exceeds the max bytes %d", size, s.maxBytes)
+	}
+
+	// make room by dropping the oldest segments.
+	for s.size+size > s.maxBytes && len(s.segments) > 0 {
+		if s.isActiveLocked(s.segments[0]) {
+			s.sealLocked()
+		}
+		s.removeOldestLocked("spool is full")
+	}
+
+	var segment *spoolSegment
+	if s.active != nil {
+		segment = s.segments[len(s.segments)-1]
+		if segment.size+size > s.segmentMaxBytes {
+			s.sealLocked()
+			segment = nil
+		}
+	}
+
+	if segment == nil {
+		f, err := os.OpenFile(filepath.Join(s.dir, fmt.Sprintf("%020d%s", time.Now().UnixNano(), spoolSegmentExt)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		s.active = f
+		segment = &spoolSegment{filename: f.Name()}
+		s.segments = append(s.segments, segment)
+	}
+
+	written, err := s.active.Write(frames)
+	segment.updated = time.Now()
+	if err != nil {
+		// the partial frames are cut off, the replay skips them if they can't be. The segment is never
+		// appended to again.
+		if written > 0 && s.active.Truncate(segment.size) != nil {
+			segment.size += int64(written)
+			s.size += int64(written)
+		}
+		s.sealLocked()
+		s.updateStatsLocked()
+		return err
+	}
+	segment.size += int64(written)
+	s.size += int64(written)
+
+	segment.frames += n
+	atomic.AddUint64(&s.stats.Spooled, uint64(n))
+	s.updateStatsLocked()
+
+	return nil
+}
+
+// Pending reports whether there are frames waiting to be replayed.
+func (s *Spool) Pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.segments) > 0
+}
+
+// Replay writes the whole frames of the spooled segments to w oldest first, a segment is removed once it has
+// been written completely. After an error the next replay starts from the first frame that has not been written
+// completely, w must drop the frame cut by the error. Only one caller replays at a time, the others wait for it
+// and replay what it has left, so once Replay returns nil every frame spooled before the call has been written,
+// and the caller can send the frames that follow.
+func (s *Spool) Replay(w io.Writer) error {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+
+	for {
+		s.mu.Lock()
+		s.expireLocked()
+		if len(s.segments) == 0 {
+			s.mu.Unlock()
+			return nil
+		}
+		segment := s.segments[0]
+		if s.isActiveLocked(segment) {
+			s.sealLocked()
+		}
+		s.mu.Unlock()
+
+		data, err := ioutil.ReadFile(segment.filename)
+		if err != nil {
+			s.mu.Lock()
+			s.removeOldestLocked(err.Error())
+			s.mu.Unlock()
+			continue
+		}
+
+		// a tail that is not a whole frame is never sent.
+		frames, end := countFrames(data[segment.replayed:])
+		n, err := w.Write(data[segment.replayed : segment.replayed+end])
+		if err != nil {
+			written, writtenEnd := countFrames(data[segment.replayed : segment.replayed+int64(n)])
+			s.mu.Lock()
+			segment.replayed += writtenEnd
+			segment.frames -= written
+			atomic.AddUint64(&s.stats.Replayed, uint64(written))
+			s.mu.Unlock()
+			return err
+		}
+
+		s.mu.Lock()
+		if len(s.segments) > 0 && s.segments[0] == segment {
+			s.segments = s.segments[1:]
+			s.size -= segment.size
+			os.Remove(segment.filename)
+			atomic.AddUint64(&s.stats.Replayed, uint64(frames))
+			s.updateStatsLocked()
+		}
+		s.mu.Unlock()
+
+		log.Infof("spool replayed segment %s, %d frames", segment.filename, frames)
+	}
+}
+
+func (s *Spool) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active != nil {
+		s.active.Close()
+		s.active = nil
+	}
+}
+
+func (s *Spool) isActiveLocked(segment *spoolSegment) bool {
+	return s.active != nil && s.active.Name() == segment.filename
+}
+
+func (s *Spool) sealLocked() {
+	if s.active != nil {
+		s.active.Close()
+		s.active = nil
+	}
+}
+
+func (s *Spool) expireLocked() {
+	deadline := time.Now().Add(-s.maxAge)
+	for len(s.segments) > 0 && s.segments[0].updated.Before(deadline) {
+		if s.isActiveLocked(s.segments[0]) {
+			s.sealLocked()
+		}
+		s.removeOldestLocked("spool segment expired")
+	}
+}
+
+func (s *Spool) removeOldestLocked(reason string) {
+	segment := s.segments[0]
+	s.segments = s.segments[1:]
+	s.size -= segment.size
+	os.Remove(segment.filename)
+	atomic.AddUint64(&s.stats.Dropped, uint64(segment.frames))
+	s.updateStatsLocked()
+	log.Warnf("%s, segment %s with %d frames has been discarded", reason, segment.filename, segment.frames)
+}
+
+func (s *Spool) updateStatsLocked() {
+	atomic.StoreInt64(&s.stats.SpoolBytes, s.size)
+}
+
+// countFrames returns the number of whole frames data starts with, and the offset they end at.
+func countFrames(data []byte) (n int, end int64) {
+	for int64(len(data))-end >= 4 {
+		length := int64(binary.BigEndian.Uint32(data[end:]))
+		if int64(len(data))-end < 4+length {
+			break
+		}
+		end += 4 + length
+		n++
+	}
+	return
+}
@@ -0,0 +1,297 @@
+package sender
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Orlion/cat-agent/log"
+)
+
+func init() {
+	log.Init(&log.Config{
+		StdoutLevel: "error",
+	})
+}
+
+func testFrame(payload string) []byte {
+	frame := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[4:], payload)
+	return frame
+}
+
+func testSpoolDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "cat-agent-spool")
+	if err != nil {
+		t.Fatalf("create temp dir error: %s", err)
+	}
+	return dir
+}
+
+type failingWriter struct{}
+
+func (w failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestSpoolReplayInOrderAfterRestart(t *testing.T) {
+	dir := testSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	stats := new(Stats)
+	spool, err := NewSpool(dir, 20, 1024, time.Hour, stats)
+	if err != nil {
+		t.Fatalf("NewSpool error: %s", err)
+	}
+
+	expected := new(bytes.Buffer)
+	for _, payload := range []string{"frame-1", "frame-2", "frame-3", "frame-4", "frame-5"} {
+		frame := testFrame(payload)
+		expected.Write(frame)
+		if err := spool.Append(frame, 1); err != nil {
+			t.Fatalf("Append error: %s", err)
+		}
+	}
+	spool.Close()
+
+	// a failed replay must keep every frame.
+	spool, err = NewSpool(dir, 20, 1024, time.Hour, stats)
+	if err != nil {
+		t.Fatalf("NewSpool error: %s", err)
+	}
+	if err := spool.Replay(failingWriter{}); err == nil {
+		t.Fatal("Replay to a failing writer should return an error")
+	}
+	if !spool.Pending() {
+		t.Fatal("spool should still be pending after a failed replay")
+	}
+
+	actual := new(bytes.Buffer)
+	if err := spool.Replay(actual); err != nil {
+		t.Fatalf("Replay error: %s", err)
+	}
+
+	if !bytes.Equal(expected.Bytes(), actual.Bytes()) {
+		t.Fatalf("replayed %q, expected %q", actual.Bytes(), expected.Bytes())
+	}
+
+	if spool.Pending() {
+		t.Fatal("spool should be empty after replay")
+	}
+
+	snapshot := stats.Snapshot()
+	if snapshot.Spooled != 5 || snapshot.Replayed != 5 || snapshot.Dropped != 0 || snapshot.SpoolBytes != 0 {
+		t.Fatalf("unexpected stats: %+v", snapshot)
+	}
+}
+
+func TestSpoolSizeCapDropsOldest(t *testing.T) {
+	dir := testSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	stats := new(Stats)
+	// every segment holds a single 11 bytes frame, the spool holds three of them.
+	spool, err := NewSpool(dir, 11, 33, time.Hour, stats)
+	if err != nil {
+		t.Fatalf("NewSpool error: %s", err)
+	}
+
+	for _, payload := range []string{"frame-1", "frame-2", "frame-3", "frame-4", "frame-5"} {
+		if err := spool.Append(testFrame(payload), 1); err != nil {
+			t.Fatalf("Append error: %s", err)
+		}
+	}
+
+	actual := new(bytes.Buffer)
+	if err := spool.Replay(actual); err != nil {
+		t.Fatalf("Replay error: %s", err)
+	}
+
+	expected := new(bytes.Buffer)
+	for _, payload := range []string{"frame-3", "frame-4", "frame-5"} {
+		expected.Write(testFrame(payload))
+	}
+
+	if !bytes.Equal(expected.Bytes(), actual.Bytes()) {
+		t.Fatalf("replayed %q, expected %q", actual.Bytes(), expected.Bytes())
+	}
+
+	if snapshot := stats.Snapshot(); snapshot.Dropped != 2 || snapshot.Replayed != 3 {
+		t.Fatalf("unexpected stats: %+v", snapshot)
+	}
+}
+
+func TestSpoolAgeCapDropsExpired(t *testing.T) {
+	dir := testSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	stats := new(Stats)
+	spool, err := NewSpool(dir, 1024, 1024, 50*time.Millisecond, stats)
+	if err != nil {
+		t.Fatalf("NewSpool error: %s", err)
+	}
+
+	if err := spool.Append(testFrame("frame-1"), 1); err != nil {
+		t.Fatalf("Append error: %s", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	actual := new(bytes.Buffer)
+	if err := spool.Replay(actual); err != nil {
+		t.Fatalf("Replay error: %s", err)
+	}
+
+	if actual.Len() != 0 {
+		t.Fatalf("expired frames have been replayed: %q", actual.Bytes())
+	}
+
+	if snapshot := stats.Snapshot(); snapshot.Dropped != 1 || snapshot.Replayed != 0 {
+		t.Fatalf("unexpected stats: %+v", snapshot)
+	}
+}
+
+// blockingWriter writes to buf once release is closed.
+type blockingWriter struct {
+	buf     *bytes.Buffer
+	started chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	close(w.started)
+	<-w.release
+	return w.buf.Write(p)
+}
+
+func TestSpoolReplayWaitsForReplay(t *testing.T) {
+	spool, err := NewSpool(t.TempDir(), 1024, 1024, time.Hour, new(Stats))
+	if err != nil {
+		t.Fatalf("NewSpool error: %s", err)
+	}
+	defer spool.Close()
+
+	frame := testFrame("frame-1")
+	if err = spool.Append(frame, 1); err != nil {
+		t.Fatalf("Append error: %s", err)
+	}
+
+	first := &blockingWriter{buf: new(bytes.Buffer), started: make(chan struct{}), release: make(chan struct{})}
+	firstDone := make(chan error, 1)
+	go func() {
+		firstDone <- spool.Replay(first)
+	}()
+	<-first.started
+
+	// the second caller must not send its batch before the spooled frames.
+	second := new(bytes.Buffer)
+	secondDone := make(chan error, 1)
+	go func() {
+		secondDone <- spool.Replay(second)
+	}()
+	select {
+	case err = <-secondDone:
+		t.Fatalf("Replay returned %v while another replay was in progress", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(first.release)
+	if err = <-firstDone; err != nil {
+		t.Fatalf("first Replay error: %s", err)
+	}
+	if err = <-secondDone; err != nil {
+		t.Fatalf("second Replay error: %s", err)
+	}
+
+	if !bytes.Equal(first.buf.Bytes(), frame) || second.Len() != 0 {
+		t.Fatalf("replayed %q and %q, expected %q once", first.buf.Bytes(), second.Bytes(), frame)
+	}
+}
+
+// shortWriter takes n bytes and then fails, like a connection that breaks in the middle of a frame.
+type shortWriter struct {
+	buf *bytes.Buffer
+	n   int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		w.buf.Write(p[:w.n])
+		return w.n, errors.New("broken pipe")
+	}
+	return w.buf.Write(p)
+}
+
+func TestSpoolReplayResumesAfterError(t *testing.T) {
+	stats := new(Stats)
+	spool, err := NewSpool(t.TempDir(), 1024, 1024, time.Hour, stats)
+	if err != nil {
+		t.Fatalf("NewSpool error: %s", err)
+	}
+	defer spool.Close()
+
+	frames := [][]byte{testFrame("frame-1"), testFrame("frame-2"), testFrame("frame-3")}
+	for _, frame := range frames {
+		if err = spool.Append(frame, 1); err != nil {
+			t.Fatalf("Append error: %s", err)
+		}
+	}
+
+	// the connection breaks in the middle of the second frame.
+	broken := &shortWriter{buf: new(bytes.Buffer), n: len(frames[0]) + 3}
+	if err = spool.Replay(broken); err == nil {
+		t.Fatal("Replay to a broken writer should return an error")
+	}
+	if replayed := stats.Snapshot().Replayed; replayed != 1 {
+		t.Fatalf("%d frames replayed, expected the one written completely", replayed)
+	}
+
+	actual := new(bytes.Buffer)
+	if err = spool.Replay(actual); err != nil {
+		t.Fatalf("Replay error: %s", err)
+	}
+	if expected := append(append([]byte{}, frames[1]...), frames[2]...); !bytes.Equal(actual.Bytes(), expected) {
+		t.Fatalf("replayed %q after the error, expected %q", actual.Bytes(), expected)
+	}
+
+	if snapshot := stats.Snapshot(); snapshot.Replayed != 3 || snapshot.Dropped != 0 || snapshot.SpoolBytes != 0 {
+		t.Fatalf("unexpected stats: %+v", snapshot)
+	}
+}
+
+func TestSpoolLoadCutsPartialFrame(t *testing.T) {
+	dir := t.TempDir()
+	whole := append(testFrame("frame-1"), testFrame("frame-2")...)
+	data := append(append([]byte{}, whole...), testFrame("frame-3")[:6]...)
+	if err := ioutil.WriteFile(filepath.Join(dir, "00000000000000000001"+spoolSegmentExt), data, 0644); err != nil {
+		t.Fatalf("write segment error: %s", err)
+	}
+
+	stats := new(Stats)
+	spool, err := NewSpool(dir, 1024, 1024, time.Hour, stats)
+	if err != nil {
+		t.Fatalf("NewSpool error: %s", err)
+	}
+	defer spool.Close()
+
+	if size := stats.Snapshot().SpoolBytes; size != int64(len(whole)) {
+		t.Fatalf("spool bytes: %d, expected the %d bytes of the whole frames", size, len(whole))
+	}
+
+	actual := new(bytes.Buffer)
+	if err = spool.Replay(actual); err != nil {
+		t.Fatalf("Replay error: %s", err)
+	}
+	if !bytes.Equal(actual.Bytes(), whole) {
+		t.Fatalf("replayed %q, expected the whole frames %q", actual.Bytes(), whole)
+	}
+	if replayed := stats.Snapshot().Replayed; replayed != 2 {
+		t.Fatalf("%d frames replayed, expected 2", replayed)
+	}
+}
@@ -6,12 +6,14 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Orlion/cat-agent/cat/config"
 	"github.com/Orlion/cat-agent/cat/encoder"
 	"github.com/Orlion/cat-agent/cat/message"
 	"github.com/Orlion/cat-agent/log"
+	"github.com/Orlion/cat-agent/metrics"
 	"github.com/Orlion/cat-agent/pkg/atomicx"
 )
 
@@ -21,55 +23,124 @@ type TcpSender struct {
 	config     *config.ConfigService
 	wg         *sync.WaitGroup
 	inShutdown atomicx.Bool
-	running    bool
+	stats      *Stats
+	spool      *Spool
+	// overflowed holds the trees that the queues could not take until the spooler spools them.
+	overflowed chan *message.MessageTree
+	dumper     *Dumper
+	balancer   *Balancer
+	mu         sync.Mutex
+	// the consumers are not bound to a router, the balancer picks the routers of every batch.
+	normalConsumers []*Consumer
+	highConsumers   []*Consumer
 }
 
 func NewTcpSender() *TcpSender {
-	return &TcpSender{
-		normal: make(chan *message.MessageTree, config.TcpSenderNormalQueueSize),
-		high:   make(chan *message.MessageTree, config.TcpSenderHighQueueSize),
-		config: config.GetInstance(),
-		wg:     new(sync.WaitGroup),
+	s := &TcpSender{
+		normal:   make(chan *message.MessageTree, config.TcpSenderNormalQueueSize),
+		high:     make(chan *message.MessageTree, config.TcpSenderHighQueueSize),
+		config:   config.GetInstance(),
+		wg:       new(sync.WaitGroup),
+		stats:    new(Stats),
+		balancer: NewBalancer(config.GetInstance().GetSenderRoutingStrategy()),
 	}
+
+	if dir := s.config.GetSenderSpoolDir(); dir != "" {
+		spool, err := NewSpool(dir, s.config.GetSenderSpoolSegmentMaxBytes(), s.config.GetSenderSpoolMaxBytes(), s.config.GetSenderSpoolMaxAge(), s.stats)
+		if err != nil {
+			log.Errorf("tcp sender create spool in %s error: %s, spool has been disabled", dir, err.Error())
+		} else {
+			s.spool = spool
+			s.overflowed = make(chan *message.MessageTree, config.TcpSenderOverflowQueueSize)
+		}
+	}
+
+	if target := s.config.GetSenderDump(); target != "" {
+		dumper, err := NewDumper(target)
+		if err != nil {
+			log.Errorf("tcp sender create dumper to %s error: %s, dump has been disabled", target, err.Error())
+		} else {
+			s.dumper = dumper
+		}
+	}
+
+	return s
 }
 
 func (s *TcpSender) Run() {
 	log.Info("tcp sender running...")
 
-	for _, router := range s.config.GetRouters() {
-		for i := 0; i < config.GetInstance().GetSenderNormalQueueConsumerNum(); i++ {
-			s.wg.Add(1)
-			go func(id int) {
-				newConsumer(id, router, "normal", s.normal).run()
-				s.wg.Done()
-			}(i)
-		}
+	routers, version := s.config.GetRoutersWithVersion()
+	s.updateRouters(routers)
 
-		for i := 0; i < config.GetInstance().GetSenderHighQueueConsumerNum(); i++ {
-			s.wg.Add(1)
-			go func(id int) {
-				newConsumer(id, router, "high", s.high).run()
-				s.wg.Done()
-			}(i)
+	s.mu.Lock()
+	s.scaleLocked()
+	s.mu.Unlock()
+
+	if s.overflowed != nil {
+		s.wg.Add(1)
+		go func() {
+			s.runSpooler()
+			s.wg.Done()
+		}()
+	}
+
+	go func() {
+		for {
+			// listen routers change
+			routers, version = s.config.WaitRoutersChange(version)
+			if s.inShutdown.Get() {
+				return
+			}
+			s.updateRouters(routers)
 		}
+	}()
+}
+
+// updateRouters hands the routers to the balancer, the queues and the consumers are left alone,
+// the consumers close their connections to the routers that have been removed.
+func (s *TcpSender) updateRouters(routers []string) {
+	log.Infof("tcp sender routers has been updated to %v", routers)
+	s.balancer.Update(routers)
+}
+
+// Reload applies the consumer numbers and the routing strategy of the current configuration.
+func (s *TcpSender) Reload() {
+	s.balancer.SetStrategy(s.config.GetSenderRoutingStrategy())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inShutdown.Get() {
+		return
 	}
 
-	if !s.running {
-		s.running = true
+	s.scaleLocked()
+}
+
+func (s *TcpSender) scaleLocked() {
+	s.normalConsumers = s.scaleConsumersLocked(s.normalConsumers, s.config.GetSenderNormalQueueConsumerNum(), "normal", s.normal)
+	s.highConsumers = s.scaleConsumersLocked(s.highConsumers, s.config.GetSenderHighQueueConsumerNum(), "high", s.high)
+}
+
+// scaleConsumersLocked starts or stops consumers until there are exactly n of them.
+func (s *TcpSender) scaleConsumersLocked(consumers []*Consumer, n int, chName string, ch <-chan *message.MessageTree) []*Consumer {
+	for len(consumers) < n {
+		c := newConsumer(len(consumers), chName, ch, s)
+		s.wg.Add(1)
 		go func() {
-			for {
-				// listen routers change
-				s.config.RoutersCondWait()
-				s.restart()
-			}
+			c.run()
+			s.wg.Done()
 		}()
+		consumers = append(consumers, c)
+	}
+
+	for len(consumers) > n {
+		consumers[len(consumers)-1].stop()
+		consumers = consumers[:len(consumers)-1]
 	}
-}
 
-func (s *TcpSender) restart() {
-	log.Info("tcp sender restart")
-	s.Shutdown()
-	s.Run()
+	return consumers
 }
 
 func (s *TcpSender) Shutdown() {
@@ -77,56 +148,136 @@ func (s *TcpSender) Shutdown() {
 
 	s.inShutdown.SetTrue()
 
+	s.mu.Lock()
 	close(s.normal)
 	close(s.high)
+	if s.overflowed != nil {
+		close(s.overflowed)
+	}
+	s.normalConsumers = nil
+	s.highConsumers = nil
+	s.mu.Unlock()
 
 	s.wg.Wait()
 
+	if s.spool != nil {
+		s.spool.Close()
+	}
+
+	if s.dumper != nil {
+		s.dumper.Close()
+	}
+
 	log.Info("tcp sender exit")
 }
 
-func (s *TcpSender) Offer(tree *message.MessageTree) {
+func (s *TcpSender) Offer(tree *message.MessageTree) OfferResult {
 	if s.inShutdown.Get() {
-		return
+		return OfferDropped
 	}
 
 	if tree.GetMessage().IsSuccess() {
+		metrics.TreesOffered.WithLabelValues("normal").Inc()
 		select {
 		case s.normal <- tree:
+			return OfferQueued
 		default:
-
+			return s.overflow(tree)
 		}
 	} else {
+		metrics.TreesOffered.WithLabelValues("high").Inc()
 		select {
 		case s.high <- tree:
+			return OfferQueued
 		default:
+			return s.overflow(tree)
+		}
+	}
+}
+
+func (s *TcpSender) Stats() Stats {
+	stats := s.stats.Snapshot()
+	stats.NormalQueueLen = len(s.normal)
+	stats.HighQueueLen = len(s.high)
+	stats.Routers = s.balancer.Stats()
+	return stats
+}
+
+// overflow hands a tree that no consumer could take to the spooler, so Offer never waits for the disk.
+// It is dropped if the spool is disabled or the spooler is behind.
+func (s *TcpSender) overflow(tree *message.MessageTree) OfferResult {
+	if s.overflowed == nil {
+		atomic.AddUint64(&s.stats.Dropped, 1)
+		return OfferDropped
+	}
+
+	select {
+	case s.overflowed <- tree:
+		return OfferSpooled
+	default:
+		atomic.AddUint64(&s.stats.Dropped, 1)
+		return OfferDropped
+	}
+}
+
+// runSpooler spools the trees that overflowed the queues until the sender shuts down.
+func (s *TcpSender) runSpooler() {
+	e := encoder.NewBinaryEncoder()
+	for tree := range s.overflowed {
+		if err := e.EncodeMessageTree(tree); err != nil {
+			log.Warnf("tcp sender encode message tree error: %s, tree has been dropped", err.Error())
+			atomic.AddUint64(&s.stats.Dropped, 1)
+			continue
+		}
 
+		frame := make([]byte, 4+e.BufLen())
+		binary.BigEndian.PutUint32(frame, uint32(e.BufLen()))
+		copy(frame[4:], e.Bytes())
+		if err := s.spool.Append(frame, 1); err != nil {
+			log.Warnf("tcp sender spool error: %s, tree has been dropped", err.Error())
+			atomic.AddUint64(&s.stats.Dropped, 1)
 		}
 	}
 }
 
+type routerConn struct {
+	conn     net.Conn
+	connTime time.Time
+}
+
 type Consumer struct {
-	encoder  *encoder.BinaryEncoder
+	// encoders are created on demand by name, encoding is the name of the encoder of buf.
+	encoders map[string]encoder.Encoder
+	encoding string
 	name     string
-	server   string
 	ch       <-chan *message.MessageTree
-	conn     net.Conn
-	connTime time.Time
+	sender   *TcpSender
+	conns    map[string]*routerConn
 	trees    []*message.MessageTree
 	buf      *bytes.Buffer
+	ends     []int
+	done     chan struct{}
 }
 
-func newConsumer(id int, server, chName string, ch <-chan *message.MessageTree) *Consumer {
+func newConsumer(id int, chName string, ch <-chan *message.MessageTree, sender *TcpSender) *Consumer {
 	return &Consumer{
-		encoder: encoder.NewBinaryEncoder(),
-		name:    fmt.Sprintf("%s-%s-%d", chName, server, id),
-		server:  server,
-		ch:      ch,
-		trees:   make([]*message.MessageTree, 0, config.TcpSenderQueueConsumerBufSize),
-		buf:     bytes.NewBuffer([]byte{}),
+		encoders: make(map[string]encoder.Encoder),
+		name:     fmt.Sprintf("%s-%d", chName, id),
+		ch:       ch,
+		sender:   sender,
+		conns:    make(map[string]*routerConn),
+		trees:    make([]*message.MessageTree, 0, config.TcpSenderQueueConsumerBufSize),
+		buf:      bytes.NewBuffer([]byte{}),
+		ends:     make([]int, 0, config.TcpSenderQueueConsumerBufSize),
+		done:     make(chan struct{}),
 	}
 }
 
+// stop makes the consumer flush its batch and exit, the queue it consumes stays open.
+func (c *Consumer) stop() {
+	close(c.done)
+}
+
 func (c *Consumer) run() {
 	log.Infof("consumer %s running...", c.name)
 
@@ -134,17 +285,28 @@ func (c *Consumer) run() {
 
 Loop:
 	for {
+		// a full batch that no router could take is kept, the queue backs up meanwhile.
+		ch := c.ch
+		if len(c.trees) == config.TcpSenderQueueConsumerBufSize {
+			ch = nil
+		}
+
 		select {
-		case msg, ok := <-c.ch:
+		case msg, ok := <-ch:
 			if !ok {
 				break Loop
 			}
+			if c.sender.dumper != nil {
+				c.sender.dumper.Dump(msg)
+			}
 			c.trees = append(c.trees, msg)
 			if len(c.trees) == config.TcpSenderQueueConsumerBufSize {
 				c.flush(false)
 			}
 		case <-ticker.C:
 			c.flush(false)
+		case <-c.done:
+			break Loop
 		}
 	}
 
@@ -153,86 +315,262 @@ Loop:
 	c.flush(true)
 	c.buf = nil
 
-	if c.conn != nil {
-		c.conn.Close()
+	for router := range c.conns {
+		c.closeConn(router)
 	}
+
+	log.Infof("consumer %s exit", c.name)
 }
 
-func (c *Consumer) connect(nonblock bool) error {
-	var (
-		err       error
-		tempDelay time.Duration
-	)
+// flush sends the batch to the routers picked by the balancer. The trees that no router takes are kept
+// for the next flush, unless final is set or the sender shuts down, then they are spooled.
+func (c *Consumer) flush(final bool) {
+	balancer, spool := c.sender.balancer, c.sender.spool
 
-	if c.conn != nil && time.Now().Sub(c.connTime) < 10*time.Minute {
-		return nil
+	for router := range c.conns {
+		if !balancer.Has(router) {
+			c.closeConn(router)
+		}
+	}
+
+	if len(c.trees) == 0 && (spool == nil || !spool.Pending()) {
+		return
 	}
 
-	c.conn = nil
+	keep := !final && !c.sender.inShutdown.Get()
+	if !balancer.Available() {
+		if !keep {
+			c.encodeTrees(c.trees, config.EncoderBinary)
+			c.spoolUnwritten(c.trees, 0)
+			c.trees = c.trees[:0]
+		}
+		return
+	}
 
-	for {
-		c.conn, err = net.DialTimeout("tcp", c.server, time.Second)
-		if err == nil {
-			c.connTime = time.Now()
-			break
+	var unsent []*message.MessageTree
+	for _, r := range balancer.Route(c.trees) {
+		written := c.send(r)
+		sent, _ := c.completeFrames(written)
+		if sent == len(r.trees) {
+			continue
+		}
+		if keep {
+			unsent = append(unsent, r.trees[sent:]...)
+			c.ends = c.ends[:0]
+		} else {
+			c.spoolUnwritten(r.trees, written)
 		}
+	}
+
+	c.trees = append(c.trees[:0], unsent...)
+}
 
-		if nonblock {
-			return err
+// send writes the trees of r to the first router of r that takes them, the frames left over by a failed
+// router go to the next one. It returns the number of bytes of the encoded trees that have been sent,
+// the trees are encoded with the encoder of the last router tried.
+func (c *Consumer) send(r *route) int {
+	encoding := config.EncoderBinary
+	if len(r.routers) > 0 {
+		encoding = c.sender.config.GetSenderRouterEncoder(r.routers[0])
+	}
+	c.encodeTrees(r.trees, encoding)
+
+	written := 0
+	for _, router := range r.routers {
+		// the trees are encoded again for a router with another encoder, the frames sent stay sent.
+		if encoding = c.sender.config.GetSenderRouterEncoder(router); encoding != c.encoding {
+			sent, _ := c.completeFrames(written)
+			c.encodeTrees(r.trees, encoding)
+			written = 0
+			if sent > 0 {
+				written = c.ends[sent-1]
+			}
 		}
+		data := c.buf.Bytes()
 
-		log.Errorf("consumer %s dial to %s error: %s, tempDelay: %d", c.name, c.server, err, tempDelay)
+		conn, err := c.connect(router)
+		if err != nil {
+			continue
+		}
 
-		if tempDelay == 0 {
-			tempDelay = 100 * time.Millisecond
-		} else {
-			tempDelay *= 2
+		if err = c.replay(router, conn); err != nil {
+			continue
 		}
-		if max := 5 * time.Second; tempDelay > max {
-			tempDelay = max
+
+		log.Debugf("consumer %s flush %d trees to %s", c.name, len(c.ends), router)
+
+		n, err := c.write(router, conn, data[written:])
+		sentBefore, _ := c.completeFrames(written)
+		sent, start := c.completeFrames(written + n)
+		metrics.TreesSent.WithLabelValues(router).Add(uint64(sent - sentBefore))
+		if err == nil {
+			c.sender.balancer.MarkSuccess(router)
+			return len(data)
 		}
 
-		time.Sleep(tempDelay)
+		log.Warnf("error: %s occurred while writing data to %s, connection has been dropped", err.Error(), router)
+		c.dropConn(router, err)
+		// a frame written partially is sent again from its start.
+		written = start
 	}
 
-	return nil
+	return written
 }
 
-func (c *Consumer) flush(nonblock bool) {
-	if len(c.trees) == 0 {
-		return
+func (c *Consumer) connect(router string) (net.Conn, error) {
+	rc, exists := c.conns[router]
+	if exists && rc.conn != nil {
+		if time.Now().Sub(rc.connTime) < config.TcpSenderConnMaxAge {
+			return rc.conn, nil
+		}
+		rc.conn.Close()
+		rc.conn = nil
 	}
-	if err := c.connect(nonblock); err != nil {
-		return
+
+	conn, err := net.DialTimeout("tcp", router, time.Second)
+	if err != nil {
+		metrics.SenderConnectFailures.WithLabelValues(router).Inc()
+		log.Errorf("consumer %s dial to %s error: %s", c.name, router, err)
+		c.sender.balancer.MarkFailure(router, err)
+		return nil, err
 	}
 
-	log.Debugf("tcp sender flush %d trees", len(c.trees))
+	if exists {
+		metrics.SenderReconnects.WithLabelValues(router).Inc()
+	} else {
+		rc = new(routerConn)
+		c.conns[router] = rc
+	}
+	rc.conn = conn
+	rc.connTime = time.Now()
 
-	c.buf.Reset()
-	b := make([]byte, 4)
-	for _, tree := range c.trees {
-		c.encoder.EncodeMessageTree(tree)
-		binary.BigEndian.PutUint32(b, uint32(c.encoder.BufLen()))
-		c.buf.Write(b)
-		c.buf.Write(c.encoder.Bytes())
+	return conn, nil
+}
+
+// replay writes the spool to conn before the batch, so the spooled trees are sent in order. If another
+// consumer is replaying, it waits until the spool has been drained. The spool holds NT1 frames only,
+// they are kept for a router with the binary encoder if router takes another encoding.
+func (c *Consumer) replay(router string, conn net.Conn) error {
+	spool := c.sender.spool
+	if spool == nil || !spool.Pending() || c.sender.config.GetSenderRouterEncoder(router) != config.EncoderBinary {
+		return nil
+	}
+
+	err := spool.Replay(replayWriter{conn, metrics.SenderBytesWritten.WithLabelValues(router)})
+	if err != nil {
+		log.Warnf("error: %s occurred while replaying spool to %s, connection has been dropped", err.Error(), router)
+		c.dropConn(router, err)
 	}
 
-	c.trees = c.trees[:0]
+	return err
+}
 
-	if err := c.conn.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
-		log.Warnf("error: %s occurred while setting write deadline, connection has been dropped", err.Error())
-		c.conn = nil
+func (c *Consumer) write(router string, conn net.Conn, data []byte) (written int, err error) {
+	if err = conn.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+		return
 	}
-	for {
-		n, err := c.conn.Write(c.buf.Bytes())
+
+	for written < len(data) {
+		var n int
+		n, err = conn.Write(data[written:])
+		written += n
+		metrics.SenderBytesWritten.WithLabelValues(router).Add(uint64(n))
 		if err != nil {
-			log.Warnf("error: %s occurred while writing data, connection has been dropped", err.Error())
-			c.conn = nil
 			return
 		}
-		c.buf.Next(n)
-		if c.buf.Len() < 1 {
+	}
+
+	return
+}
+
+// dropConn closes the connection to router after an error and reports the error to the balancer.
+func (c *Consumer) dropConn(router string, err error) {
+	if rc, exists := c.conns[router]; exists && rc.conn != nil {
+		rc.conn.Close()
+		rc.conn = nil
+	}
+	c.sender.balancer.MarkFailure(router, err)
+}
+
+func (c *Consumer) closeConn(router string) {
+	if rc, exists := c.conns[router]; exists {
+		if rc.conn != nil {
+			rc.conn.Close()
+		}
+		delete(c.conns, router)
+	}
+}
+
+// encodeTrees encodes the trees in buf with the encoder named encoding, every tree is a frame of its length and its bytes.
+func (c *Consumer) encodeTrees(trees []*message.MessageTree, encoding string) {
+	e, exists := c.encoders[encoding]
+	if !exists {
+		e = encoder.NewEncoder(encoding)
+		c.encoders[encoding] = e
+	}
+	c.encoding = encoding
+
+	c.buf.Reset()
+	c.ends = c.ends[:0]
+	b := make([]byte, 4)
+	for _, tree := range trees {
+		e.EncodeMessageTree(tree)
+		binary.BigEndian.PutUint32(b, uint32(e.BufLen()))
+		c.buf.Write(b)
+		c.buf.Write(e.Bytes())
+		c.ends = append(c.ends, c.buf.Len())
+	}
+}
+
+// completeFrames returns the number of frames of the current batch that end within the first offset bytes,
+// and the offset the next frame starts at.
+func (c *Consumer) completeFrames(offset int) (n, start int) {
+	for _, end := range c.ends {
+		if end > offset {
 			break
 		}
+		n++
+		start = end
+	}
+	return
+}
+
+// spoolUnwritten spools the frames of the current batch of trees that were not written completely,
+// written is the number of bytes of the batch that have already been written to a router. The spool
+// holds NT1 frames only, the trees are encoded again if the batch has been encoded in another format.
+func (c *Consumer) spoolUnwritten(trees []*message.MessageTree, written int) {
+	spool, stats := c.sender.spool, c.sender.stats
+
+	n, start := c.completeFrames(written)
+	if n = len(c.ends) - n; n > 0 {
+		if c.encoding != config.EncoderBinary {
+			c.encodeTrees(trees[len(trees)-n:], config.EncoderBinary)
+			start = 0
+		}
+		frames := c.buf.Bytes()[start:]
+		if spool == nil {
+			atomic.AddUint64(&stats.Dropped, uint64(n))
+		} else if err := spool.Append(frames, n); err != nil {
+			log.Warnf("consumer %s spool error: %s, %d trees have been dropped", c.name, err.Error(), n)
+			atomic.AddUint64(&stats.Dropped, uint64(n))
+		}
+	}
+
+	c.ends = c.ends[:0]
+}
+
+// replayWriter writes the spool to a router, every write has TcpSenderSpoolReplayTimeout to complete
+// from the time it starts, and counts the bytes written.
+type replayWriter struct {
+	conn    net.Conn
+	counter *metrics.Counter
+}
+
+func (w replayWriter) Write(p []byte) (n int, err error) {
+	if err = w.conn.SetWriteDeadline(time.Now().Add(config.TcpSenderSpoolReplayTimeout)); err != nil {
+		return
 	}
+	n, err = w.conn.Write(p)
+	w.counter.Add(uint64(n))
+	return
 }
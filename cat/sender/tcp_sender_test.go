@@ -0,0 +1,366 @@
+package sender
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Orlion/cat-agent/cat/config"
+	"github.com/Orlion/cat-agent/cat/message"
+)
+
+// testRouter is a local router that counts the frames it receives, and the ones in plain text.
+type testRouter struct {
+	l               net.Listener
+	frames          int64
+	plainTextFrames int64
+}
+
+func newTestRouter(t *testing.T) *testRouter {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %s", err)
+	}
+
+	r := &testRouter{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+
+	return r
+}
+
+func (r *testRouter) serve(conn net.Conn) {
+	defer conn.Close()
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		frame := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(conn, frame); err != nil {
+			return
+		}
+		if bytes.HasPrefix(frame, config.PlainTextProtocol) {
+			atomic.AddInt64(&r.plainTextFrames, 1)
+		}
+		atomic.AddInt64(&r.frames, 1)
+	}
+}
+
+func (r *testRouter) addr() string {
+	return r.l.Addr().String()
+}
+
+func (r *testRouter) received() int64 {
+	return atomic.LoadInt64(&r.frames)
+}
+
+func testMessageTree(i int) *message.MessageTree {
+	status := message.SUCCESS
+	if i%2 == 1 {
+		status = "ERROR"
+	}
+
+	tree := message.NewMessageTree()
+	tree.SetDomain([]byte("TestTcpSender"))
+	tree.SetMessageId([]byte("TestTcpSender-7f000001-447323-1"))
+	tree.SetMessage(message.NewTransaction("URL", "/index", status, "", time.Now().UnixNano()/1e6, nil, 1000))
+	return tree
+}
+
+func offerTestMessageTrees(t *testing.T, s *TcpSender, n int) {
+	for i := 0; i < n; i++ {
+		if result := s.Offer(testMessageTree(i)); result != OfferQueued {
+			t.Fatalf("Offer returned %d, expected %d", result, OfferQueued)
+		}
+	}
+}
+
+func waitReceived(t *testing.T, expected int64, routers ...*testRouter) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var received int64
+		for _, r := range routers {
+			received += r.received()
+		}
+		if received == expected {
+			return
+		}
+		if received > expected || time.Now().After(deadline) {
+			t.Fatalf("routers received %d trees, expected %d", received, expected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func testUnreachableRouter(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %s", err)
+	}
+	l.Close()
+	return l.Addr().String()
+}
+
+// newTestTcpSender starts a sender without routers, the router server is unreachable.
+func newTestTcpSender(t *testing.T, strategy string) *TcpSender {
+	err := config.Init(&config.Config{
+		Domain:                       "TestTcpSender",
+		Servers:                      []string{"127.0.0.1:1"},
+		SenderNormalQueueConsumerNum: 2,
+		SenderHighQueueConsumerNum:   2,
+		SenderRoutingStrategy:        strategy,
+	})
+	if err != nil {
+		t.Fatalf("config.Init error: %s", err)
+	}
+
+	s := NewTcpSender()
+	s.Run()
+	return s
+}
+
+func shutdownTestTcpSender(t *testing.T, s *TcpSender) {
+	s.Shutdown()
+	config.Shutdown()
+
+	if stats := s.Stats(); stats.Dropped != 0 {
+		t.Fatalf("%d trees have been dropped", stats.Dropped)
+	}
+}
+
+func TestTcpSenderUpdateRouters(t *testing.T) {
+	r1, r2 := newTestRouter(t), newTestRouter(t)
+	defer r1.l.Close()
+	defer r2.l.Close()
+
+	s := newTestTcpSender(t, config.RoutingStrategyFailover)
+	defer shutdownTestTcpSender(t, s)
+
+	s.updateRouters([]string{r1.addr()})
+	offerTestMessageTrees(t, s, 100)
+
+	// the batches still buffered by the consumers must not be lost.
+	s.updateRouters([]string{r2.addr()})
+	offerTestMessageTrees(t, s, 100)
+	waitReceived(t, 200, r1, r2)
+
+	if s.balancer.Has(r1.addr()) || !s.balancer.Has(r2.addr()) {
+		t.Fatalf("router %s should have been removed, router %s should have been added", r1.addr(), r2.addr())
+	}
+
+	r2Received := r2.received()
+	offerTestMessageTrees(t, s, 100)
+	waitReceived(t, r2Received+100, r2)
+
+	// the batches are kept while the only router is unreachable, and sent once a router is up.
+	s.updateRouters([]string{testUnreachableRouter(t)})
+	offerTestMessageTrees(t, s, 100)
+	time.Sleep(2 * config.TcpSenderQueueConsumerTickerDuration)
+	s.updateRouters([]string{r2.addr()})
+	waitReceived(t, r2Received+200, r2)
+}
+
+// TestTcpSenderOverflow fills the queues while there is no router, the trees that overflow them are
+// spooled in the background and replayed once a router is up.
+func TestTcpSenderOverflow(t *testing.T) {
+	err := config.Init(&config.Config{
+		Domain:                       "TestTcpSender",
+		Servers:                      []string{"127.0.0.1:1"},
+		SenderNormalQueueConsumerNum: 1,
+		SenderHighQueueConsumerNum:   1,
+		SenderSpoolDir:               t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("config.Init error: %s", err)
+	}
+
+	s := NewTcpSender()
+	s.Run()
+	defer shutdownTestTcpSender(t, s)
+
+	// the consumer keeps a full batch, then the queue fills up.
+	queued, spooled := 0, 0
+	for spooled < 100 {
+		switch result := s.Offer(testMessageTree(0)); result {
+		case OfferSpooled:
+			spooled++
+		case OfferQueued:
+			if queued++; queued > config.TcpSenderQueueConsumerBufSize+config.TcpSenderNormalQueueSize {
+				t.Fatalf("%d trees queued, the queue should be full", queued)
+			}
+		default:
+			t.Fatalf("Offer returned %d", result)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Stats().Spooled != uint64(spooled) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d trees spooled, expected %d", s.Stats().Spooled, spooled)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	r := newTestRouter(t)
+	defer r.l.Close()
+	s.updateRouters([]string{r.addr()})
+
+	waitReceived(t, int64(queued+spooled), r)
+	if replayed := s.Stats().Replayed; replayed != uint64(spooled) {
+		t.Fatalf("%d trees replayed, expected %d", replayed, spooled)
+	}
+}
+
+func TestTcpSenderFailover(t *testing.T) {
+	r1, r2 := newTestRouter(t), newTestRouter(t)
+	defer r1.l.Close()
+	defer r2.l.Close()
+
+	s := newTestTcpSender(t, config.RoutingStrategyFailover)
+	defer shutdownTestTcpSender(t, s)
+
+	// the dead primary is skipped, the routers after the first healthy one are not used.
+	dead := testUnreachableRouter(t)
+	s.updateRouters([]string{dead, r1.addr(), r2.addr()})
+	offerTestMessageTrees(t, s, 100)
+	waitReceived(t, 100, r1)
+
+	if received := r2.received(); received != 0 {
+		t.Fatalf("router %s received %d trees while router %s was healthy", r2.addr(), received, r1.addr())
+	}
+
+	for _, router := range s.Stats().Routers {
+		if healthy := router.Router != dead; router.Healthy != healthy {
+			t.Fatalf("router %s healthy: %t, expected %t", router.Router, router.Healthy, healthy)
+		}
+	}
+}
+
+func TestTcpSenderRoundRobin(t *testing.T) {
+	r1, r2 := newTestRouter(t), newTestRouter(t)
+	defer r1.l.Close()
+	defer r2.l.Close()
+
+	s := newTestTcpSender(t, config.RoutingStrategyRoundRobin)
+	defer shutdownTestTcpSender(t, s)
+
+	s.updateRouters([]string{r1.addr(), r2.addr()})
+	for i := 0; i < 10; i++ {
+		offerTestMessageTrees(t, s, 20)
+		time.Sleep(config.TcpSenderQueueConsumerTickerDuration / 5)
+	}
+	waitReceived(t, 200, r1, r2)
+
+	if r1.received() == 0 || r2.received() == 0 {
+		t.Fatalf("routers received %d and %d trees, expected both to receive some", r1.received(), r2.received())
+	}
+}
+
+func TestTcpSenderRouterEncoders(t *testing.T) {
+	r1, r2 := newTestRouter(t), newTestRouter(t)
+	defer r1.l.Close()
+	defer r2.l.Close()
+
+	s := newTestTcpSender(t, config.RoutingStrategyRoundRobin)
+	defer shutdownTestTcpSender(t, s)
+
+	err := config.GetInstance().Reload(&config.Config{
+		Domain:                       "TestTcpSender",
+		Servers:                      []string{"127.0.0.1:1"},
+		SenderNormalQueueConsumerNum: 2,
+		SenderHighQueueConsumerNum:   2,
+		SenderRoutingStrategy:        config.RoutingStrategyRoundRobin,
+		SenderRouterEncoders:         map[string]string{r1.addr(): config.EncoderPlainText},
+	})
+	if err != nil {
+		t.Fatalf("config reload error: %s", err)
+	}
+
+	s.updateRouters([]string{r1.addr(), r2.addr()})
+	for i := 0; i < 10; i++ {
+		offerTestMessageTrees(t, s, 20)
+		time.Sleep(config.TcpSenderQueueConsumerTickerDuration / 5)
+	}
+	waitReceived(t, 200, r1, r2)
+
+	if r1.received() == 0 || atomic.LoadInt64(&r1.plainTextFrames) != r1.received() {
+		t.Fatalf("router %s received %d trees, %d in plain text, expected all of them in plain text", r1.addr(), r1.received(), atomic.LoadInt64(&r1.plainTextFrames))
+	}
+	if plainTextFrames := atomic.LoadInt64(&r2.plainTextFrames); plainTextFrames != 0 {
+		t.Fatalf("router %s received %d trees in plain text, expected none", r2.addr(), plainTextFrames)
+	}
+}
+
+// TestTcpSenderSpoolBinaryOnly checks that the spooled NT1 frames are kept for the routers with the binary encoder.
+func TestTcpSenderSpoolBinaryOnly(t *testing.T) {
+	plainText, binaryRouter := newTestRouter(t), newTestRouter(t)
+	defer plainText.l.Close()
+	defer binaryRouter.l.Close()
+
+	err := config.Init(&config.Config{
+		Domain:                       "TestTcpSender",
+		Servers:                      []string{"127.0.0.1:1"},
+		SenderNormalQueueConsumerNum: 1,
+		SenderHighQueueConsumerNum:   1,
+		SenderSpoolDir:               t.TempDir(),
+		SenderRouterEncoders:         map[string]string{plainText.addr(): config.EncoderPlainText},
+	})
+	if err != nil {
+		t.Fatalf("config.Init error: %s", err)
+	}
+
+	s := NewTcpSender()
+	s.Run()
+	defer shutdownTestTcpSender(t, s)
+
+	queued, spooled := 0, 0
+	for spooled < 100 {
+		switch result := s.Offer(testMessageTree(0)); result {
+		case OfferSpooled:
+			spooled++
+		case OfferQueued:
+			queued++
+		default:
+			t.Fatalf("Offer returned %d", result)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Stats().Spooled != uint64(spooled) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d trees spooled, expected %d", s.Stats().Spooled, spooled)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.updateRouters([]string{plainText.addr()})
+	waitReceived(t, int64(queued), plainText)
+	time.Sleep(2 * config.TcpSenderQueueConsumerTickerDuration)
+	if received, plainTextFrames := plainText.received(), atomic.LoadInt64(&plainText.plainTextFrames); received != int64(queued) || plainTextFrames != received {
+		t.Fatalf("router %s received %d trees, %d in plain text, expected the %d queued ones in plain text", plainText.addr(), received, plainTextFrames, queued)
+	}
+	if replayed := s.Stats().Replayed; replayed != 0 {
+		t.Fatalf("%d trees replayed to a plain text router, expected none", replayed)
+	}
+
+	s.updateRouters([]string{binaryRouter.addr()})
+	waitReceived(t, int64(spooled), binaryRouter)
+	if plainTextFrames := atomic.LoadInt64(&binaryRouter.plainTextFrames); plainTextFrames != 0 {
+		t.Fatalf("router %s received %d trees in plain text, expected none", binaryRouter.addr(), plainTextFrames)
+	}
+	if replayed := s.Stats().Replayed; replayed != uint64(spooled) {
+		t.Fatalf("%d trees replayed, expected %d", replayed, spooled)
+	}
+}
@@ -6,11 +6,13 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/Orlion/cat-agent/cat/config"
 	"github.com/Orlion/cat-agent/cat/message"
 	"github.com/Orlion/cat-agent/log"
+	"github.com/Orlion/cat-agent/metrics"
 	"github.com/Orlion/cat-agent/pkg/timex"
 )
 
@@ -73,6 +75,7 @@ type transactionWithDomain struct {
 type TransactionAggregator struct {
 	datas map[string]map[string]*transactionData
 	ch    chan *transactionWithDomain
+	size  int64
 }
 
 func newTransactionAggregator() *TransactionAggregator {
@@ -114,6 +117,7 @@ func (ta *TransactionAggregator) logTransaction(domain string, transaction *mess
 	select {
 	case ta.ch <- &transactionWithDomain{domain, transaction}:
 	default:
+		metrics.AggregatorDropped.WithLabelValues("transaction").Inc()
 		log.Warnf("transaction aggregatro's ch is full, transaction: %s,%s has been discarded", transaction.GetType(), transaction.GetName())
 	}
 }
@@ -134,6 +138,7 @@ func (ta *TransactionAggregator) getOrDefault(domain string, transaction *messag
 			}
 
 			domainData[key] = data
+			atomic.AddInt64(&ta.size, 1)
 		}
 	} else {
 		data = &transactionData{
@@ -146,6 +151,7 @@ func (ta *TransactionAggregator) getOrDefault(domain string, transaction *messag
 		}
 
 		ta.datas[domain] = map[string]*transactionData{key: data}
+		atomic.AddInt64(&ta.size, 1)
 	}
 
 	return
@@ -164,10 +170,15 @@ func (ta *TransactionAggregator) flush() {
 			trans.AddChild(child)
 		}
 
+		messageId, err := CreateMessageId(domain)
+		if err != nil {
+			log.Errorf("transaction aggregator create message id of domain %s error: %s, the aggregated tree has been dropped", domain, err.Error())
+			continue
+		}
+
 		tree := message.NewMessageTree()
 		tree.SetMessage(trans)
 		tree.SetDomain([]byte(domain))
-		messageId := CreateMessageId(domain)
 		tree.SetMessageId(messageId)
 		tree.SetThreadGroupName(config.ThreadGroupNameCatAgent)
 		tree.SetThreadId([]byte(strconv.Itoa(os.Getpid())))
@@ -179,4 +190,10 @@ func (ta *TransactionAggregator) flush() {
 	}
 
 	ta.datas = make(map[string]map[string]*transactionData)
+	atomic.StoreInt64(&ta.size, 0)
+}
+
+// getSize returns the number of transactions waiting for the next flush, it is safe to call from any goroutine.
+func (ta *TransactionAggregator) getSize() int64 {
+	return atomic.LoadInt64(&ta.size)
 }
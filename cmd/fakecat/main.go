@@ -0,0 +1,56 @@
+// Command fakecat runs a fake cat server to try the agent locally: point cat.servers to its http address,
+// the agent sends its trees to its tcp address, and every tree received is printed.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/Orlion/cat-agent/cat/message"
+	"github.com/Orlion/cat-agent/fakecat"
+)
+
+func main() {
+	conf := new(fakecat.Config)
+	var routers string
+	flag.StringVar(&conf.HttpAddr, "http", "127.0.0.1:8080", "the address of the router config, cat.servers of the agent")
+	flag.StringVar(&conf.TcpAddr, "tcp", "127.0.0.1:0", "the address the trees are sent to, a free port is picked by default and printed")
+	flag.StringVar(&conf.Sample, "sample", "1.0", "the sample property")
+	flag.StringVar(&routers, "routers", "", "the routers property, ip:port separated by commas, it defaults to the tcp address")
+	flag.BoolVar(&conf.Block, "block", false, "the block property")
+	flag.Parse()
+
+	if routers != "" {
+		conf.Routers = strings.Split(routers, ",")
+	}
+	conf.OnTree = printTree
+
+	s := fakecat.NewServer(conf)
+	if err := s.ListenAndServe(); err != nil {
+		fmt.Fprintln(os.Stderr, "fakecat listen error: "+err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Printf("fakecat serves the router config on %s and receives the trees on %s\n", s.HttpAddr(), s.TcpAddr())
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
+	<-c
+
+	s.Close()
+	fmt.Printf("fakecat received %d frames, %d trees, %d errors\n", len(s.Frames()), len(s.Trees()), len(s.Errors()))
+}
+
+func printTree(tree *message.MessageTree) {
+	m := tree.GetMessage()
+	if m == nil {
+		fmt.Printf("%s %s\n", tree.GetDomain(), tree.GetMessageId())
+		return
+	}
+
+	fmt.Printf("%s %s %s %s %s\n", tree.GetDomain(), tree.GetMessageId(), m.GetType(), m.GetName(), m.GetStatus())
+}
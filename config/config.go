@@ -4,6 +4,7 @@ import (
 	"errors"
 	"io/ioutil"
 
+	"github.com/Orlion/cat-agent/admin"
 	catconfig "github.com/Orlion/cat-agent/cat/config"
 	"github.com/Orlion/cat-agent/log"
 	"github.com/Orlion/cat-agent/server"
@@ -14,6 +15,7 @@ type Config struct {
 	Cat    *catconfig.Config `yaml:"cat"`
 	Server *server.Config    `yaml:"server"`
 	Log    *log.Config       `yaml:"log"`
+	Admin  *admin.Config     `yaml:"admin"`
 }
 
 func ParseConfig(filename string) (config *Config, err error) {
@@ -0,0 +1,162 @@
+package fakecat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Orlion/cat-agent/cat/message"
+)
+
+// pollInterval is how often the helpers look at the trees received while they wait.
+const pollInterval = 10 * time.Millisecond
+
+// Matcher selects trees for the assertion helpers.
+type Matcher func(tree *message.MessageTree) bool
+
+// Any matches every tree.
+func Any() Matcher {
+	return func(tree *message.MessageTree) bool {
+		return true
+	}
+}
+
+// MessageId matches the tree of messageId.
+func MessageId(messageId string) Matcher {
+	return func(tree *message.MessageTree) bool {
+		return string(tree.GetMessageId()) == messageId
+	}
+}
+
+// RootMessageId matches the trees of the trace of rootMessageId.
+func RootMessageId(rootMessageId string) Matcher {
+	return func(tree *message.MessageTree) bool {
+		return string(tree.GetRootMessageId()) == rootMessageId
+	}
+}
+
+// Domain matches the trees of domain.
+func Domain(domain string) Matcher {
+	return func(tree *message.MessageTree) bool {
+		return string(tree.GetDomain()) == domain
+	}
+}
+
+// HasMessage matches the trees with a message of t and name at any depth.
+func HasMessage(t, name string) Matcher {
+	return func(tree *message.MessageTree) bool {
+		return FindMessage(tree, t, name) != nil
+	}
+}
+
+// All matches the trees matched by every matcher.
+func All(matchers ...Matcher) Matcher {
+	return func(tree *message.MessageTree) bool {
+		for _, match := range matchers {
+			if !match(tree) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// FindMessage returns the first message of t and name of tree in depth first order, nil if there is none.
+func FindMessage(tree *message.MessageTree, t, name string) message.Message {
+	return findMessage(tree.GetMessage(), t, name)
+}
+
+func findMessage(m message.Message, t, name string) message.Message {
+	if m == nil {
+		return nil
+	}
+
+	if m.GetType() == t && m.GetName() == name {
+		return m
+	}
+
+	if trans, ok := m.(*message.Transaction); ok {
+		for _, child := range trans.GetChildren() {
+			if found := findMessage(child, t, name); found != nil {
+				return found
+			}
+		}
+	}
+
+	return nil
+}
+
+// Match returns the trees received so far that match.
+func (s *Server) Match(match Matcher) (trees []*message.MessageTree) {
+	for _, tree := range s.Trees() {
+		if match(tree) {
+			trees = append(trees, tree)
+		}
+	}
+	return
+}
+
+// WaitTrees waits until n trees that match have been received and returns them, t fails if they
+// have not arrived within timeout or if more than n have.
+func (s *Server) WaitTrees(t testing.TB, n int, timeout time.Duration, match Matcher) []*message.MessageTree {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		trees := s.Match(match)
+		if len(trees) > n {
+			t.Fatalf("fakecat received %d trees, expected %d", len(trees), n)
+		}
+		if len(trees) == n {
+			return trees
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("fakecat received %d trees within %s, expected %d", len(trees), timeout, n)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// WaitTree waits for a tree that matches and returns it.
+func (s *Server) WaitTree(t testing.TB, timeout time.Duration, match Matcher) *message.MessageTree {
+	t.Helper()
+
+	return s.WaitTrees(t, 1, timeout, match)[0]
+}
+
+// AssertNoTree fails t if a tree that matches is received within d.
+func (s *Server) AssertNoTree(t testing.TB, d time.Duration, match Matcher) {
+	t.Helper()
+
+	deadline := time.Now().Add(d)
+	for {
+		if trees := s.Match(match); len(trees) > 0 {
+			t.Fatalf("fakecat received %d trees, expected none, the first is %s", len(trees), trees[0].GetMessageId())
+		}
+		if time.Now().After(deadline) {
+			return
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// AssertNoErrors fails t if a frame could not be decoded.
+func (s *Server) AssertNoErrors(t testing.TB) {
+	t.Helper()
+
+	if errs := s.Errors(); len(errs) > 0 {
+		t.Fatalf("fakecat got %d errors, the first is: %s", len(errs), errs[0])
+	}
+}
+
+// WaitRouterPulls waits until the router config has been pulled n times at least.
+func (s *Server) WaitRouterPulls(t testing.TB, n int, timeout time.Duration) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for s.RouterPulls() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("fakecat served %d router pulls within %s, expected %d", s.RouterPulls(), timeout, n)
+		}
+		time.Sleep(pollInterval)
+	}
+}
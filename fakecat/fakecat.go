@@ -0,0 +1,323 @@
+// Package fakecat is a fake cat server for the end to end tests of the agent. It serves the router config
+// of /cat/s/router like the cat servers, and it is the router the agent sends its trees to: the NT1 frames
+// are decoded and kept in memory so that the tests can assert on them.
+package fakecat
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Orlion/cat-agent/cat/config"
+	"github.com/Orlion/cat-agent/cat/encoder"
+	"github.com/Orlion/cat-agent/cat/message"
+)
+
+// MaxFrameBytes is the largest frame accepted from the agent.
+const MaxFrameBytes = 16 << 20
+
+type Config struct {
+	// HttpAddr is the address of the router config, it defaults to 127.0.0.1:0.
+	HttpAddr string
+	// TcpAddr is the address the trees are sent to, it defaults to 127.0.0.1:0.
+	TcpAddr string
+	// Sample is the sample property, it defaults to 1.0.
+	Sample string
+	// Routers is the routers property, it defaults to the tcp address of the server.
+	Routers []string
+	// Block is the block property, the agent stops sending trees while it is true.
+	Block bool
+	// OnTree is called with every tree received, it must not block.
+	OnTree func(tree *message.MessageTree)
+}
+
+func withDefaultConf(config *Config) {
+	if config.HttpAddr == "" {
+		config.HttpAddr = "127.0.0.1:0"
+	}
+
+	if config.TcpAddr == "" {
+		config.TcpAddr = "127.0.0.1:0"
+	}
+
+	if config.Sample == "" {
+		config.Sample = "1.0"
+	}
+}
+
+type Server struct {
+	httpAddr string
+	tcpAddr  string
+	onTree   func(tree *message.MessageTree)
+
+	httpListener net.Listener
+	httpSrv      *http.Server
+	tcpListener  net.Listener
+
+	mu          sync.Mutex
+	sample      string
+	routers     []string
+	block       bool
+	routerPulls int
+	frames      [][]byte
+	trees       []*message.MessageTree
+	errs        []error
+	conns       map[net.Conn]struct{}
+	closed      bool
+}
+
+func NewServer(config *Config) *Server {
+	withDefaultConf(config)
+
+	s := &Server{
+		httpAddr: config.HttpAddr,
+		tcpAddr:  config.TcpAddr,
+		onTree:   config.OnTree,
+		sample:   config.Sample,
+		routers:  config.Routers,
+		block:    config.Block,
+		conns:    make(map[net.Conn]struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/cat/s/router", s)
+	s.httpSrv = &http.Server{Handler: mux}
+
+	return s
+}
+
+// ListenAndServe listens to the addresses of the config and serves them in the background.
+func (s *Server) ListenAndServe() (err error) {
+	if s.tcpListener, err = net.Listen("tcp", s.tcpAddr); err != nil {
+		return
+	}
+
+	if s.httpListener, err = net.Listen("tcp", s.httpAddr); err != nil {
+		s.tcpListener.Close()
+		return
+	}
+
+	s.mu.Lock()
+	if len(s.routers) == 0 {
+		s.routers = []string{s.TcpAddr()}
+	}
+	s.mu.Unlock()
+
+	go s.httpSrv.Serve(s.httpListener)
+	go s.serveTcp()
+
+	return nil
+}
+
+// HttpAddr is the address to put in cat.servers.
+func (s *Server) HttpAddr() string {
+	return s.httpListener.Addr().String()
+}
+
+// TcpAddr is the address of the router of the server.
+func (s *Server) TcpAddr() string {
+	return s.tcpListener.Addr().String()
+}
+
+// SetSample changes the sample property, the agent takes it on its next router pull.
+func (s *Server) SetSample(sample string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sample = sample
+}
+
+// SetRouters changes the routers property, the agent takes it on its next router pull.
+func (s *Server) SetRouters(routers ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.routers = routers
+}
+
+// SetBlock changes the block property, the agent takes it on its next router pull.
+func (s *Server) SetBlock(block bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.block = block
+}
+
+// ServeHTTP answers the router pulls of the agent with the sample, routers and block properties.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.routerPulls++
+	properties := routerConfigXML{
+		Properties: []routerConfigXMLProperty{
+			{Id: "sample", Value: s.sample},
+			{Id: "routers", Value: strings.Join(s.routers, ";") + ";"},
+			{Id: "block", Value: strconv.FormatBool(s.block)},
+		},
+	}
+	s.mu.Unlock()
+
+	b, err := xml.Marshal(properties)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Write(b)
+}
+
+type routerConfigXMLProperty struct {
+	XMLName xml.Name `xml:"property"`
+	Id      string   `xml:"id,attr"`
+	Value   string   `xml:"value,attr"`
+}
+
+type routerConfigXML struct {
+	XMLName    xml.Name                  `xml:"property-config"`
+	Properties []routerConfigXMLProperty `xml:"property"`
+}
+
+func (s *Server) serveTcp() {
+	for {
+		conn, err := s.tcpListener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn reads the frames of a connection of the agent: a big endian uint32 length followed by the tree.
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	bufr := bufio.NewReader(conn)
+	header := make([]byte, 4)
+	decoder := encoder.NewBinaryDecoder()
+
+	for {
+		// the agent drops its connections whenever it likes, a read error is not an error of the agent.
+		if _, err := io.ReadFull(bufr, header); err != nil {
+			return
+		}
+
+		length := binary.BigEndian.Uint32(header)
+		if length > MaxFrameBytes {
+			s.addError(fmt.Errorf("frame of %d bytes is larger than %d bytes", length, MaxFrameBytes))
+			return
+		}
+
+		frame := make([]byte, length)
+		if _, err := io.ReadFull(bufr, frame); err != nil {
+			return
+		}
+
+		s.addFrame(decoder, frame)
+	}
+}
+
+// addFrame keeps frame, and the tree it decodes to if it is NT1. The frames in another format are only kept.
+func (s *Server) addFrame(decoder *encoder.BinaryDecoder, frame []byte) {
+	var tree *message.MessageTree
+	var err error
+	if bytes.HasPrefix(frame, config.BinaryProtocol) {
+		tree, err = decoder.DecodeMessageTree(frame)
+	}
+
+	s.mu.Lock()
+	s.frames = append(s.frames, frame)
+	if err != nil {
+		s.errs = append(s.errs, err)
+	} else if tree != nil {
+		s.trees = append(s.trees, tree)
+	}
+	s.mu.Unlock()
+
+	if tree != nil && s.onTree != nil {
+		s.onTree(tree)
+	}
+}
+
+func (s *Server) addError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.errs = append(s.errs, err)
+}
+
+// RouterPulls returns the number of router config requests served.
+func (s *Server) RouterPulls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.routerPulls
+}
+
+// Frames returns the frames received, in every format.
+func (s *Server) Frames() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([][]byte(nil), s.frames...)
+}
+
+// Trees returns the trees decoded from the NT1 frames, in the order they have been received.
+func (s *Server) Trees() []*message.MessageTree {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*message.MessageTree(nil), s.trees...)
+}
+
+// Errors returns the errors of the NT1 frames that could not be decoded and of the frames too large.
+func (s *Server) Errors() []error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]error(nil), s.errs...)
+}
+
+// Reset forgets the frames, trees, errors and router pulls received so far.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.routerPulls = 0
+	s.frames, s.trees, s.errs = nil, nil, nil
+}
+
+// Close stops both listeners and closes the connections of the agent.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.tcpListener.Close()
+	return s.httpSrv.Close()
+}
@@ -0,0 +1,118 @@
+package fakecat_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Orlion/cat-agent/cat"
+	"github.com/Orlion/cat-agent/cat/config"
+	"github.com/Orlion/cat-agent/fakecat"
+	"github.com/Orlion/cat-agent/handler"
+	"github.com/Orlion/cat-agent/log"
+	"github.com/Orlion/cat-agent/server"
+)
+
+func init() {
+	log.Init(&log.Config{
+		StdoutLevel: "error",
+	})
+}
+
+func TestRouterConfig(t *testing.T) {
+	s := fakecat.NewServer(&fakecat.Config{Sample: "0.5", Routers: []string{"127.0.0.1:2280", "127.0.0.2:2280"}, Block: true})
+	if err := s.ListenAndServe(); err != nil {
+		t.Fatalf("listen error: %s", err)
+	}
+	defer s.Close()
+
+	resp, err := http.Get("http://" + s.HttpAddr() + "/cat/s/router?domain=demo&op=xml")
+	if err != nil {
+		t.Fatalf("get router config error: %s", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	expected := `<property-config><property id="sample" value="0.5"></property><property id="routers" value="127.0.0.1:2280;127.0.0.2:2280;"></property><property id="block" value="true"></property></property-config>`
+	if string(b) != expected {
+		t.Fatalf("router config: %s, expected: %s", b, expected)
+	}
+
+	if pulls := s.RouterPulls(); pulls != 1 {
+		t.Fatalf("router pulls: %d, expected 1", pulls)
+	}
+}
+
+// TestAgent sends a tree to the unix socket of an agent whose cat server is fakecat, and finds it on the wire.
+func TestAgent(t *testing.T) {
+	s := fakecat.NewServer(&fakecat.Config{})
+	if err := s.ListenAndServe(); err != nil {
+		t.Fatalf("listen error: %s", err)
+	}
+	defer s.Close()
+
+	if err := cat.Init(&config.Config{Domain: "fakecat", Servers: []string{s.HttpAddr()}}); err != nil {
+		t.Fatalf("cat.Init error: %s", err)
+	}
+	defer cat.Shutdown()
+
+	s.WaitRouterPulls(t, 1, time.Second)
+
+	sock := filepath.Join(t.TempDir(), "cat-agent.sock")
+	srv := server.NewServer(&server.Config{Addr: "unix://" + sock})
+	srv.Handle(server.CmdSendMessageJson, handler.SendMessageJson)
+	if err := srv.ListenAndServe(); err != nil {
+		t.Fatalf("agent listen error: %s", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("dial agent error: %s", err)
+	}
+	defer conn.Close()
+
+	body := `{"domain": "fakecat", "message": {"kind": "transaction", "type": "URL", "name": "/order", "status": "0", "duration": 1500,` +
+		` "children": [{"kind": "event", "type": "SQL", "name": "select", "status": "0", "data": "select 1"}]}}`
+	req := make([]byte, server.ReqHeaderLen, server.ReqHeaderLen+len(body))
+	binary.BigEndian.PutUint32(req, uint32(server.CmdSendMessageJson))
+	binary.BigEndian.PutUint32(req[4:], uint32(server.ReqHeaderLen+len(body)))
+	if _, err = conn.Write(append(req, body...)); err != nil {
+		t.Fatalf("write request error: %s", err)
+	}
+
+	bufr := bufio.NewReader(conn)
+	header := make([]byte, server.RespHeaderLen)
+	if _, err = io.ReadFull(bufr, header); err != nil {
+		t.Fatalf("read response error: %s", err)
+	}
+	messageId := make([]byte, binary.BigEndian.Uint32(header[4:])-server.RespHeaderLen)
+	if _, err = io.ReadFull(bufr, messageId); err != nil {
+		t.Fatalf("read response error: %s", err)
+	}
+	if status := server.Status(binary.BigEndian.Uint32(header)); status != server.StatusOk {
+		t.Fatalf("status: %s, payload: %s", status, messageId)
+	}
+
+	tree := s.WaitTree(t, 5*time.Second, fakecat.All(fakecat.MessageId(string(messageId)), fakecat.HasMessage("SQL", "select")))
+	if !strings.HasPrefix(string(tree.GetMessageId()), "fakecat-") {
+		t.Fatalf("messageId: %s", tree.GetMessageId())
+	}
+	if data := fakecat.FindMessage(tree, "SQL", "select").GetData(); data != "select 1" {
+		t.Fatalf("data: %s, expected: select 1", data)
+	}
+
+	s.AssertNoErrors(t)
+}
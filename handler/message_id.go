@@ -1,7 +1,13 @@
 package handler
 
 import (
+	"bytes"
+	"errors"
+	"strconv"
+
 	"github.com/Orlion/cat-agent/cat"
+	"github.com/Orlion/cat-agent/cat/config"
+	"github.com/Orlion/cat-agent/log"
 	"github.com/Orlion/cat-agent/server"
 )
 
@@ -11,7 +17,47 @@ func CreateMessageId(req *server.Request) (status server.Status, payload []byte)
 		return
 	}
 
-	payload = []byte(cat.CreateMessageId(string(req.Body)))
+	messageId, err := cat.CreateMessageId(string(req.Body))
+	if errors.Is(err, cat.ErrBadDomain) {
+		status = server.StatusBadDomain
+		return
+	}
+	if err != nil {
+		log.Errorf("create message id handler error: %s", err.Error())
+		status = server.StatusMessageIdErr
+		return
+	}
+
+	payload = messageId
+
+	return
+}
+
+func CreateMessageIds(req *server.Request) (status server.Status, payload []byte) {
+	i := bytes.IndexByte(req.Body, Tab)
+	if i < 1 {
+		status = server.StatusBadDomain
+		return
+	}
+
+	n, err := strconv.Atoi(string(req.Body[i+1:]))
+	if err != nil || n < 1 || n > config.MaxBatchMessageIdCount {
+		status = server.StatusBadCount
+		return
+	}
+
+	messageIds, err := cat.CreateMessageIds(string(req.Body[:i]), n)
+	if errors.Is(err, cat.ErrBadDomain) {
+		status = server.StatusBadDomain
+		return
+	}
+	if err != nil {
+		log.Errorf("create message ids handler error: %s", err.Error())
+		status = server.StatusMessageIdErr
+		return
+	}
+
+	payload = bytes.Join(messageIds, []byte{Lf})
 
 	return
 }
@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Orlion/cat-agent/cat/message"
+	"github.com/Orlion/cat-agent/pkg/dsx"
+)
+
+// messageTreeBuilder assembles the messages read from a body into its tree, whatever the format of the body.
+type messageTreeBuilder struct {
+	tree  *message.MessageTree
+	root  message.Message
+	stack *dsx.TransactionStack
+	// the traces over maxTraceCount or maxTraceBytes are dropped, 0 means no cap.
+	maxTraceCount int
+	maxTraceBytes int
+	traceCount    int
+	traceBytes    int
+	droppedTraces int
+}
+
+func newMessageTreeBuilder() messageTreeBuilder {
+	return messageTreeBuilder{
+		tree:  message.NewMessageTree(),
+		stack: dsx.NewTransactionStack(),
+	}
+}
+
+// add puts msg of type t in the tree, t is the type of its line in the text format.
+func (b *messageTreeBuilder) add(t byte, msg message.Message) error {
+	switch t {
+	case Typet:
+		if trans := b.stack.Peek(); trans != nil {
+			trans.AddChild(msg)
+		}
+		b.stack.Push(msg.(*message.Transaction))
+	case TypeT:
+		if trans := b.stack.Pop(); trans == nil {
+			return errors.New("transaction are not a pair")
+		} else if trans.GetType() != msg.GetType() || trans.GetName() != msg.GetName() {
+			return errors.New("transaction are not a pair")
+		} else {
+			b.root = trans
+		}
+	case TypeL:
+		if !b.acceptTrace(msg) {
+			return nil
+		}
+		fallthrough
+	case TypeA, TypeE, TypeM, TypeH:
+		if trans := b.stack.Peek(); trans != nil {
+			trans.AddChild(msg)
+		}
+		b.root = msg
+	default:
+		return errors.New("unknown type: " + string(t))
+	}
+
+	// heartbeats are always sent as they are, they are never sampled out or aggregated.
+	if t == TypeH || !msg.IsSuccess() {
+		b.tree.SetDiscard(false)
+	}
+
+	return nil
+}
+
+// finish sets the message of the tree once every message has been added.
+func (b *messageTreeBuilder) finish() error {
+	if !b.stack.IsEmpty() {
+		return errors.New("transaction is not closed")
+	}
+
+	if b.root == nil {
+		return errors.New("body has no message")
+	}
+
+	b.tree.SetMessage(b.root)
+
+	return nil
+}
+
+// newMessage creates the message of a line of type t, durationInMicros is only used by transactions.
+func newMessage(t byte, mtype, name, status, data string, timestampInMillis, durationInMicros int64) (message.Message, error) {
+	switch t {
+	case Typet, TypeT, TypeA:
+		return message.NewTransaction(mtype, name, status, data, timestampInMillis, nil, durationInMicros), nil
+	case TypeE:
+		return message.NewEvent(mtype, name, status, data, timestampInMillis), nil
+	case TypeL:
+		return message.NewTrace(mtype, name, status, data, timestampInMillis), nil
+	case TypeH:
+		return message.NewHeartbeat(mtype, name, status, data, timestampInMillis), nil
+	case TypeM:
+		return message.NewMetric(mtype, name, status, data, timestampInMillis), nil
+	default:
+		return nil, fmt.Errorf("unknown type: %s", string(t))
+	}
+}
+
+// acceptTrace counts trace against the per tree caps, it reports whether the trace fits.
+func (b *messageTreeBuilder) acceptTrace(trace message.Message) bool {
+	size := len(trace.GetType()) + len(trace.GetName()) + len(trace.GetData())
+	if (b.maxTraceCount > 0 && b.traceCount >= b.maxTraceCount) || (b.maxTraceBytes > 0 && b.traceBytes+size > b.maxTraceBytes) {
+		b.droppedTraces++
+		return false
+	}
+
+	b.traceCount++
+	b.traceBytes += size
+
+	return true
+}
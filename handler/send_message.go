@@ -1,20 +1,23 @@
 package handler
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"strconv"
 
 	"github.com/Orlion/cat-agent/cat"
+	"github.com/Orlion/cat-agent/cat/config"
 	"github.com/Orlion/cat-agent/cat/message"
 	"github.com/Orlion/cat-agent/log"
-	"github.com/Orlion/cat-agent/pkg/dsx"
+	"github.com/Orlion/cat-agent/metrics"
 	"github.com/Orlion/cat-agent/server"
 )
 
 var (
-	errBodyEof = errors.New("body eof")
-	errBodyEnd = errors.New("body end")
+	errBodyEof   = errors.New("body eof")
+	errBodyEnd   = errors.New("body end")
+	errBadEscape = errors.New("bad escape sequence")
 )
 
 const (
@@ -24,24 +27,62 @@ const (
 	Typet byte = 't'
 	TypeT byte = 'T'
 	TypeE byte = 'E'
+	TypeM byte = 'M'
+	TypeH byte = 'H'
+	TypeL byte = 'L'
+
+	// Backslash starts an escape sequence in the body of a request with server.CmdFlagEscaped,
+	// \\, \t, \n and \r stand for a backslash, a tab, a newline and a carriage return.
+	Backslash byte = '\\'
 )
 
 func SendMessage(req *server.Request) (status server.Status, payload []byte) {
-	// read header
-	r := &messageTreeReader{
-		len:  len(req.Body),
-		body: req.Body,
-		tree: message.NewMessageTree(),
+	r := newMessageTreeReader(req.Body, req.Escaped)
+	status, _, _ = sendMessage(r, &r.messageTreeBuilder)
+	return
+}
+
+// SendMessageAck answers the client with the parse status, the payload is the error message if the body
+// is malformed, otherwise it is the big endian uint32 cat.SendResult of the tree.
+func SendMessageAck(req *server.Request) (status server.Status, payload []byte) {
+	r := newMessageTreeReader(req.Body, req.Escaped)
+	status, result, err := sendMessage(r, &r.messageTreeBuilder)
+	if err != nil {
+		payload = []byte(err.Error())
+		return
 	}
 
-	err := r.readHeader()
+	payload = make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(result))
+
+	return
+}
+
+// messageReader reads a tree from a request body in one of the body formats.
+type messageReader interface {
+	readHeader() error
+	readMessage() error
+}
+
+// sendMessage reads a tree with r and sends it, b is the builder r adds the messages it reads to.
+func sendMessage(r messageReader, b *messageTreeBuilder) (status server.Status, result cat.SendResult, err error) {
+	// read header
+	err = r.readHeader()
+	if errors.Is(err, cat.ErrMessageIdUnavailable) {
+		log.Errorf("send message handler create message id error: %s", err.Error())
+		status = server.StatusMessageIdErr
+		return
+	}
 	if err != nil {
 		log.Errorf("send message handler read header error: %s", err.Error())
 		status = server.StatusMsgReadHeaderErr
 		return
 	}
 
-	log.Debugf("read header, domain: %s, threadGroupName: %s, threadId: %s, threadName: %s, messageId: %s, parentMessageId: %s, rootMessageId: %s", r.tree.GetDomain(), r.tree.GetThreadGroupName(), r.tree.GetThreadId(), r.tree.GetThreadName(), r.tree.GetMessageId(), r.tree.GetParentMessageId(), r.tree.GetRootMessageId())
+	log.Debugf("read header, domain: %s, threadGroupName: %s, threadId: %s, threadName: %s, messageId: %s, parentMessageId: %s, rootMessageId: %s", b.tree.GetDomain(), b.tree.GetThreadGroupName(), b.tree.GetThreadId(), b.tree.GetThreadName(), b.tree.GetMessageId(), b.tree.GetParentMessageId(), b.tree.GetRootMessageId())
+
+	b.maxTraceCount = config.GetInstance().GetTraceMaxCountPerTree()
+	b.maxTraceBytes = config.GetInstance().GetTraceMaxBytesPerTree()
 
 	err = r.readMessage()
 	if err != nil {
@@ -50,16 +91,32 @@ func SendMessage(req *server.Request) (status server.Status, payload []byte) {
 		return
 	}
 
-	cat.Send(r.tree)
+	if b.droppedTraces > 0 {
+		metrics.TracesDropped.Add(uint64(b.droppedTraces))
+		log.Debugf("send message handler dropped %d traces of messageId: %s over the per tree cap", b.droppedTraces, b.tree.GetMessageId())
+	}
+
+	result = cat.Send(b.tree)
 
 	return
 }
 
 type messageTreeReader struct {
+	messageTreeBuilder
 	i    int
 	len  int
 	body []byte
-	tree *message.MessageTree
+	// escaped is set if the elements of body use backslash escapes.
+	escaped bool
+}
+
+func newMessageTreeReader(body []byte, escaped bool) *messageTreeReader {
+	return &messageTreeReader{
+		messageTreeBuilder: newMessageTreeBuilder(),
+		len:                len(body),
+		body:               body,
+		escaped:            escaped,
+	}
 }
 
 func (r *messageTreeReader) readHeader() error {
@@ -90,11 +147,12 @@ func (r *messageTreeReader) readHeader() error {
 	if err != nil {
 		return err
 	}
-	if len(messageId) > 0 {
-		r.tree.SetMessageId(messageId)
-	} else {
-		r.tree.SetMessageId(cat.CreateMessageId(string(domain)))
+	if len(messageId) == 0 {
+		if messageId, err = cat.CreateMessageId(string(domain)); err != nil {
+			return err
+		}
 	}
+	r.tree.SetMessageId(messageId)
 
 	parentMessageId, err := r.readElement()
 	if err != nil {
@@ -103,6 +161,9 @@ func (r *messageTreeReader) readHeader() error {
 	r.tree.SetParentMessageId(parentMessageId)
 
 	rootMessageId, err := r.readElement()
+	if err == errBadEscape {
+		return err
+	}
 	if err == errBodyEnd {
 		err = nil
 	}
@@ -111,57 +172,19 @@ func (r *messageTreeReader) readHeader() error {
 	return nil
 }
 
-func (r *messageTreeReader) readMessage() (err error) {
-	var (
-		root  message.Message
-		msg   message.Message
-		stack = dsx.NewTransactionStack()
-		t     byte
-	)
-
-Loop:
+func (r *messageTreeReader) readMessage() error {
 	for {
-		t, msg, err = r.readMessageLine()
-		if err != nil {
-			break Loop
+		t, msg, err := r.readMessageLine()
+		if err == errBodyEof {
+			return r.finish()
+		} else if err != nil {
+			return err
 		}
-		switch t {
-		case Typet:
-			if trans := stack.Peek(); trans != nil {
-				stack.Peek().AddChild(msg)
-			}
-			stack.Push(msg.(*message.Transaction))
-		case TypeT:
-			if trans := stack.Pop(); trans == nil {
-				err = errors.New("transaction are not a pair")
-				break Loop
-			} else if trans.GetType() != msg.GetType() || trans.GetName() != msg.GetName() {
-				err = errors.New("transaction are not a pair")
-				break Loop
-			} else {
-				root = trans
-			}
-		case TypeA:
-			fallthrough
-		case TypeE:
-			if trans := stack.Peek(); trans != nil {
-				stack.Peek().AddChild(msg)
-			}
-			root = msg
-		}
-		if msg.GetStatus() != message.SUCCESS {
-			r.tree.SetDiscard(false)
-		}
-	}
 
-	if err == nil {
-		err = errors.New("body not eof")
-	} else if err == errBodyEof && stack.IsEmpty() {
-		err = nil
-		r.tree.SetMessage(root)
+		if err = r.add(t, msg); err != nil {
+			return err
+		}
 	}
-
-	return
 }
 
 func (r *messageTreeReader) readMessageLine() (t byte, msg message.Message, err error) {
@@ -207,22 +230,17 @@ func (r *messageTreeReader) readMessageLine() (t byte, msg message.Message, err
 	data, err := r.readElement()
 	if err == errBodyEnd {
 		err = nil
+	} else if err != nil {
+		return
 	}
 
-	switch t {
-	case Typet:
-		fallthrough
-	case TypeT:
-		fallthrough
-	case TypeA:
-		durationInMicrosInt64, _ := strconv.ParseInt(string(durationInMicros), 10, 64)
-		msg = message.NewTransaction(string(mtype), string(name), string(status), string(data), timestampInMillisInt64, nil, durationInMicrosInt64)
-	case TypeE:
-		msg = message.NewEvent(string(mtype), string(name), string(status), string(data), timestampInMillisInt64)
-	default:
-		err = fmt.Errorf("unknown type: %s", string(t))
+	var durationInMicrosInt64 int64
+	if t == Typet || t == TypeT || t == TypeA {
+		durationInMicrosInt64, _ = strconv.ParseInt(string(durationInMicros), 10, 64)
 	}
 
+	msg, err = newMessage(t, string(mtype), string(name), string(status), string(data), timestampInMillisInt64, durationInMicrosInt64)
+
 	return
 }
 
@@ -242,6 +260,28 @@ func (r *messageTreeReader) readElement() (b []byte, err error) {
 		if r.body[r.i] == Tab {
 			break
 		}
+		if r.escaped && r.body[r.i] == Backslash {
+			r.i++
+			if r.i >= r.len {
+				err = errBadEscape
+				return
+			}
+			switch r.body[r.i] {
+			case Backslash:
+				b = append(b, Backslash)
+			case 't':
+				b = append(b, Tab)
+			case 'n':
+				b = append(b, Lf)
+			case 'r':
+				b = append(b, '\r')
+			default:
+				err = errBadEscape
+				return
+			}
+			r.i++
+			continue
+		}
 		b = append(b, r.body[r.i])
 		r.i++
 	}
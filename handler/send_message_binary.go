@@ -0,0 +1,170 @@
+package handler
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/Orlion/cat-agent/cat"
+	"github.com/Orlion/cat-agent/server"
+)
+
+var errBinaryBodyShort = errors.New("binary body is too short")
+
+// SendMessageBinary reads a tree in the binary body format of server.CmdSendMessageBinary, it is not answered.
+//
+// The body carries the same fields as the text format, integers are big endian and every string is a
+// uint32 length followed by its bytes, so php can build the body with pack("N", ...) and pack("J", ...):
+//
+//	header:  domain, threadGroupName, threadId, threadName, messageId, parentMessageId and rootMessageId strings.
+//	message: the type byte of the text line, uint64 timestampInMillis, uint64 durationInMicros,
+//	         then the type, name, status and data strings.
+//
+// The messages follow the header until the end of the body, an empty messageId is replaced by a new one.
+func SendMessageBinary(req *server.Request) (status server.Status, payload []byte) {
+	r := newBinaryMessageTreeReader(req.Body)
+	status, _, _ = sendMessage(r, &r.messageTreeBuilder)
+	return
+}
+
+type binaryMessageTreeReader struct {
+	messageTreeBuilder
+	i    int
+	body []byte
+	// s is body as a string, the strings of the messages are sliced from it instead of being copied one by one.
+	s string
+}
+
+func newBinaryMessageTreeReader(body []byte) *binaryMessageTreeReader {
+	return &binaryMessageTreeReader{
+		messageTreeBuilder: newMessageTreeBuilder(),
+		body:               body,
+		s:                  string(body),
+	}
+}
+
+func (r *binaryMessageTreeReader) readHeader() error {
+	domain, err := r.readBytes()
+	if err != nil {
+		return err
+	}
+	r.tree.SetDomain(domain)
+
+	threadGroupName, err := r.readBytes()
+	if err != nil {
+		return err
+	}
+	r.tree.SetThreadGroupName(threadGroupName)
+
+	threadId, err := r.readBytes()
+	if err != nil {
+		return err
+	}
+	r.tree.SetThreadId(threadId)
+
+	threadName, err := r.readBytes()
+	if err != nil {
+		return err
+	}
+	r.tree.SetThreadName(threadName)
+
+	messageId, err := r.readBytes()
+	if err != nil {
+		return err
+	}
+	if len(messageId) == 0 {
+		if messageId, err = cat.CreateMessageId(string(domain)); err != nil {
+			return err
+		}
+	}
+	r.tree.SetMessageId(messageId)
+
+	parentMessageId, err := r.readBytes()
+	if err != nil {
+		return err
+	}
+	r.tree.SetParentMessageId(parentMessageId)
+
+	rootMessageId, err := r.readBytes()
+	if err != nil {
+		return err
+	}
+	r.tree.SetRootMessageId(rootMessageId)
+
+	return nil
+}
+
+func (r *binaryMessageTreeReader) readMessage() error {
+	for r.i < len(r.body) {
+		t := r.body[r.i]
+		r.i++
+
+		timestampInMillis, err := r.readUint64()
+		if err != nil {
+			return err
+		}
+
+		durationInMicros, err := r.readUint64()
+		if err != nil {
+			return err
+		}
+
+		var fields [4]string
+		for i := range fields {
+			if fields[i], err = r.readString(); err != nil {
+				return err
+			}
+		}
+
+		msg, err := newMessage(t, fields[0], fields[1], fields[2], fields[3], int64(timestampInMillis), int64(durationInMicros))
+		if err != nil {
+			return err
+		}
+
+		if err = r.add(t, msg); err != nil {
+			return err
+		}
+	}
+
+	return r.finish()
+}
+
+func (r *binaryMessageTreeReader) readUint64() (uint64, error) {
+	if len(r.body)-r.i < 8 {
+		return 0, errBinaryBodyShort
+	}
+	v := binary.BigEndian.Uint64(r.body[r.i:])
+	r.i += 8
+	return v, nil
+}
+
+// readLen reads the length of a string and returns its bounds in the body.
+func (r *binaryMessageTreeReader) readLen() (start, end int, err error) {
+	if len(r.body)-r.i < 4 {
+		return 0, 0, errBinaryBodyShort
+	}
+	n := binary.BigEndian.Uint32(r.body[r.i:])
+	r.i += 4
+	if uint64(n) > uint64(len(r.body)-r.i) {
+		return 0, 0, errBinaryBodyShort
+	}
+	start, end = r.i, r.i+int(n)
+	r.i = end
+	return
+}
+
+func (r *binaryMessageTreeReader) readBytes() ([]byte, error) {
+	start, end, err := r.readLen()
+	if err != nil {
+		return nil, err
+	}
+	// the capacity is limited, so appending to an element never overwrites the rest of the body.
+	return r.body[start:end:end], nil
+}
+
+func (r *binaryMessageTreeReader) readString() (string, error) {
+	start, end, err := r.readLen()
+	if err != nil {
+		return "", err
+	}
+	return r.s[start:end], nil
+}
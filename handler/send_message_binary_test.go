@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Orlion/cat-agent/cat/message"
+)
+
+var testHeader = []string{"domain", "group", "1", "thread", "domain-7f000001-447323-1", "", "domain-7f000001-447323-0"}
+
+type testLine struct {
+	t                   byte
+	mtype, name, status string
+	timestamp, duration int64
+	data                string
+}
+
+func testLines(events int) []testLine {
+	lines := []testLine{{Typet, "URL", "/order", "0", 1600000000000, 0, ""}}
+	for i := 0; i < events; i++ {
+		lines = append(lines, testLine{TypeE, "SQL", "select", "0", 1600000000000 + int64(i), 0, fmt.Sprintf("select * from order where id = %d", i)})
+	}
+	lines = append(lines, testLine{TypeM, "", "order.count", message.MetricCount, 1600000000000, 0, "1"})
+	lines = append(lines, testLine{TypeT, "URL", "/order", "0", 1600000000100, 100000, ""})
+	return lines
+}
+
+func textBody(header []string, lines []testLine) []byte {
+	buf := new(strings.Builder)
+	buf.WriteString(strings.Join(header, "\t"))
+	buf.WriteByte(Lf)
+	for _, l := range lines {
+		duration := ""
+		if l.duration != 0 {
+			duration = strconv.FormatInt(l.duration, 10)
+		}
+		buf.WriteString(strings.Join([]string{string(l.t), l.mtype, l.name, l.status, strconv.FormatInt(l.timestamp, 10), duration, l.data}, "\t"))
+		buf.WriteByte(Lf)
+	}
+	return []byte(buf.String())
+}
+
+func appendBinaryString(b []byte, s string) []byte {
+	n := make([]byte, 4)
+	binary.BigEndian.PutUint32(n, uint32(len(s)))
+	return append(append(b, n...), s...)
+}
+
+func appendBinaryUint64(b []byte, v uint64) []byte {
+	n := make([]byte, 8)
+	binary.BigEndian.PutUint64(n, v)
+	return append(b, n...)
+}
+
+func binaryBody(header []string, lines []testLine) []byte {
+	var b []byte
+	for _, field := range header {
+		b = appendBinaryString(b, field)
+	}
+	for _, l := range lines {
+		b = append(b, l.t)
+		b = appendBinaryUint64(b, uint64(l.timestamp))
+		b = appendBinaryUint64(b, uint64(l.duration))
+		for _, s := range []string{l.mtype, l.name, l.status, l.data} {
+			b = appendBinaryString(b, s)
+		}
+	}
+	return b
+}
+
+func assertSameMessage(t *testing.T, expected, actual message.Message) {
+	if fmt.Sprintf("%T", expected) != fmt.Sprintf("%T", actual) ||
+		expected.GetType() != actual.GetType() ||
+		expected.GetName() != actual.GetName() ||
+		expected.GetStatus() != actual.GetStatus() ||
+		expected.GetData() != actual.GetData() ||
+		expected.GetTimestamp() != actual.GetTimestamp() {
+		t.Fatalf("message: %+v, expected: %+v", actual, expected)
+	}
+
+	if trans, ok := expected.(*message.Transaction); ok {
+		actualTrans := actual.(*message.Transaction)
+		if len(trans.GetChildren()) != len(actualTrans.GetChildren()) {
+			t.Fatalf("%d children, expected %d", len(actualTrans.GetChildren()), len(trans.GetChildren()))
+		}
+		for i, child := range trans.GetChildren() {
+			assertSameMessage(t, child, actualTrans.GetChildren()[i])
+		}
+	}
+}
+
+func TestBinaryMessageTreeReader(t *testing.T) {
+	lines := testLines(3)
+
+	text := newMessageTreeReader(textBody(testHeader, lines), false)
+	if err := text.readHeader(); err != nil {
+		t.Fatalf("text readHeader error: %s", err)
+	}
+	if err := text.readMessage(); err != nil {
+		t.Fatalf("text readMessage error: %s", err)
+	}
+
+	r := newBinaryMessageTreeReader(binaryBody(testHeader, lines))
+	if err := r.readHeader(); err != nil {
+		t.Fatalf("binary readHeader error: %s", err)
+	}
+	if err := r.readMessage(); err != nil {
+		t.Fatalf("binary readMessage error: %s", err)
+	}
+
+	for i, field := range [][2][]byte{
+		{text.tree.GetDomain(), r.tree.GetDomain()},
+		{text.tree.GetThreadGroupName(), r.tree.GetThreadGroupName()},
+		{text.tree.GetThreadId(), r.tree.GetThreadId()},
+		{text.tree.GetThreadName(), r.tree.GetThreadName()},
+		{text.tree.GetMessageId(), r.tree.GetMessageId()},
+		{text.tree.GetParentMessageId(), r.tree.GetParentMessageId()},
+		{text.tree.GetRootMessageId(), r.tree.GetRootMessageId()},
+	} {
+		if string(field[0]) != string(field[1]) {
+			t.Fatalf("header field %d: %s, expected: %s", i, field[1], field[0])
+		}
+	}
+
+	assertSameMessage(t, text.tree.GetMessage(), r.tree.GetMessage())
+	expected := text.tree.GetMessage().(*message.Transaction).GetDurationInMicros()
+	if duration := r.tree.GetMessage().(*message.Transaction).GetDurationInMicros(); duration != expected {
+		t.Fatalf("duration: %d, expected: %d", duration, expected)
+	}
+}
+
+func TestBinaryMessageTreeReaderMalformed(t *testing.T) {
+	body := binaryBody(testHeader, testLines(1))
+
+	for i := 0; i < len(body); i++ {
+		r := newBinaryMessageTreeReader(body[:i])
+		err := r.readHeader()
+		if err == nil {
+			err = r.readMessage()
+		}
+		if err == nil {
+			t.Fatalf("body truncated to %d bytes should fail", i)
+		}
+	}
+
+	r := newBinaryMessageTreeReader(binaryBody(testHeader, []testLine{{'X', "URL", "/order", "0", 1600000000000, 0, ""}}))
+	if err := r.readHeader(); err != nil {
+		t.Fatalf("readHeader error: %s", err)
+	}
+	if err := r.readMessage(); err == nil {
+		t.Fatal("unknown type should fail")
+	}
+}
+
+func BenchmarkReadTextMessage(b *testing.B) {
+	body := textBody(testHeader, testLines(20))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	for i := 0; i < b.N; i++ {
+		r := newMessageTreeReader(body, false)
+		if err := r.readHeader(); err != nil {
+			b.Fatal(err)
+		}
+		if err := r.readMessage(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadBinaryMessage(b *testing.B) {
+	body := binaryBody(testHeader, testLines(20))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	for i := 0; i < b.N; i++ {
+		r := newBinaryMessageTreeReader(body)
+		if err := r.readHeader(); err != nil {
+			b.Fatal(err)
+		}
+		if err := r.readMessage(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+//go:build go1.18
+// +build go1.18
+
+package handler
+
+import (
+	"testing"
+)
+
+func FuzzReadMessage(f *testing.F) {
+	f.Add([]byte("t\tURL\t/order\t0\t1600000000000\t\t\nE\tSQL\tselect\t0\t1600000000000\t\tselect 1\nT\tURL\t/order\t0\t1600000000000\t1000\t\n"), false)
+	f.Add([]byte("E\tSQL\tselect\t0\t1600000000000\t\tselect\\n\\t1\n"), true)
+	f.Add([]byte("M\t\torder.count\tC\t1600000000000\t\t2\n"), false)
+	f.Add([]byte("T\tURL\t/order\t0\t\t\t\n"), false)
+	f.Add([]byte("t\tURL\t/order\\"), true)
+	f.Add([]byte("0"), false)
+
+	f.Fuzz(func(t *testing.T, body []byte, escaped bool) {
+		r := newMessageTreeReader(body, escaped)
+		r.maxTraceCount = 10
+		r.maxTraceBytes = 1024
+
+		if err := r.readMessage(); err == nil && r.tree.GetMessage() == nil {
+			t.Fatalf("readMessage %q returned no message and no error", body)
+		}
+	})
+}
+
+func FuzzReadElementEscaped(f *testing.F) {
+	f.Add("select *\n\tfrom `order`")
+	f.Add("C:\\tmp\\n")
+	f.Add("\r\n\\")
+
+	f.Fuzz(func(t *testing.T, data string) {
+		body := "E\tSQL\tselect\t0\t1600000000000\t\t" + escapeElement(data) + "\n"
+		r := newMessageTreeReader([]byte(body), true)
+
+		if err := r.readMessage(); err != nil {
+			t.Fatalf("readMessage %q error: %s", body, err)
+		}
+		if actual := r.tree.GetMessage().GetData(); actual != data {
+			t.Fatalf("data: %q, expected: %q", actual, data)
+		}
+	})
+}
+
+func FuzzReadBinaryMessage(f *testing.F) {
+	f.Add(binaryBody(nil, testLines(2)))
+	f.Add(binaryBody(nil, []testLine{{TypeT, "URL", "/order", "0", 1600000000000, 1000, ""}}))
+	f.Add([]byte{TypeE, 0xff, 0xff, 0xff, 0xff})
+
+	header := binaryBody(testHeader, nil)
+	f.Fuzz(func(t *testing.T, messages []byte) {
+		body := append(append([]byte{}, header...), messages...)
+		r := newBinaryMessageTreeReader(body)
+		r.maxTraceCount = 10
+		r.maxTraceBytes = 1024
+
+		if err := r.readHeader(); err != nil {
+			t.Fatalf("readHeader error: %s", err)
+		}
+		if err := r.readMessage(); err == nil && r.tree.GetMessage() == nil {
+			t.Fatalf("readMessage %q returned no message and no error", messages)
+		}
+	})
+}
@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/Orlion/cat-agent/cat"
+	"github.com/Orlion/cat-agent/cat/message"
+	"github.com/Orlion/cat-agent/pkg/timex"
+	"github.com/Orlion/cat-agent/server"
+)
+
+// the kinds of the messages of a json tree.
+const (
+	KindTransaction = "transaction"
+	KindEvent       = "event"
+	KindHeartbeat   = "heartbeat"
+	KindMetric      = "metric"
+	KindTrace       = "trace"
+)
+
+var kindTypes = map[string]byte{
+	KindEvent:     TypeE,
+	KindHeartbeat: TypeH,
+	KindMetric:    TypeM,
+	KindTrace:     TypeL,
+}
+
+// jsonMessageTree is the body of server.CmdSendMessageJson, for example:
+//
+//	{
+//	  "domain": "order", "threadGroupName": "cron", "threadId": "1", "threadName": "sync",
+//	  "messageId": "", "parentMessageId": "", "rootMessageId": "",
+//	  "message": {
+//	    "kind": "transaction", "type": "Job", "name": "sync", "status": "0", "timestamp": 1600000000000, "duration": 1500,
+//	    "children": [{"kind": "event", "type": "Sync", "name": "rows", "status": "0", "data": "12"}]
+//	  }
+//	}
+//
+// An empty messageId is replaced by a new one, a message without timestamp is stamped with the current time
+// and a message without status is successful.
+type jsonMessageTree struct {
+	Domain          string       `json:"domain"`
+	ThreadGroupName string       `json:"threadGroupName"`
+	ThreadId        string       `json:"threadId"`
+	ThreadName      string       `json:"threadName"`
+	MessageId       string       `json:"messageId"`
+	ParentMessageId string       `json:"parentMessageId"`
+	RootMessageId   string       `json:"rootMessageId"`
+	Message         *jsonMessage `json:"message"`
+}
+
+type jsonMessage struct {
+	Kind      string `json:"kind"`
+	Type      string `json:"type"`
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	Data      string `json:"data"`
+	Timestamp int64  `json:"timestamp"`
+	// Duration is the duration of a transaction in microseconds.
+	Duration int64          `json:"duration"`
+	Children []*jsonMessage `json:"children"`
+}
+
+// SendMessageJson reads a tree from the json body of server.CmdSendMessageJson, the payload is the
+// validation error if the body is malformed, otherwise it is the messageId of the tree.
+func SendMessageJson(req *server.Request) (status server.Status, payload []byte) {
+	r := newJsonMessageTreeReader(req.Body)
+	status, _, err := sendMessage(r, &r.messageTreeBuilder)
+	if err != nil {
+		payload = []byte(err.Error())
+		return
+	}
+
+	payload = r.tree.GetMessageId()
+
+	return
+}
+
+type jsonMessageTreeReader struct {
+	messageTreeBuilder
+	body []byte
+	msg  *jsonMessage
+}
+
+func newJsonMessageTreeReader(body []byte) *jsonMessageTreeReader {
+	return &jsonMessageTreeReader{
+		messageTreeBuilder: newMessageTreeBuilder(),
+		body:               body,
+	}
+}
+
+// readHeader decodes the whole body, the messages are only validated by readMessage.
+func (r *jsonMessageTreeReader) readHeader() error {
+	decoder := json.NewDecoder(bytes.NewReader(r.body))
+	decoder.DisallowUnknownFields()
+
+	var tree jsonMessageTree
+	if err := decoder.Decode(&tree); err != nil {
+		return fmt.Errorf("invalid json: %s", err.Error())
+	}
+	if decoder.More() {
+		return errors.New("invalid json: body has more than one document")
+	}
+
+	if tree.Domain == "" {
+		return errors.New("domain cannot be empty")
+	}
+
+	r.tree.SetDomain([]byte(tree.Domain))
+	r.tree.SetThreadGroupName([]byte(tree.ThreadGroupName))
+	r.tree.SetThreadId([]byte(tree.ThreadId))
+	r.tree.SetThreadName([]byte(tree.ThreadName))
+	if tree.MessageId != "" {
+		r.tree.SetMessageId([]byte(tree.MessageId))
+	} else {
+		messageId, err := cat.CreateMessageId(tree.Domain)
+		if err != nil {
+			return err
+		}
+		r.tree.SetMessageId(messageId)
+	}
+	r.tree.SetParentMessageId([]byte(tree.ParentMessageId))
+	r.tree.SetRootMessageId([]byte(tree.RootMessageId))
+
+	r.msg = tree.Message
+
+	return nil
+}
+
+func (r *jsonMessageTreeReader) readMessage() error {
+	if r.msg == nil {
+		return errors.New("message cannot be empty")
+	}
+
+	if err := r.addMessage("message", r.msg); err != nil {
+		return err
+	}
+
+	return r.finish()
+}
+
+// addMessage adds m and its children to the tree, path locates m in the body for the validation errors.
+func (r *jsonMessageTreeReader) addMessage(path string, m *jsonMessage) error {
+	if m == nil {
+		return fmt.Errorf("%s: message cannot be null", path)
+	}
+
+	if m.Name == "" {
+		return fmt.Errorf("%s: name cannot be empty", path)
+	}
+
+	status := m.Status
+	if status == "" {
+		status = message.SUCCESS
+	}
+
+	timestamp := m.Timestamp
+	if timestamp == 0 {
+		timestamp = timex.NowUnixMillis()
+	} else if timestamp < 0 {
+		return fmt.Errorf("%s: timestamp cannot be negative", path)
+	}
+
+	if m.Kind != KindTransaction {
+		t, exists := kindTypes[m.Kind]
+		if !exists {
+			return fmt.Errorf("%s: unknown kind: %q", path, m.Kind)
+		}
+		if len(m.Children) > 0 {
+			return fmt.Errorf("%s: only a transaction can have children", path)
+		}
+
+		msg, err := newMessage(t, m.Type, m.Name, status, m.Data, timestamp, 0)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err.Error())
+		}
+
+		return r.add(t, msg)
+	}
+
+	if m.Duration < 0 {
+		return fmt.Errorf("%s: duration cannot be negative", path)
+	}
+
+	if len(m.Children) == 0 {
+		msg, _ := newMessage(TypeA, m.Type, m.Name, status, m.Data, timestamp, m.Duration)
+		return r.add(TypeA, msg)
+	}
+
+	msg, _ := newMessage(Typet, m.Type, m.Name, status, m.Data, timestamp, m.Duration)
+	if err := r.add(Typet, msg); err != nil {
+		return err
+	}
+
+	for i, child := range m.Children {
+		if err := r.addMessage(fmt.Sprintf("%s.children[%d]", path, i), child); err != nil {
+			return err
+		}
+	}
+
+	return r.add(TypeT, msg)
+}
@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Orlion/cat-agent/cat/message"
+)
+
+func readJsonMessage(body string) (*jsonMessageTreeReader, error) {
+	r := newJsonMessageTreeReader([]byte(body))
+	if err := r.readHeader(); err != nil {
+		return r, err
+	}
+	return r, r.readMessage()
+}
+
+func TestJsonMessageTreeReader(t *testing.T) {
+	body := `{
+		"domain": "order", "threadGroupName": "cron", "threadId": "1", "threadName": "sync",
+		"messageId": "order-7f000001-447323-1", "rootMessageId": "order-7f000001-447323-0",
+		"message": {
+			"kind": "transaction", "type": "Job", "name": "sync", "status": "0", "timestamp": 1600000000000, "duration": 1500,
+			"children": [
+				{"kind": "event", "type": "Sync", "name": "rows", "status": "0", "timestamp": 1600000000001, "data": "12"},
+				{"kind": "transaction", "type": "SQL", "name": "select", "status": "0", "timestamp": 1600000000002, "duration": 300},
+				{"kind": "heartbeat", "type": "Heartbeat", "name": "host", "status": "0", "timestamp": 1600000000003}
+			]
+		}
+	}`
+
+	r, err := readJsonMessage(body)
+	if err != nil {
+		t.Fatalf("read error: %s", err)
+	}
+
+	if string(r.tree.GetDomain()) != "order" || string(r.tree.GetMessageId()) != "order-7f000001-447323-1" || string(r.tree.GetRootMessageId()) != "order-7f000001-447323-0" {
+		t.Fatalf("unexpected header, domain: %s, messageId: %s, rootMessageId: %s", r.tree.GetDomain(), r.tree.GetMessageId(), r.tree.GetRootMessageId())
+	}
+
+	root, ok := r.tree.GetMessage().(*message.Transaction)
+	if !ok || root.GetName() != "sync" || root.GetDurationInMicros() != 1500 {
+		t.Fatalf("root message: %+v, expected the sync transaction", r.tree.GetMessage())
+	}
+
+	children := root.GetChildren()
+	if len(children) != 3 {
+		t.Fatalf("%d children, expected 3", len(children))
+	}
+	if event, ok := children[0].(*message.Event); !ok || event.GetData() != "12" || event.GetTimestamp() != 1600000000001 {
+		t.Fatalf("first child: %+v, expected the rows event", children[0])
+	}
+	if trans, ok := children[1].(*message.Transaction); !ok || trans.GetDurationInMicros() != 300 {
+		t.Fatalf("second child: %+v, expected the select transaction", children[1])
+	}
+	if _, ok := children[2].(*message.Heartbeat); !ok {
+		t.Fatalf("third child: %+v, expected the heartbeat", children[2])
+	}
+
+	// a heartbeat is never sampled out.
+	if r.tree.CanDiscard() {
+		t.Fatal("tree with a heartbeat should not be discardable")
+	}
+}
+
+func TestJsonMessageTreeReaderDefaultStatus(t *testing.T) {
+	body := `{
+		"domain": "order", "messageId": "order-7f000001-447323-1",
+		"message": {
+			"kind": "transaction", "type": "Job", "name": "sync", "duration": 1500,
+			"children": [{"kind": "event", "type": "Sync", "name": "rows"}, {"kind": "event", "type": "Sync", "name": "failed", "status": "ERROR"}]
+		}
+	}`
+
+	r, err := readJsonMessage(body)
+	if err != nil {
+		t.Fatalf("read error: %s", err)
+	}
+
+	root := r.tree.GetMessage().(*message.Transaction)
+	children := root.GetChildren()
+	if root.GetStatus() != message.SUCCESS || children[0].GetStatus() != message.SUCCESS || children[1].GetStatus() != "ERROR" {
+		t.Fatalf("statuses: %s, %s and %s, expected %s for the messages without status", root.GetStatus(), children[0].GetStatus(), children[1].GetStatus(), message.SUCCESS)
+	}
+
+	// the tree has an error.
+	if r.tree.CanDiscard() {
+		t.Fatal("tree with an error should not be discardable")
+	}
+
+	r, err = readJsonMessage(`{"domain": "order", "messageId": "order-7f000001-447323-2", "message": {"kind": "transaction", "type": "Job", "name": "sync"}}`)
+	if err != nil {
+		t.Fatalf("read error: %s", err)
+	}
+	if !r.tree.CanDiscard() {
+		t.Fatal("tree without status should be sampled like a successful one")
+	}
+}
+
+func TestJsonMessageTreeReaderInvalid(t *testing.T) {
+	header := `"domain": "order", "messageId": "order-7f000001-447323-1"`
+	for _, c := range []struct {
+		body, err string
+	}{
+		{`{"domain": "order"`, "invalid json"},
+		{`{` + header + `, "unknown": 1}`, `unknown field "unknown"`},
+		{`{` + header + `} {}`, "more than one document"},
+		{`{"messageId": "order-7f000001-447323-1"}`, "domain cannot be empty"},
+		{`{` + header + `}`, "message cannot be empty"},
+		{`{` + header + `, "message": {"kind": "span", "name": "sync"}}`, `message: unknown kind: "span"`},
+		{`{` + header + `, "message": {"kind": "event"}}`, "message: name cannot be empty"},
+		{`{` + header + `, "message": {"kind": "event", "name": "rows", "children": [{"kind": "event", "name": "rows"}]}}`, "only a transaction can have children"},
+		{`{` + header + `, "message": {"kind": "transaction", "name": "sync", "children": [{"kind": "event", "name": "rows"}, null]}}`, "message.children[1]: message cannot be null"},
+		{`{` + header + `, "message": {"kind": "transaction", "name": "sync", "children": [{"kind": "transaction", "name": "sql", "duration": -1}]}}`, "message.children[0]: duration cannot be negative"},
+	} {
+		_, err := readJsonMessage(c.body)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Fatalf("body %s, error: %v, expected: %s", c.body, err, c.err)
+		}
+	}
+}
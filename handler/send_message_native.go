@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"errors"
+
+	"github.com/Orlion/cat-agent/cat"
+	"github.com/Orlion/cat-agent/cat/encoder"
+	"github.com/Orlion/cat-agent/log"
+	"github.com/Orlion/cat-agent/server"
+)
+
+// SendMessageNative sends a tree encoded in NT1 by a native cat client, it is not answered.
+func SendMessageNative(req *server.Request) (status server.Status, payload []byte) {
+	tree, err := encoder.NewBinaryDecoder().DecodeMessageTree(req.Body)
+	if err != nil {
+		log.Errorf("send message native handler decode error: %s", err.Error())
+		status = server.StatusMsgReadMessageErr
+		return
+	}
+
+	if len(tree.GetMessageId()) == 0 {
+		messageId, err := cat.CreateMessageId(string(tree.GetDomain()))
+		if errors.Is(err, cat.ErrBadDomain) {
+			status = server.StatusBadDomain
+			return
+		}
+		if err != nil {
+			log.Errorf("send message native handler error: %s", err.Error())
+			status = server.StatusMessageIdErr
+			return
+		}
+		tree.SetMessageId(messageId)
+	}
+
+	log.Debugf("decode native tree, domain: %s, messageId: %s", tree.GetDomain(), tree.GetMessageId())
+
+	cat.Send(tree)
+
+	return
+}
@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Orlion/cat-agent/cat/message"
+	"github.com/Orlion/cat-agent/log"
+	"github.com/Orlion/cat-agent/server"
+)
+
+func init() {
+	log.Init(&log.Config{
+		StdoutLevel: "error",
+	})
+}
+
+func TestSendMessageAckMalformedHeader(t *testing.T) {
+	status, payload := SendMessageAck(&server.Request{
+		Cmd:  server.CmdSendMessageAck,
+		Body: []byte("domain\n"),
+	})
+
+	if status != server.StatusMsgReadHeaderErr {
+		t.Fatalf("status: %d, expected: %d", status, server.StatusMsgReadHeaderErr)
+	}
+
+	if len(payload) == 0 {
+		t.Fatal("payload should carry the parse error")
+	}
+}
+
+func TestReadMessageMetric(t *testing.T) {
+	body := "t\tURL\t/order\t0\t1600000000000\t\t\n" +
+		"M\t\torder.count\tC\t1600000000000\t\t2\n" +
+		"T\tURL\t/order\t0\t1600000000000\t1000\t\n"
+	r := newMessageTreeReader([]byte(body), false)
+
+	if err := r.readMessage(); err != nil {
+		t.Fatalf("readMessage error: %s", err)
+	}
+
+	if !r.tree.CanDiscard() {
+		t.Fatal("the status of a metric should not make the tree undiscardable")
+	}
+
+	root, ok := r.tree.GetMessage().(*message.Transaction)
+	if !ok || len(root.GetChildren()) != 1 {
+		t.Fatalf("root: %v, expected a transaction with the metric as its child", r.tree.GetMessage())
+	}
+
+	metric, ok := root.GetChildren()[0].(*message.Metric)
+	if !ok || metric.GetName() != "order.count" || metric.GetStatus() != message.MetricCount || metric.GetData() != "2" {
+		t.Fatalf("child: %+v, expected the order.count metric", root.GetChildren()[0])
+	}
+}
+
+func TestReadMessageHeartbeat(t *testing.T) {
+	for _, body := range []string{
+		"H\tHeartbeat\tworker-1\t0\t1600000000000\t\t<status><queue backlog=\"3\"/></status>\n",
+		"t\tCron\tsync\t0\t1600000000000\t\t\n" +
+			"H\tHeartbeat\tworker-1\t0\t1600000000000\t\t<status><queue backlog=\"3\"/></status>\n" +
+			"T\tCron\tsync\t0\t1600000000000\t1000\t\n",
+	} {
+		r := newMessageTreeReader([]byte(body), false)
+
+		if err := r.readMessage(); err != nil {
+			t.Fatalf("readMessage %q error: %s", body, err)
+		}
+
+		if r.tree.CanDiscard() {
+			t.Fatalf("a tree with a heartbeat should never be discarded: %q", body)
+		}
+
+		heartbeat, ok := r.tree.GetMessage().(*message.Heartbeat)
+		if root, isTransaction := r.tree.GetMessage().(*message.Transaction); isTransaction && len(root.GetChildren()) == 1 {
+			heartbeat, ok = root.GetChildren()[0].(*message.Heartbeat)
+		}
+		if !ok || heartbeat.GetName() != "worker-1" || heartbeat.GetData() != "<status><queue backlog=\"3\"/></status>" {
+			t.Fatalf("message: %+v, expected the worker-1 heartbeat", r.tree.GetMessage())
+		}
+	}
+}
+
+func TestReadMessageTraceCap(t *testing.T) {
+	body := "t\tURL\t/order\t0\t1600000000000\t\t\n"
+	for i := 0; i < 5; i++ {
+		body += "L\tDebug\tsql\t0\t1600000000000\t\tselect 1\n"
+	}
+	body += "T\tURL\t/order\t0\t1600000000000\t1000\t\n"
+
+	for _, c := range []struct {
+		maxCount, maxBytes, expected int
+	}{
+		{0, 0, 5},
+		{3, 0, 3},
+		{0, 40, 2},
+	} {
+		r := newMessageTreeReader([]byte(body), false)
+		r.maxTraceCount = c.maxCount
+		r.maxTraceBytes = c.maxBytes
+
+		if err := r.readMessage(); err != nil {
+			t.Fatalf("readMessage error: %s", err)
+		}
+
+		root := r.tree.GetMessage().(*message.Transaction)
+		if len(root.GetChildren()) != c.expected || r.droppedTraces != 5-c.expected {
+			t.Fatalf("max count %d, max bytes %d: %d traces kept, %d dropped, expected %d kept", c.maxCount, c.maxBytes, len(root.GetChildren()), r.droppedTraces, c.expected)
+		}
+		if _, ok := root.GetChildren()[0].(*message.Trace); !ok {
+			t.Fatalf("child: %+v, expected a trace", root.GetChildren()[0])
+		}
+	}
+}
+
+// escapeElement escapes an element the way a client that sets server.CmdFlagEscaped does.
+func escapeElement(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r").Replace(s)
+}
+
+func TestReadMessageEscaped(t *testing.T) {
+	data := "select *\n\tfrom `order`\r\nwhere path = 'C:\\tmp'"
+	body := "E\tSQL\tselect\t0\t1600000000000\t\t" + escapeElement(data) + "\n"
+
+	r := newMessageTreeReader([]byte(body), true)
+	if err := r.readMessage(); err != nil {
+		t.Fatalf("readMessage error: %s", err)
+	}
+	if actual := r.tree.GetMessage().GetData(); actual != data {
+		t.Fatalf("data: %q, expected: %q", actual, data)
+	}
+
+	// old clients don't escape, a backslash is read as it is.
+	body = "E\tFile\topen\t0\t1600000000000\t\tC:\\tmp\n"
+	r = newMessageTreeReader([]byte(body), false)
+	if err := r.readMessage(); err != nil {
+		t.Fatalf("readMessage error: %s", err)
+	}
+	if actual := r.tree.GetMessage().GetData(); actual != "C:\\tmp" {
+		t.Fatalf("data: %q, expected: %q", actual, "C:\\tmp")
+	}
+
+	for _, body := range []string{
+		"E\tSQL\tselect\t0\t1600000000000\t\tbad \\x escape\n",
+		"E\tSQL\tselect\t0\t1600000000000\t\ttrailing backslash\\",
+	} {
+		r = newMessageTreeReader([]byte(body), true)
+		if err := r.readMessage(); err != errBadEscape {
+			t.Fatalf("readMessage %q error: %v, expected: %s", body, err, errBadEscape)
+		}
+	}
+}
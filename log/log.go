@@ -1,6 +1,7 @@
 package log
 
 import (
+	"errors"
 	"os"
 
 	"go.uber.org/zap"
@@ -8,32 +9,27 @@ import (
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-var logger *zap.SugaredLogger
+var (
+	logger      *zap.SugaredLogger
+	current     *Config
+	stdoutLevel = zap.NewAtomicLevel()
+	fileLevel   = zap.NewAtomicLevel()
+)
 
 func Init(config *Config) {
 	config = withDefaultConf(config)
+	current = config
 
 	encoderConfig := zap.NewProductionEncoderConfig()
 	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
 	encoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
 
-	level, err := zapcore.ParseLevel(config.StdoutLevel)
-	if err != nil {
-		level = zapcore.InfoLevel
-	}
+	setLevels(config)
 
 	cores := make([]zapcore.Core, 1)
-	cores[0] = zapcore.NewCore(zapcore.NewConsoleEncoder(encoderConfig), zapcore.AddSync(os.Stdout), level)
+	cores[0] = zapcore.NewCore(zapcore.NewConsoleEncoder(encoderConfig), zapcore.AddSync(os.Stdout), stdoutLevel)
 
 	if config.Filename != "" {
-		level, err = zapcore.ParseLevel(config.Level)
-		if err != nil {
-			level = zapcore.ErrorLevel
-		}
-
-		priority := zap.LevelEnablerFunc(func(lev zapcore.Level) bool {
-			return lev >= level
-		})
 		infoFileWriteSyncer := zapcore.AddSync(&lumberjack.Logger{
 			Filename:   config.Filename,
 			MaxSize:    config.MaxSize,
@@ -43,13 +39,55 @@ func Init(config *Config) {
 		})
 
 		encoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
-		core := zapcore.NewCore(zapcore.NewConsoleEncoder(encoderConfig), infoFileWriteSyncer, priority)
+		core := zapcore.NewCore(zapcore.NewConsoleEncoder(encoderConfig), infoFileWriteSyncer, fileLevel)
 		cores = append(cores, core)
 	}
 
 	logger = zap.New(zapcore.NewTee(cores...)).Sugar()
 }
 
+func setLevels(config *Config) {
+	level, err := zapcore.ParseLevel(config.StdoutLevel)
+	if err != nil {
+		level = zapcore.InfoLevel
+	}
+	stdoutLevel.SetLevel(level)
+
+	level, err = zapcore.ParseLevel(config.Level)
+	if err != nil {
+		level = zapcore.ErrorLevel
+	}
+	fileLevel.SetLevel(level)
+}
+
+// CheckReload reports the changes of config that cannot be applied without a restart.
+func CheckReload(config *Config) error {
+	config = withDefaultConf(config)
+	if config.Filename != current.Filename ||
+		config.MaxSize != current.MaxSize ||
+		config.MaxAge != current.MaxAge ||
+		config.MaxBackups != current.MaxBackups ||
+		config.Compress != current.Compress {
+		return errors.New("log file settings changed, restart required")
+	}
+
+	return nil
+}
+
+// Reload applies the log levels of config.
+func Reload(config *Config) error {
+	if err := CheckReload(config); err != nil {
+		return err
+	}
+
+	config = withDefaultConf(config)
+	setLevels(config)
+	current = config
+	Infof("log config has been reloaded, stdout level: %s, level: %s", stdoutLevel.Level(), fileLevel.Level())
+
+	return nil
+}
+
 func Debug(args ...interface{}) {
 	logger.Debug(args...)
 }
@@ -9,6 +9,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/Orlion/cat-agent/admin"
 	"github.com/Orlion/cat-agent/cat"
 	"github.com/Orlion/cat-agent/config"
 	"github.com/Orlion/cat-agent/handler"
@@ -24,6 +25,10 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+
 	flag.Parse()
 
 	conf, err := config.ParseConfig(confFilename)
@@ -36,7 +41,7 @@ func main() {
 
 	err = cat.Init(conf.Cat)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "configuration file parse error: "+err.Error())
+		fmt.Fprintln(os.Stderr, "cat init error: "+err.Error())
 		os.Exit(1)
 	}
 
@@ -51,17 +56,31 @@ func main() {
 		}
 	}()
 
-	waitGracefulStop(srv)
+	var adminSrv *admin.Server
+	if conf.Admin != nil && conf.Admin.Addr != "" {
+		adminSrv = admin.NewServer(conf.Admin, srv)
+		if err := adminSrv.ListenAndServe(); err != nil {
+			fmt.Fprintln(os.Stderr, "admin server listen and serve error: "+err.Error())
+			os.Exit(1)
+		}
+	}
+
+	waitGracefulStop(srv, adminSrv)
 }
 
 func createServer(config *server.Config) *server.Server {
 	srv := server.NewServer(config)
 	srv.Handle(server.CmdCreateMessageId, handler.CreateMessageId)
+	srv.Handle(server.CmdCreateMessageIds, handler.CreateMessageIds)
 	srv.Handle(server.CmdSendMessage, handler.SendMessage)
+	srv.Handle(server.CmdSendMessageAck, handler.SendMessageAck)
+	srv.Handle(server.CmdSendMessageBinary, handler.SendMessageBinary)
+	srv.Handle(server.CmdSendMessageJson, handler.SendMessageJson)
+	srv.Handle(server.CmdSendMessageNative, handler.SendMessageNative)
 	return srv
 }
 
-func waitGracefulStop(srv *server.Server) {
+func waitGracefulStop(srv *server.Server, adminSrv *admin.Server) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
 	for {
@@ -69,14 +88,60 @@ func waitGracefulStop(srv *server.Server) {
 		switch s {
 		case syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
 			log.Infof("received signal: %s will stop...", s.String())
-			ctx, _ := context.WithTimeout(context.Background(), 3000*time.Millisecond)
+			ctx, cancel := context.WithTimeout(context.Background(), 3000*time.Millisecond)
 			srv.Shutdown(ctx)
+			if adminSrv != nil {
+				adminSrv.Shutdown(ctx)
+			}
+			cancel()
 			cat.Shutdown()
 			log.Shutdown()
 			time.Sleep(1 * time.Second)
 			return
 		case syscall.SIGHUP:
+			log.Infof("received signal: %s will reload configuration file %s...", s.String(), confFilename)
+			reloadConfig(srv, adminSrv)
 		default:
 		}
 	}
 }
+
+// reloadConfig applies the settings that are safe to change while running, the running
+// configuration is left untouched if the file is invalid or changes a setting that requires a restart.
+func reloadConfig(srv *server.Server, adminSrv *admin.Server) {
+	conf, err := config.ParseConfig(confFilename)
+	if err != nil {
+		log.Errorf("reload configuration rejected, configuration file parse error: %s", err.Error())
+		return
+	}
+
+	if conf.Server == nil {
+		conf.Server = new(server.Config)
+	}
+
+	if err = srv.CheckReload(conf.Server); err != nil {
+		log.Errorf("reload configuration rejected: %s", err.Error())
+		return
+	}
+
+	if err = adminSrv.CheckReload(conf.Admin); err != nil {
+		log.Errorf("reload configuration rejected: %s", err.Error())
+		return
+	}
+
+	if err = cat.CheckReload(conf.Cat); err != nil {
+		log.Errorf("reload configuration rejected: %s", err.Error())
+		return
+	}
+
+	if err = log.CheckReload(conf.Log); err != nil {
+		log.Errorf("reload configuration rejected: %s", err.Error())
+		return
+	}
+
+	log.Reload(conf.Log)
+	srv.Reload(conf.Server)
+	cat.Reload(conf.Cat)
+
+	log.Info("configuration has been reloaded")
+}
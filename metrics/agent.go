@@ -0,0 +1,27 @@
+package metrics
+
+// The metrics of the agent internals, gauges of values owned by other components are registered
+// with NewGaugeFunc by the component that serves the metrics.
+var (
+	Requests = NewCounterVec("cat_agent_requests_total", "Requests received per command.", "cmd")
+
+	RequestErrors = NewCounterVec("cat_agent_request_errors_total", "Requests answered with a non ok status per command and status.", "cmd", "status")
+
+	Trees = NewCounterVec("cat_agent_trees_total", "Message trees handed to cat per send result.", "result")
+
+	TreesOffered = NewCounterVec("cat_agent_trees_offered_total", "Message trees offered to the sender per queue.", "queue")
+
+	TreesSent = NewCounterVec("cat_agent_trees_sent_total", "Message trees written to the cat server per router.", "router")
+
+	TracesDropped = NewCounter("cat_agent_traces_dropped_total", "Trace messages dropped because their tree exceeds the per tree cap.")
+
+	AggregatorDropped = NewCounterVec("cat_agent_aggregator_dropped_total", "Messages discarded because the channel of the aggregator is full.", "aggregator")
+
+	SenderBytesWritten = NewCounterVec("cat_agent_sender_bytes_written_total", "Bytes written to the cat server per router.", "router")
+
+	SenderConnectFailures = NewCounterVec("cat_agent_sender_connect_failures_total", "Failed dials to the cat server per router.", "router")
+
+	SenderReconnects = NewCounterVec("cat_agent_sender_reconnects_total", "Connections to the cat server established after the first one per router.", "router")
+
+	RouterRefreshes = NewCounterVec("cat_agent_router_refresh_total", "Router config pulls from the cat server per result.", "result")
+)
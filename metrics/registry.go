@@ -0,0 +1,237 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	typeCounter = "counter"
+	typeGauge   = "gauge"
+)
+
+// collector writes its samples in the prometheus text exposition format.
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func NewRegistry() *Registry {
+	return new(Registry)
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mu.Unlock()
+}
+
+// WriteText writes every registered metric in the prometheus text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+
+	return bw.Flush()
+}
+
+var defaultRegistry = NewRegistry()
+
+func WriteText(w io.Writer) error {
+	return defaultRegistry.WriteText(w)
+}
+
+type Counter struct {
+	labelValues []string
+	v           uint64
+}
+
+// NewCounter registers a counter without labels.
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return r.NewCounterVec(name, help).WithLabelValues()
+}
+
+func NewCounter(name, help string) *Counter {
+	return defaultRegistry.NewCounter(name, help)
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *Counter) Add(delta uint64) {
+	atomic.AddUint64(&c.v, delta)
+}
+
+func (c *Counter) Get() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct {
+	name       string
+	help       string
+	labelNames []string
+	mu         sync.RWMutex
+	counters   map[string]*Counter
+}
+
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	v := &CounterVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		counters:   make(map[string]*Counter),
+	}
+	r.register(v)
+	return v
+}
+
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return defaultRegistry.NewCounterVec(name, help, labelNames...)
+}
+
+// WithLabelValues returns the counter of the label values, they must be given in the order of the label names.
+func (v *CounterVec) WithLabelValues(labelValues ...string) *Counter {
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.RLock()
+	c, exists := v.counters[key]
+	v.mu.RUnlock()
+	if exists {
+		return c
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, exists = v.counters[key]; !exists {
+		c = &Counter{labelValues: append([]string(nil), labelValues...)}
+		v.counters[key] = c
+	}
+
+	return c
+}
+
+func (v *CounterVec) write(w *bufio.Writer) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.counters))
+	for key := range v.counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	counters := make([]*Counter, len(keys))
+	for i, key := range keys {
+		counters[i] = v.counters[key]
+	}
+	v.mu.RUnlock()
+
+	writeHeader(w, v.name, v.help, typeCounter)
+	for _, c := range counters {
+		writeSample(w, v.name, v.labelNames, c.labelValues, float64(c.Get()))
+	}
+}
+
+// funcCollector reads its value when the metrics are scraped, it suits values that are owned by other components.
+type funcCollector struct {
+	name string
+	help string
+	t    string
+	f    func() float64
+}
+
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) {
+	r.register(&funcCollector{name: name, help: help, t: typeGauge, f: f})
+}
+
+func NewGaugeFunc(name, help string, f func() float64) {
+	defaultRegistry.NewGaugeFunc(name, help, f)
+}
+
+// NewCounterFunc registers a counter whose value is read from f, f must never decrease.
+func (r *Registry) NewCounterFunc(name, help string, f func() float64) {
+	r.register(&funcCollector{name: name, help: help, t: typeCounter, f: f})
+}
+
+func NewCounterFunc(name, help string, f func() float64) {
+	defaultRegistry.NewCounterFunc(name, help, f)
+}
+
+func (c *funcCollector) write(w *bufio.Writer) {
+	writeHeader(w, c.name, c.help, c.t)
+	writeSample(w, c.name, nil, nil, c.f())
+}
+
+func writeHeader(w *bufio.Writer, name, help, t string) {
+	w.WriteString("# HELP ")
+	w.WriteString(name)
+	w.WriteByte(' ')
+	w.WriteString(escapeHelp(help))
+	w.WriteString("\n# TYPE ")
+	w.WriteString(name)
+	w.WriteByte(' ')
+	w.WriteString(t)
+	w.WriteByte('\n')
+}
+
+func writeSample(w *bufio.Writer, name string, labelNames, labelValues []string, v float64) {
+	w.WriteString(name)
+	if len(labelNames) > 0 {
+		w.WriteByte('{')
+		for i, labelName := range labelNames {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(labelName)
+			w.WriteString(`="`)
+			if i < len(labelValues) {
+				w.WriteString(escapeLabelValue(labelValues[i]))
+			}
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatValue(v))
+	w.WriteByte('\n')
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var (
+	helpReplacer       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueReplacer.Replace(s)
+}
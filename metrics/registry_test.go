@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRegistryWriteText(t *testing.T) {
+	r := NewRegistry()
+
+	requests := r.NewCounterVec("test_requests_total", "Requests per cmd.\nSecond line.", "cmd", "status")
+	requests.WithLabelValues("send_message", "ok").Add(3)
+	requests.WithLabelValues("create_message_id", "ok").Inc()
+	requests.WithLabelValues(`a"b\c`, "bad").Inc()
+
+	r.NewGaugeFunc("test_queue_len", "Queue length.", func() float64 {
+		return 1.5
+	})
+
+	buf := new(bytes.Buffer)
+	if err := r.WriteText(buf); err != nil {
+		t.Fatalf("WriteText error: %s", err)
+	}
+
+	expected := `# HELP test_requests_total Requests per cmd.\nSecond line.
+# TYPE test_requests_total counter
+test_requests_total{cmd="a\"b\\c",status="bad"} 1
+test_requests_total{cmd="create_message_id",status="ok"} 1
+test_requests_total{cmd="send_message",status="ok"} 3
+# HELP test_queue_len Queue length.
+# TYPE test_queue_len gauge
+test_queue_len 1.5
+`
+	if buf.String() != expected {
+		t.Fatalf("WriteText got:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestRegistryNewCounter(t *testing.T) {
+	r := NewRegistry()
+
+	dropped := r.NewCounter("test_dropped_total", "Dropped messages.")
+	dropped.Add(2)
+	dropped.Inc()
+
+	buf := new(bytes.Buffer)
+	if err := r.WriteText(buf); err != nil {
+		t.Fatalf("WriteText error: %s", err)
+	}
+
+	expected := `# HELP test_dropped_total Dropped messages.
+# TYPE test_dropped_total counter
+test_dropped_total 3
+`
+	if buf.String() != expected {
+		t.Fatalf("WriteText got:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
@@ -17,6 +17,9 @@ func (s *TransactionStack) Push(trans *message.Transaction) {
 }
 
 func (s *TransactionStack) Pop() *message.Transaction {
+	if s.IsEmpty() {
+		return nil
+	}
 	trans := s.list[len(s.list)-1]
 	s.list = s.list[:len(s.list)-1]
 	return trans
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Orlion/cat-agent/cat"
+	"github.com/Orlion/cat-agent/config"
+	"github.com/Orlion/cat-agent/log"
+	"github.com/Orlion/cat-agent/server"
+)
+
+// replayer sends a captured request and returns the status it has been answered with,
+// StatusOk for the cmds that are not answered.
+type replayer func(captured *server.CapturedRequest) (server.Status, error)
+
+// runReplay feeds the requests of a capture file back into a running agent, or into the handlers
+// of this process, it returns the exit code of the subcommand.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	captureFilename := fs.String("capture", "", "the capture file to replay, it is recorded by the agent with server.capture_file")
+	addr := fs.String("addr", "", "the address of a running agent, ip:port or unix:///path, the requests are sent to it")
+	replayConfFilename := fs.String("conf", "", "the configuration file used to send the requests from this process if -addr is empty")
+	speed := fs.Float64("speed", 1, "the replay rate relative to the captured one, 2 replays twice as fast, 0 as fast as possible")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *captureFilename == "" || (*addr == "") == (*replayConfFilename == "") {
+		fmt.Fprintln(os.Stderr, "usage: cat-agent replay -capture file (-addr address | -conf file) [-speed rate]")
+		return 2
+	}
+
+	f, err := os.Open(*captureFilename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "open capture error: "+err.Error())
+		return 1
+	}
+	defer f.Close()
+
+	reader, err := server.NewCaptureReader(f)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, *captureFilename+": "+err.Error())
+		return 1
+	}
+
+	var replay replayer
+	if *addr != "" {
+		conn, err := dialAgent(*addr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "dial agent error: "+err.Error())
+			return 1
+		}
+		defer conn.Close()
+		replay = newConnReplayer(conn)
+	} else {
+		srv, err := initReplayServer(*replayConfFilename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		defer func() {
+			cat.Shutdown()
+			log.Shutdown()
+		}()
+		replay = func(captured *server.CapturedRequest) (server.Status, error) {
+			status, _ := srv.Dispatch(captured.Request)
+			return status, nil
+		}
+	}
+
+	n, failed, err := replayCapture(reader, replay, *speed)
+	fmt.Printf("%d requests replayed, %d answered with an error status\n", n, failed)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay error: "+err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+// replayCapture replays the requests of reader with the delays they have been captured with divided by speed.
+func replayCapture(reader *server.CaptureReader, replay replayer, speed float64) (n, failed int, err error) {
+	var first time.Time
+	start := time.Now()
+
+	for {
+		captured, err := reader.Next()
+		if err == io.EOF {
+			return n, failed, nil
+		} else if err != nil {
+			return n, failed, err
+		}
+
+		if first.IsZero() {
+			first = captured.Time
+		}
+		if speed > 0 {
+			due := start.Add(time.Duration(float64(captured.Time.Sub(first)) / speed))
+			time.Sleep(time.Until(due))
+		}
+
+		status, err := replay(captured)
+		if err != nil {
+			return n, failed, err
+		}
+
+		n++
+		if status != server.StatusOk {
+			failed++
+		}
+	}
+}
+
+func dialAgent(addr string) (net.Conn, error) {
+	if strings.HasPrefix(addr, "unix://") {
+		return net.Dial("unix", strings.TrimPrefix(addr, "unix://"))
+	}
+	return net.Dial("tcp", addr)
+}
+
+// newConnReplayer writes the requests to conn as they have been captured and reads the responses of the answered cmds.
+func newConnReplayer(conn net.Conn) replayer {
+	bufr := bufio.NewReader(conn)
+	header := make([]byte, server.RespHeaderLen)
+
+	return func(captured *server.CapturedRequest) (server.Status, error) {
+		if _, err := conn.Write(captured.Raw); err != nil {
+			return 0, err
+		}
+
+		if !captured.Request.Cmd.Answered() {
+			return server.StatusOk, nil
+		}
+
+		if _, err := io.ReadFull(bufr, header); err != nil {
+			return 0, err
+		}
+		length := binary.BigEndian.Uint32(header[4:])
+		if length < server.RespHeaderLen {
+			return 0, errors.New("bad response length")
+		}
+		if _, err := io.CopyN(ioutil.Discard, bufr, int64(length-server.RespHeaderLen)); err != nil {
+			return 0, err
+		}
+
+		return server.Status(binary.BigEndian.Uint32(header)), nil
+	}
+}
+
+// initReplayServer starts cat like the agent does, without listening, so the requests can be dispatched to its handlers.
+func initReplayServer(confFilename string) (*server.Server, error) {
+	conf, err := config.ParseConfig(confFilename)
+	if err != nil {
+		return nil, errors.New("configuration file parse error: " + err.Error())
+	}
+
+	log.Init(conf.Log)
+
+	// the message id state file and the spool belong to the agent that may run with the same configuration,
+	// this process must neither overwrite its reservations nor replay or write its spool segments.
+	if conf.Cat != nil {
+		conf.Cat.MessageIdStateFile = ""
+		conf.Cat.SenderSpoolDir = ""
+	}
+
+	if err = cat.Init(conf.Cat); err != nil {
+		return nil, errors.New("configuration file parse error: " + err.Error())
+	}
+
+	if conf.Server == nil {
+		conf.Server = new(server.Config)
+	}
+	// the replayed requests must not be captured again.
+	conf.Server.CaptureFile = ""
+
+	return createServer(conf.Server), nil
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/Orlion/cat-agent/log"
+	"github.com/Orlion/cat-agent/pkg/atomicx"
+)
+
+// CaptureMagic starts every capture file.
+var CaptureMagic = []byte("CATCAP1\n")
+
+var ErrBadCapture = errors.New("not a capture file")
+
+// captureQueueSize is the number of records that can wait for the writer of a capture, the next ones are dropped.
+const captureQueueSize = 4096
+
+// Capture records the requests received by the server to a file, so that they can be replayed. Every record
+// is the big endian int64 unix nanoseconds the request has been received at, followed by the request as it
+// is sent by the clients: cmd with CmdFlagEscaped if it is escaped, length and body.
+type Capture struct {
+	f        *os.File
+	maxBytes int64
+	// size is only touched by the writer.
+	size    int64
+	ch      chan []byte
+	done    chan struct{}
+	stopped atomicx.Bool
+	dropped uint64
+}
+
+// NewCapture appends to filename until it reaches maxBytes, the magic is written if the file is empty.
+func NewCapture(filename string, maxBytes int64) (*Capture, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	size := info.Size()
+	if size == 0 {
+		if _, err = f.Write(CaptureMagic); err != nil {
+			f.Close()
+			return nil, err
+		}
+		size = int64(len(CaptureMagic))
+	}
+
+	c := &Capture{
+		f:        f,
+		maxBytes: maxBytes,
+		size:     size,
+		ch:       make(chan []byte, captureQueueSize),
+		done:     make(chan struct{}),
+	}
+	go c.run()
+
+	return c, nil
+}
+
+// Record queues req for the writer without waiting for the disk, it is dropped if the writer is behind
+// or the capture has stopped.
+func (c *Capture) Record(req *Request) {
+	if c.stopped.Get() {
+		return
+	}
+
+	cmd := req.Cmd
+	if req.Escaped {
+		cmd |= CmdFlagEscaped
+	}
+
+	b := make([]byte, 8+ReqHeaderLen+len(req.Body))
+	binary.BigEndian.PutUint64(b, uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(b[8:], uint32(cmd))
+	binary.BigEndian.PutUint32(b[12:], uint32(ReqHeaderLen+len(req.Body)))
+	copy(b[8+ReqHeaderLen:], req.Body)
+
+	select {
+	case c.ch <- b:
+	default:
+		atomic.AddUint64(&c.dropped, 1)
+	}
+}
+
+// run writes the queued records until the capture is closed, the buffer is flushed whenever the queue is
+// empty so the records reach the file soon after their requests. The capture stops at maxBytes or on a
+// write error, the records are never cut.
+func (c *Capture) run() {
+	defer close(c.done)
+
+	w := bufio.NewWriter(c.f)
+	for b := range c.ch {
+		if c.stopped.Get() {
+			continue
+		}
+
+		if maxBytes := atomic.LoadInt64(&c.maxBytes); c.size+int64(len(b)) > maxBytes {
+			log.Warnf("capture %s reached %d bytes, capture has been stopped", c.f.Name(), maxBytes)
+			c.stopped.SetTrue()
+			continue
+		}
+
+		_, err := w.Write(b)
+		if err == nil && len(c.ch) == 0 {
+			err = w.Flush()
+		}
+		if err != nil {
+			log.Warnf("capture write %s error: %s, capture has been stopped", c.f.Name(), err.Error())
+			c.stopped.SetTrue()
+			continue
+		}
+		c.size += int64(len(b))
+	}
+
+	if err := w.Flush(); err != nil {
+		log.Warnf("capture write %s error: %s", c.f.Name(), err.Error())
+	}
+}
+
+// setMaxBytes changes the size the capture stops at, a capture that has stopped is not started again.
+func (c *Capture) setMaxBytes(maxBytes int64) {
+	atomic.StoreInt64(&c.maxBytes, maxBytes)
+}
+
+// Close writes the queued records and closes the file, Record must not be called anymore.
+func (c *Capture) Close() error {
+	close(c.ch)
+	<-c.done
+
+	if dropped := atomic.LoadUint64(&c.dropped); dropped > 0 {
+		log.Warnf("capture %s dropped %d requests while its writer was behind", c.f.Name(), dropped)
+	}
+
+	return c.f.Close()
+}
+
+// CapturedRequest is a record of a capture, Raw is the request as it is sent by the clients.
+type CapturedRequest struct {
+	Time    time.Time
+	Request *Request
+	Raw     []byte
+}
+
+// CaptureReader reads the records of a capture file in order.
+type CaptureReader struct {
+	r io.Reader
+}
+
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	bufr := bufio.NewReader(r)
+
+	magic := make([]byte, len(CaptureMagic))
+	if _, err := io.ReadFull(bufr, magic); err != nil || !bytes.Equal(magic, CaptureMagic) {
+		return nil, ErrBadCapture
+	}
+
+	return &CaptureReader{r: bufr}, nil
+}
+
+// Next returns the next record, io.EOF if there is none, a record cut by the end of the file is
+// io.ErrUnexpectedEOF.
+func (cr *CaptureReader) Next() (*CapturedRequest, error) {
+	header := make([]byte, 8+ReqHeaderLen)
+	if _, err := io.ReadFull(cr.r, header); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[12:])
+	if length < ReqHeaderLen {
+		return nil, ErrBadCapture
+	}
+
+	raw := make([]byte, length)
+	copy(raw, header[8:])
+	if _, err := io.ReadFull(cr.r, raw[ReqHeaderLen:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	req := &Request{
+		Cmd:    Cmd(binary.BigEndian.Uint32(raw)),
+		Length: length,
+		Body:   raw[ReqHeaderLen:],
+	}
+	if req.Cmd&CmdFlagEscaped != 0 {
+		req.Cmd &^= CmdFlagEscaped
+		req.Escaped = true
+	}
+
+	return &CapturedRequest{
+		Time:    time.Unix(0, int64(binary.BigEndian.Uint64(header))),
+		Request: req,
+		Raw:     raw,
+	}, nil
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCapture(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "agent.cap")
+
+	srv := NewServer(&Config{Addr: "127.0.0.1:0", CaptureFile: filename})
+	srv.Handle(CmdSendMessage, func(req *Request) (Status, []byte) {
+		return StatusOk, nil
+	})
+
+	reqs := []*Request{
+		{Cmd: CmdSendMessage, Length: ReqHeaderLen + 5, Body: []byte("first")},
+		{Cmd: CmdSendMessage, Length: ReqHeaderLen + 6, Body: []byte("second"), Escaped: true},
+		// the requests of the cmds without a handler are captured too.
+		{Cmd: CmdCreateMessageId, Length: ReqHeaderLen + 4, Body: []byte("demo")},
+	}
+	for _, req := range reqs {
+		srv.Dispatch(req)
+	}
+
+	// a reload without capture_file stops the capture.
+	srv.Reload(&Config{Addr: "127.0.0.1:0"})
+	srv.Dispatch(&Request{Cmd: CmdSendMessage, Length: ReqHeaderLen + 4, Body: []byte("lost")})
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("open capture error: %s", err)
+	}
+	defer f.Close()
+
+	reader, err := NewCaptureReader(f)
+	if err != nil {
+		t.Fatalf("new capture reader error: %s", err)
+	}
+
+	for i, expected := range reqs {
+		captured, err := reader.Next()
+		if err != nil {
+			t.Fatalf("record %d: next error: %s", i, err)
+		}
+
+		req := captured.Request
+		if req.Cmd != expected.Cmd || req.Length != expected.Length || req.Escaped != expected.Escaped || !bytes.Equal(req.Body, expected.Body) {
+			t.Fatalf("record %d: request %+v, expected %+v", i, req, expected)
+		}
+		if captured.Time.IsZero() {
+			t.Fatalf("record %d: the time has not been recorded", i)
+		}
+
+		// Raw can be written to an agent as it is.
+		raw := make([]byte, ReqHeaderLen, expected.Length)
+		cmd := expected.Cmd
+		if expected.Escaped {
+			cmd |= CmdFlagEscaped
+		}
+		binary.BigEndian.PutUint32(raw, uint32(cmd))
+		binary.BigEndian.PutUint32(raw[4:], expected.Length)
+		if raw = append(raw, expected.Body...); !bytes.Equal(captured.Raw, raw) {
+			t.Fatalf("record %d: raw %v, expected %v", i, captured.Raw, raw)
+		}
+	}
+
+	if _, err = reader.Next(); err != io.EOF {
+		t.Fatalf("next after the last record: %v, expected EOF", err)
+	}
+}
+
+func TestCaptureMaxBytes(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "agent.cap")
+
+	// room for the magic and 3 records of 4 bytes bodies.
+	recordLen := 8 + ReqHeaderLen + 4
+	capture, err := NewCapture(filename, int64(len(CaptureMagic)+3*recordLen+recordLen/2))
+	if err != nil {
+		t.Fatalf("new capture error: %s", err)
+	}
+	for i := 0; i < 10; i++ {
+		capture.Record(&Request{Cmd: CmdSendMessage, Length: ReqHeaderLen + 4, Body: []byte("body")})
+	}
+	if err = capture.Close(); err != nil {
+		t.Fatalf("close capture error: %s", err)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("open capture error: %s", err)
+	}
+	defer f.Close()
+
+	reader, err := NewCaptureReader(f)
+	if err != nil {
+		t.Fatalf("new capture reader error: %s", err)
+	}
+	records := 0
+	for {
+		if _, err = reader.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("record %d: next error: %s", records, err)
+		}
+		records++
+	}
+	if records != 3 {
+		t.Fatalf("%d records captured, expected the 3 that fit in the max bytes", records)
+	}
+}
+
+func TestCaptureReaderMalformed(t *testing.T) {
+	if _, err := NewCaptureReader(bytes.NewReader([]byte("CATCAP2\n"))); err != ErrBadCapture {
+		t.Fatalf("bad magic: %v, expected %v", err, ErrBadCapture)
+	}
+
+	cut := append(append([]byte{}, CaptureMagic...), 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 3, 0, 0, 0, 12, 'a')
+	reader, err := NewCaptureReader(bytes.NewReader(cut))
+	if err != nil {
+		t.Fatalf("new capture reader error: %s", err)
+	}
+	if _, err = reader.Next(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("cut record: %v, expected %v", err, io.ErrUnexpectedEOF)
+	}
+}
@@ -2,6 +2,10 @@ package server
 
 type Config struct {
 	Addr               string `yaml:"addr"`
+	HttpAddr           string `yaml:"http_addr"`
+	NativeAddr         string `yaml:"native_addr"`
+	CaptureFile        string `yaml:"capture_file"`
+	CaptureMaxBytes    int64  `yaml:"capture_max_bytes"`
 	ReadTimeoutMillis  int    `yaml:"read_timeout_millis"`
 	WriteTimeoutMillis int    `yaml:"write_timeout_millis"`
 }
@@ -11,6 +15,10 @@ func withDefaultConf(config *Config) {
 		config.Addr = "127.0.0.1:2280"
 	}
 
+	if config.CaptureMaxBytes < 1 {
+		config.CaptureMaxBytes = 1 << 30
+	}
+
 	if config.ReadTimeoutMillis < 1 {
 		config.ReadTimeoutMillis = 5000
 	}
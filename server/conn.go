@@ -42,18 +42,9 @@ func (c *conn) serve() {
 			break
 		}
 
-		if handler, exists := c.server.handlers[req.Cmd]; exists {
-			status, payload := handler(req)
-			if req.Cmd != CmdSendMessage {
-				err = c.sendResponse(status, payload)
-				if err != nil {
-					log.Errorf("conn send response error: %s", err)
-					break
-				}
-			}
-
-		} else {
-			err = c.sendResponse(StatusNotFoundCmd, nil)
+		status, payload := c.server.Dispatch(req)
+		if req.Cmd.Answered() || status == StatusNotFoundCmd {
+			err = c.sendResponse(status, payload)
 			if err != nil {
 				log.Errorf("conn send response error: %s", err)
 				break
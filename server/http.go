@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/Orlion/cat-agent/log"
+)
+
+// MaxHttpBodyBytes is the largest body accepted by the http front end.
+const MaxHttpBodyBytes = 16 << 20
+
+// newHttpServer creates the http front end of srv, it turns every http request into a Request and
+// dispatches it to the handler of its cmd, so both listeners share the same handlers:
+//
+//	POST /messages                          a tree, CmdSendMessageJson if the content type is application/json,
+//	                                        otherwise CmdSendMessageAck, ?escaped=1 sets Request.Escaped.
+//	GET  /message-id?domain=...             CmdCreateMessageId.
+//	GET  /message-ids?domain=...&count=...  CmdCreateMessageIds, the ids are separated by newlines.
+//
+// The status of the handler is returned in the X-Cat-Status header, the body is its payload except for
+// CmdSendMessageAck which answers with the decimal cat.SendResult of the tree.
+func newHttpServer(srv *Server) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/messages", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxHttpBodyBytes))
+		if err != nil {
+			http.Error(w, "read body error: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		req := &Request{Cmd: CmdSendMessageAck, Length: uint32(ReqHeaderLen + len(body)), Body: body}
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+			req.Cmd = CmdSendMessageJson
+		} else {
+			req.Escaped = r.URL.Query().Get("escaped") == "1"
+		}
+
+		srv.serveHttp(w, req)
+	})
+	mux.HandleFunc("/message-id", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body := []byte(r.URL.Query().Get("domain"))
+		srv.serveHttp(w, &Request{Cmd: CmdCreateMessageId, Length: uint32(ReqHeaderLen + len(body)), Body: body})
+	})
+	mux.HandleFunc("/message-ids", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		body := []byte(query.Get("domain") + "\t" + query.Get("count"))
+		srv.serveHttp(w, &Request{Cmd: CmdCreateMessageIds, Length: uint32(ReqHeaderLen + len(body)), Body: body})
+	})
+
+	return &http.Server{
+		Handler:      mux,
+		ReadTimeout:  srv.ReadTimeout(),
+		WriteTimeout: srv.WriteTimeout(),
+	}
+}
+
+// serveHttp dispatches req like a request of a connection and writes the response to w.
+func (srv *Server) serveHttp(w http.ResponseWriter, req *Request) {
+	status, payload := srv.Dispatch(req)
+	w.Header().Set("X-Cat-Status", status.String())
+	if status == StatusNotFoundCmd {
+		http.Error(w, status.String(), http.StatusNotFound)
+		return
+	}
+
+	if status != StatusOk {
+		if len(payload) == 0 {
+			payload = []byte(status.String())
+		}
+		code := http.StatusBadRequest
+		if status == StatusMessageIdErr {
+			code = http.StatusServiceUnavailable
+		}
+		http.Error(w, string(payload), code)
+		return
+	}
+
+	if req.Cmd == CmdSendMessageAck && len(payload) == 4 {
+		payload = []byte(strconv.FormatUint(uint64(binary.BigEndian.Uint32(payload)), 10))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := w.Write(payload); err != nil {
+		log.Warnf("http server write response of %s error: %s", req.Cmd.String(), err.Error())
+	}
+}
+
+func (srv *Server) listenAndServeHttp() (err error) {
+	listener, err := net.Listen("tcp", srv.HttpAddr)
+	if err != nil {
+		return
+	}
+
+	srv.httpSrv = newHttpServer(srv)
+
+	log.Infof("http server listen on %s...", srv.HttpAddr)
+
+	go func() {
+		if err := srv.httpSrv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("http server serve error: %s", err.Error())
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Orlion/cat-agent/log"
+)
+
+func init() {
+	log.Init(&log.Config{
+		StdoutLevel: "error",
+	})
+}
+
+func TestHttpServer(t *testing.T) {
+	srv := NewServer(&Config{})
+	var last *Request
+	srv.Handle(CmdCreateMessageIds, func(req *Request) (Status, []byte) {
+		last = req
+		return StatusOk, []byte("domain-7f000001-447323-1\ndomain-7f000001-447323-2")
+	})
+	srv.Handle(CmdSendMessageAck, func(req *Request) (Status, []byte) {
+		last = req
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, 2)
+		return StatusOk, payload
+	})
+	srv.Handle(CmdSendMessageJson, func(req *Request) (Status, []byte) {
+		last = req
+		return StatusMsgReadMessageErr, []byte("message: name cannot be empty")
+	})
+
+	ts := httptest.NewServer(newHttpServer(srv).Handler)
+	defer ts.Close()
+
+	for _, c := range []struct {
+		method, path, contentType, body string
+		cmd                             Cmd
+		reqBody                         string
+		escaped                         bool
+		code                            int
+		status                          Status
+		respBody                        string
+	}{
+		{http.MethodGet, "/message-ids?domain=domain&count=2", "", "", CmdCreateMessageIds, "domain\t2", false, http.StatusOK, StatusOk, "domain-7f000001-447323-1\ndomain-7f000001-447323-2"},
+		{http.MethodPost, "/messages?escaped=1", "text/plain", "E\tSQL\tselect\t0\t1600000000000\t\t\n", CmdSendMessageAck, "E\tSQL\tselect\t0\t1600000000000\t\t\n", true, http.StatusOK, StatusOk, "2"},
+		{http.MethodPost, "/messages", "application/json; charset=utf-8", "{}", CmdSendMessageJson, "{}", false, http.StatusBadRequest, StatusMsgReadMessageErr, "message: name cannot be empty\n"},
+	} {
+		last = nil
+		req, _ := http.NewRequest(c.method, ts.URL+c.path, strings.NewReader(c.body))
+		if c.contentType != "" {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s error: %s", c.method, c.path, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if last == nil || last.Cmd != c.cmd || string(last.Body) != c.reqBody || last.Escaped != c.escaped {
+			t.Fatalf("%s %s dispatched %+v, expected cmd %s with body %q", c.method, c.path, last, c.cmd, c.reqBody)
+		}
+		if resp.StatusCode != c.code || resp.Header.Get("X-Cat-Status") != c.status.String() || string(body) != c.respBody {
+			t.Fatalf("%s %s answered %d %s %q, expected %d %s %q", c.method, c.path, resp.StatusCode, resp.Header.Get("X-Cat-Status"), body, c.code, c.status, c.respBody)
+		}
+	}
+
+	resp, err := http.Get(ts.URL + "/message-id?domain=domain")
+	if err != nil {
+		t.Fatalf("GET /message-id error: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET /message-id answered %d without a handler, expected %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/Orlion/cat-agent/log"
+)
+
+// MaxNativeFrameBytes is the largest tree accepted from a native cat client.
+const MaxNativeFrameBytes = 16 << 20
+
+// listenAndServeNative listens to the native cat clients, they send the trees the way they send them to
+// a cat router: every tree is a big endian uint32 length followed by the tree encoded in NT1. Each tree is
+// dispatched to the handler of CmdSendMessageNative and never answered.
+func (srv *Server) listenAndServeNative() (err error) {
+	srv.nativeListener, err = net.Listen("tcp", srv.NativeAddr)
+	if err != nil {
+		return
+	}
+
+	log.Infof("native server listen on %s...", srv.NativeAddr)
+
+	go srv.serveNative()
+
+	return nil
+}
+
+func (srv *Server) serveNative() {
+	for {
+		rwc, err := srv.nativeListener.Accept()
+		if err != nil {
+			select {
+			case <-srv.getDoneChan():
+				return
+			default:
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Warnf("native server accept temporary error: %s", err)
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+
+			log.Errorf("native server accept error: %s", err)
+			return
+		}
+
+		srv.nativeMu.Lock()
+		srv.nativeConns[rwc] = struct{}{}
+		srv.nativeMu.Unlock()
+		srv.incrConnNum()
+
+		log.Debugf("native server new conn from %s", rwc.RemoteAddr().String())
+
+		go srv.serveNativeConn(rwc)
+	}
+}
+
+// serveNativeConn reads the trees of a native client until it disconnects. Native clients keep their
+// connections open while they are idle, so there is no read timeout, closeNativeConns interrupts the read.
+func (srv *Server) serveNativeConn(rwc net.Conn) {
+	defer func() {
+		rwc.Close()
+		srv.nativeMu.Lock()
+		delete(srv.nativeConns, rwc)
+		srv.nativeMu.Unlock()
+		srv.decrConnNum()
+		if err := recover(); err != nil {
+			log.Errorf("native conn serve panic, err: %v", err)
+		}
+	}()
+
+	remoteAddr := rwc.RemoteAddr().String()
+	bufr := bufio.NewReader(rwc)
+	header := make([]byte, 4)
+
+	for !srv.shuttingDown() {
+		req, err := readNativeRequest(bufr, header)
+		if err != nil {
+			if errors.Is(err, io.EOF) || srv.shuttingDown() {
+				log.Infof("native conn from %s closed", remoteAddr)
+			} else {
+				log.Errorf("native conn read tree from %s error: %s", remoteAddr, err.Error())
+			}
+			return
+		}
+
+		srv.Dispatch(req)
+	}
+}
+
+func readNativeRequest(r io.Reader, header []byte) (*Request, error) {
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	if length > MaxNativeFrameBytes {
+		return nil, fmt.Errorf("tree of %d bytes is larger than %d bytes", length, MaxNativeFrameBytes)
+	}
+
+	req := &Request{
+		Cmd:    CmdSendMessageNative,
+		Length: length,
+		Body:   make([]byte, length),
+	}
+	if _, err := io.ReadFull(r, req.Body); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// closeNativeConns interrupts the reads of the native connections, the trees they have not sent
+// completely are lost like the ones of a native client that loses its router.
+func (srv *Server) closeNativeConns() {
+	srv.nativeMu.Lock()
+	defer srv.nativeMu.Unlock()
+
+	for rwc := range srv.nativeConns {
+		rwc.SetReadDeadline(time.Now())
+	}
+}
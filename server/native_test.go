@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNativeServer(t *testing.T) {
+	srv := NewServer(&Config{Addr: "127.0.0.1:0", NativeAddr: "127.0.0.1:0"})
+	trees := make(chan []byte, 2)
+	srv.Handle(CmdSendMessageNative, func(req *Request) (Status, []byte) {
+		trees <- req.Body
+		return StatusOk, nil
+	})
+
+	if err := srv.ListenAndServe(); err != nil {
+		t.Fatalf("listen error: %s", err)
+	}
+
+	c, err := net.Dial("tcp", srv.nativeListener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %s", err)
+	}
+	defer c.Close()
+
+	var frames []byte
+	for _, tree := range []string{"NT1 first", "NT1 second"} {
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, uint32(len(tree)))
+		frames = append(append(frames, header...), tree...)
+	}
+	// both frames are written at once, like a batch of the cat clients.
+	if _, err = c.Write(frames); err != nil {
+		t.Fatalf("write error: %s", err)
+	}
+
+	for _, expected := range []string{"NT1 first", "NT1 second"} {
+		select {
+		case tree := <-trees:
+			if string(tree) != expected {
+				t.Fatalf("tree: %q, expected: %q", tree, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("tree %q has not been dispatched", expected)
+		}
+	}
+
+	// the idle connection of the native client does not hold up the shutdown.
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err = srv.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown error: %s", err)
+	}
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"encoding/binary"
 	"io"
+	"strconv"
 	"time"
 
 	"github.com/Orlion/cat-agent/log"
@@ -13,19 +14,72 @@ type Cmd uint32
 const (
 	CmdCreateMessageId Cmd = iota + 1
 	CmdSendMessage
+	// CmdSendMessageAck has the same body as CmdSendMessage, it is answered with the parse status
+	// and the cat.SendResult of the tree.
+	CmdSendMessageAck
+	// CmdCreateMessageIds takes a body of domain and count separated by a tab, it is answered with
+	// count consecutive message ids separated by newlines.
+	CmdCreateMessageIds
+	// CmdSendMessageBinary carries a tree in the compact binary body format, it is not answered like CmdSendMessage.
+	CmdSendMessageBinary
+	// CmdSendMessageJson carries a tree as a json document, it is answered with the messageId of the tree
+	// or with the validation error.
+	CmdSendMessageJson
+	// CmdSendMessageNative carries a tree encoded in NT1 by a native cat client, it is not answered like CmdSendMessage.
+	// The trees read by the native listener are dispatched with this cmd.
+	CmdSendMessageNative
 )
 
+// CmdFlagEscaped is set on the cmd of a request by clients that escape the tabs, newlines and backslashes
+// in the elements of a text body with a backslash. It is cleared before the request is dispatched.
+const CmdFlagEscaped Cmd = 1 << 31
+
+var cmdNames = map[Cmd]string{
+	CmdCreateMessageId:   "create_message_id",
+	CmdSendMessage:       "send_message",
+	CmdSendMessageAck:    "send_message_ack",
+	CmdCreateMessageIds:  "create_message_ids",
+	CmdSendMessageBinary: "send_message_binary",
+	CmdSendMessageJson:   "send_message_json",
+	CmdSendMessageNative: "send_message_native",
+}
+
+// Answered reports whether the clients wait for the response to cmd, an unknown cmd is answered with StatusNotFoundCmd.
+func (cmd Cmd) Answered() bool {
+	return cmd != CmdSendMessage && cmd != CmdSendMessageBinary && cmd != CmdSendMessageNative
+}
+
+func (cmd Cmd) String() string {
+	if name, exists := cmdNames[cmd]; exists {
+		return name
+	}
+	return strconv.Itoa(int(cmd))
+}
+
+// cmdLabelUnknown is the metric label of every cmd without a name, so that clients sending garbage can't
+// blow up the number of series.
+const cmdLabelUnknown = "unknown"
+
+func (cmd Cmd) metricLabel() string {
+	if name, exists := cmdNames[cmd]; exists {
+		return name
+	}
+	return cmdLabelUnknown
+}
+
 const ReqHeaderLen = 8
 
 type Request struct {
 	Cmd    Cmd
 	Length uint32
 	Body   []byte
+	// Escaped is set if the cmd carried CmdFlagEscaped.
+	Escaped bool
 }
 
 func (c *conn) readRequest() (req *Request, err error) {
-	if c.server.ReadTimeout != 0 {
-		err = c.rwc.SetReadDeadline(time.Now().Add(c.server.ReadTimeout))
+	if readTimeout := c.server.ReadTimeout(); readTimeout != 0 {
+		err = c.rwc.SetReadDeadline(time.Now().Add(readTimeout))
 		if err != nil {
 			return nil, err
 		}
@@ -41,6 +95,10 @@ func (c *conn) readRequest() (req *Request, err error) {
 	req = new(Request)
 	req.Cmd = Cmd(binary.BigEndian.Uint32(buf[0:4]))
 	req.Length = binary.BigEndian.Uint32(buf[4:8])
+	if req.Cmd&CmdFlagEscaped != 0 {
+		req.Cmd &^= CmdFlagEscaped
+		req.Escaped = true
+	}
 
 	log.Debugf("recv request from %s, cmd: %d, length: %d", c.rwc.RemoteAddr().String(), req.Cmd, req.Length)
 
@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/binary"
+	"strconv"
 	"time"
 
 	"github.com/Orlion/cat-agent/log"
@@ -15,8 +16,20 @@ const (
 	StatusMsgReadMessageErr
 	StatusNotFoundCmd
 	StatusBadDomain
+	StatusBadCount
+	// StatusMessageIdErr is returned when a message id could not be created, see cat.ErrMessageIdUnavailable.
+	StatusMessageIdErr
 )
 
+var statusNames = []string{"ok", "msg_read_header_err", "msg_read_message_err", "not_found_cmd", "bad_domain", "bad_count", "message_id_err"}
+
+func (status Status) String() string {
+	if int(status) < len(statusNames) {
+		return statusNames[status]
+	}
+	return strconv.Itoa(int(status))
+}
+
 const RespHeaderLen = 8
 
 type response struct {
@@ -26,8 +39,8 @@ type response struct {
 }
 
 func (c *conn) sendResponse(status Status, payload []byte) (err error) {
-	if c.server.WriteTimeout != 0 {
-		err = c.rwc.SetWriteDeadline(time.Now().Add(c.server.ReadTimeout))
+	if writeTimeout := c.server.WriteTimeout(); writeTimeout != 0 {
+		err = c.rwc.SetWriteDeadline(time.Now().Add(writeTimeout))
 		if err != nil {
 			return
 		}
@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"context"
 	"errors"
+	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"strings"
 	"sync"
@@ -12,6 +14,7 @@ import (
 	"time"
 
 	"github.com/Orlion/cat-agent/log"
+	"github.com/Orlion/cat-agent/metrics"
 	"github.com/Orlion/cat-agent/pkg/atomicx"
 )
 
@@ -23,10 +26,14 @@ var (
 type Handler func(req *Request) (status Status, payload []byte)
 
 type Server struct {
-	Addr         string
-	ReadTimeout  time.Duration
-	WriteTimeout time.Duration
-	IdleTimeout  time.Duration
+	Addr string
+	// HttpAddr is the tcp address of the http front end, it is disabled if empty.
+	HttpAddr string
+	// NativeAddr is the tcp address the native cat clients send their trees to, it is disabled if empty.
+	NativeAddr string
+
+	readTimeout  int64
+	writeTimeout int64
 
 	handlers map[Cmd]Handler
 
@@ -36,22 +43,139 @@ type Server struct {
 	listener net.Listener
 	doneChan chan struct{}
 	connNum  int64
+
+	httpSrv *http.Server
+
+	nativeListener net.Listener
+	nativeMu       sync.Mutex
+	nativeConns    map[net.Conn]struct{}
+
+	captureMu   sync.Mutex
+	capture     *Capture
+	captureFile string
 }
 
 func NewServer(config *Config) *Server {
 	withDefaultConf(config)
-	return &Server{
-		Addr:         config.Addr,
-		ReadTimeout:  time.Duration(config.ReadTimeoutMillis) * time.Millisecond,
-		WriteTimeout: time.Duration(config.WriteTimeoutMillis) * time.Millisecond,
-		handlers:     make(map[Cmd]Handler),
+	srv := &Server{
+		Addr:        config.Addr,
+		HttpAddr:    config.HttpAddr,
+		NativeAddr:  config.NativeAddr,
+		handlers:    make(map[Cmd]Handler),
+		nativeConns: make(map[net.Conn]struct{}),
+	}
+	srv.setTimeouts(config)
+	if err := srv.setCapture(config.CaptureFile, config.CaptureMaxBytes); err != nil {
+		log.Errorf("server capture to %s error: %s, capture has been disabled", config.CaptureFile, err.Error())
 	}
+	return srv
+}
+
+// CheckReload validates config and reports the changes that cannot be applied without a restart.
+func (srv *Server) CheckReload(config *Config) error {
+	withDefaultConf(config)
+	if config.Addr != srv.Addr {
+		return fmt.Errorf("server.addr changed from %s to %s, restart required", srv.Addr, config.Addr)
+	}
+	if config.HttpAddr != srv.HttpAddr {
+		return fmt.Errorf("server.http_addr changed from %s to %s, restart required", srv.HttpAddr, config.HttpAddr)
+	}
+	if config.NativeAddr != srv.NativeAddr {
+		return fmt.Errorf("server.native_addr changed from %s to %s, restart required", srv.NativeAddr, config.NativeAddr)
+	}
+
+	return nil
+}
+
+// Reload applies the read and write timeouts of config, they take effect on the next request of every connection.
+func (srv *Server) Reload(config *Config) error {
+	if err := srv.CheckReload(config); err != nil {
+		return err
+	}
+
+	srv.setTimeouts(config)
+	if err := srv.setCapture(config.CaptureFile, config.CaptureMaxBytes); err != nil {
+		log.Errorf("server capture to %s error: %s", config.CaptureFile, err.Error())
+	}
+	log.Infof("server config has been reloaded, read timeout: %dms, write timeout: %dms", config.ReadTimeoutMillis, config.WriteTimeoutMillis)
+
+	return nil
+}
+
+func (srv *Server) setTimeouts(config *Config) {
+	atomic.StoreInt64(&srv.readTimeout, int64(time.Duration(config.ReadTimeoutMillis)*time.Millisecond))
+	atomic.StoreInt64(&srv.writeTimeout, int64(time.Duration(config.WriteTimeoutMillis)*time.Millisecond))
+}
+
+func (srv *Server) ReadTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&srv.readTimeout))
+}
+
+func (srv *Server) WriteTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&srv.writeTimeout))
 }
 
 func (srv *Server) Handle(cmd Cmd, handler Handler) {
 	srv.handlers[cmd] = handler
 }
 
+// Dispatch records req to the capture if any and runs the handler of its cmd, a cmd without handler
+// gets StatusNotFoundCmd. Every listener of the server dispatches its requests here.
+func (srv *Server) Dispatch(req *Request) (status Status, payload []byte) {
+	srv.captureMu.Lock()
+	if srv.capture != nil {
+		srv.capture.Record(req)
+	}
+	srv.captureMu.Unlock()
+
+	metrics.Requests.WithLabelValues(req.Cmd.metricLabel()).Inc()
+
+	if handler, exists := srv.handlers[req.Cmd]; exists {
+		status, payload = handler(req)
+	} else {
+		status = StatusNotFoundCmd
+	}
+
+	if status != StatusOk {
+		metrics.RequestErrors.WithLabelValues(req.Cmd.metricLabel(), status.String()).Inc()
+	}
+
+	return
+}
+
+// setCapture starts recording the requests to filename until it reaches maxBytes, or stops if it is empty.
+func (srv *Server) setCapture(filename string, maxBytes int64) error {
+	srv.captureMu.Lock()
+	defer srv.captureMu.Unlock()
+
+	if filename == srv.captureFile {
+		if srv.capture != nil {
+			srv.capture.setMaxBytes(maxBytes)
+		}
+		return nil
+	}
+
+	var capture *Capture
+	if filename != "" {
+		var err error
+		if capture, err = NewCapture(filename, maxBytes); err != nil {
+			return err
+		}
+	}
+
+	if srv.capture != nil {
+		srv.capture.Close()
+		log.Infof("server capture to %s has been stopped", srv.captureFile)
+	}
+	if capture != nil {
+		log.Infof("server capture to %s has been started", filename)
+	}
+
+	srv.capture, srv.captureFile = capture, filename
+
+	return nil
+}
+
 func (srv *Server) ListenAndServe() (err error) {
 	network := "tcp"
 
@@ -67,6 +191,23 @@ func (srv *Server) ListenAndServe() (err error) {
 		return err
 	}
 
+	if srv.HttpAddr != "" {
+		if err = srv.listenAndServeHttp(); err != nil {
+			srv.listener.Close()
+			return err
+		}
+	}
+
+	if srv.NativeAddr != "" {
+		if err = srv.listenAndServeNative(); err != nil {
+			srv.listener.Close()
+			if srv.httpSrv != nil {
+				srv.httpSrv.Close()
+			}
+			return err
+		}
+	}
+
 	go srv.serve()
 
 	return nil
@@ -119,9 +260,21 @@ func (srv *Server) Shutdown(ctx context.Context) error {
 
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
+	defer srv.setCapture("", 0)
 
 	lnerr := srv.listener.Close()
+	if srv.nativeListener != nil {
+		srv.nativeListener.Close()
+	}
 	srv.closeDoneChanLocked()
+	srv.closeNativeConns()
+
+	// the http server stops accepting requests and waits for the ones in flight, like the connections below.
+	if srv.httpSrv != nil {
+		if err := srv.httpSrv.Shutdown(ctx); err != nil {
+			log.Errorf("http server shutdown error: %s", err.Error())
+		}
+	}
 
 	ticker := time.NewTicker(shutdownPollInterval)
 	defer ticker.Stop()
@@ -177,6 +330,11 @@ func (srv *Server) newConn(rwc net.Conn) *conn {
 	return c
 }
 
+// ConnNum returns the number of active connections.
+func (srv *Server) ConnNum() int64 {
+	return srv.getConnNum()
+}
+
 func (srv *Server) getConnNum() int64 {
 	return atomic.LoadInt64(&srv.connNum)
 }
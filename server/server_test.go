@@ -0,0 +1,27 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/Orlion/cat-agent/metrics"
+)
+
+func TestDispatchUnknownCmdMetrics(t *testing.T) {
+	srv := NewServer(&Config{Addr: "127.0.0.1:0"})
+
+	requests := metrics.Requests.WithLabelValues(cmdLabelUnknown).Get()
+	requestErrors := metrics.RequestErrors.WithLabelValues(cmdLabelUnknown, StatusNotFoundCmd.String()).Get()
+
+	for _, cmd := range []Cmd{200, 201, 202} {
+		if status, _ := srv.Dispatch(&Request{Cmd: cmd, Length: ReqHeaderLen}); status != StatusNotFoundCmd {
+			t.Fatalf("Dispatch of cmd %d status: %s, expected %s", cmd, status, StatusNotFoundCmd)
+		}
+	}
+
+	if n := metrics.Requests.WithLabelValues(cmdLabelUnknown).Get() - requests; n != 3 {
+		t.Fatalf("requests of unknown cmds: %d, expected 3", n)
+	}
+	if n := metrics.RequestErrors.WithLabelValues(cmdLabelUnknown, StatusNotFoundCmd.String()).Get() - requestErrors; n != 3 {
+		t.Fatalf("request errors of unknown cmds: %d, expected 3", n)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Orlion/cat-agent/cat"
@@ -20,6 +21,7 @@ type StatusUpdateTask struct {
 	statusExtensions []StatusExtension
 	done             chan struct{}
 	wg               *sync.WaitGroup
+	lastHeartbeat    atomic.Value
 }
 
 func newStatusUpdateTask(statusExtensions []StatusExtension) *StatusUpdateTask {
@@ -35,6 +37,7 @@ func (t *StatusUpdateTask) buildHeartbeat() {
 	trans := message.NewTransaction(config.TypeSystem, config.NameStatus, message.SUCCESS, "", timex.UnixMills(start), nil, 0)
 
 	data, extensionTransList := t.buildExtension()
+	t.lastHeartbeat.Store(data)
 	for _, extensionTrans := range extensionTransList {
 		trans.AddChild(extensionTrans)
 	}
@@ -44,10 +47,15 @@ func (t *StatusUpdateTask) buildHeartbeat() {
 	trans.SetDurationInMicros(time.Now().Sub(start).Milliseconds())
 
 	domain := config.GetInstance().GetDomain()
+	messageId, err := cat.CreateMessageId(domain)
+	if err != nil {
+		log.Errorf("status update task create message id error: %s, heartbeat has been dropped", err.Error())
+		return
+	}
+
 	tree := message.NewMessageTree()
 	tree.SetMessage(trans)
 	tree.SetDomain([]byte(domain))
-	messageId := cat.CreateMessageId(domain)
 	tree.SetMessageId(messageId)
 	tree.SetThreadGroupName(config.ThreadGroupNameCatAgent)
 	tree.SetThreadId([]byte(strconv.Itoa(os.Getpid())))
@@ -130,10 +138,15 @@ func (t *StatusUpdateTask) run() {
 func (t *StatusUpdateTask) sendRebootEvent() {
 	event := message.NewEvent(config.TypeSystem, config.NameReboot, message.SUCCESS, "", timex.NowUnixMillis())
 	domain := config.GetInstance().GetDomain()
+	messageId, err := cat.CreateMessageId(domain)
+	if err != nil {
+		log.Errorf("status update task create message id error: %s, reboot event has been dropped", err.Error())
+		return
+	}
+
 	tree := message.NewMessageTree()
 	tree.SetMessage(event)
 	tree.SetDomain([]byte(domain))
-	messageId := cat.CreateMessageId(domain)
 	tree.SetMessageId(messageId)
 	tree.SetThreadGroupName(config.ThreadGroupNameCatAgent)
 	tree.SetThreadId([]byte(strconv.Itoa(os.Getpid())))
@@ -164,6 +177,16 @@ func Init() {
 	task.run()
 }
 
+// GetLastHeartbeat returns the status xml of the last heartbeat, it is empty before the first heartbeat.
+func GetLastHeartbeat() string {
+	if task == nil {
+		return ""
+	}
+
+	data, _ := task.lastHeartbeat.Load().(string)
+	return data
+}
+
 func Shutdown() {
 	task.shutdown()
 }